@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	mathrand "math/rand/v2"
+	"os"
+	"path"
+	"slices"
+
+	"github.com/vitaliy/file-storage/common/merkleTree"
+)
+
+// maxChallengeFiles is how many files the server answers in one challenge.
+const maxChallengeFiles = 16
+
+// AuditResult is the outcome of auditing one set. The set passed when there
+// are no failures.
+type AuditResult struct {
+	Key string
+	// Sampled are the leaf indices of the files that were challenged.
+	Sampled []int
+	// Deleted is the number of files of the set that were deleted, which
+	// cannot be audited. Files that were not deleted by this client are
+	// failures.
+	Deleted  int
+	Failures []string
+}
+
+// StoredKeys returns the keys of all sets whose root is stored locally.
+func StoredKeys() ([]string, error) {
+	entries, err := os.ReadDir("merkle_roots")
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			keys = append(keys, entry.Name())
+		}
+	}
+
+	return keys, nil
+}
+
+// Audit challenges the server to prove that it still stores up to samples
+// randomly chosen files of key, and verifies the answer against the locally
+// stored root. Every problem is reported as a failure of the result, as is a
+// set of which no file could be sampled.
+func (f *FileUploadService) Audit(key string, samples int) *AuditResult {
+	result := &AuditResult{Key: key}
+	fail := func(format string, args ...any) *AuditResult {
+		result.Failures = append(result.Failures, fmt.Sprintf(format, args...))
+		return result
+	}
+
+	merkleRoot, err := os.ReadFile(path.Join("merkle_roots", key, "merkle_root"))
+	if err != nil {
+		return fail("reading the stored root: %v", err)
+	}
+
+	version, err := f.getVersion(key)
+	if err != nil {
+		return fail("reading the stored version: %v", err)
+	}
+
+	// The manifest is verified against the root, so the server cannot hide
+	// files from sampling by leaving them out.
+	manifest, err := f.ListFiles(key)
+	if err != nil {
+		return fail("verifying the manifest: %v", err)
+	}
+
+	deleted, err := deletedFiles(key)
+	if err != nil {
+		return fail("reading the deleted files: %v", err)
+	}
+
+	// A server could otherwise pass off lost files as deleted.
+	live := make([]int, 0, len(manifest.Files))
+	for _, file := range manifest.Files {
+		if file.Deleted {
+			result.Deleted++
+			if !slices.Contains(deleted, file.Index) {
+				fail("file %v is deleted, but not by this client", file.Index)
+			}
+			continue
+		}
+		live = append(live, file.Index)
+	}
+
+	for _, i := range mathrand.Perm(len(live))[:min(samples, len(live), maxChallengeFiles)] {
+		result.Sampled = append(result.Sampled, live[i])
+	}
+	slices.Sort(result.Sampled)
+
+	if len(result.Sampled) == 0 {
+		return fail("no file could be sampled, %v of %v files are deleted", result.Deleted, len(manifest.Files))
+	}
+
+	nonce := make([]byte, 32)
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return fail("creating a nonce: %v", err)
+	}
+
+	challenge, err := f.client.Challenge(key, version, hex.EncodeToString(nonce), result.Sampled)
+	if err != nil {
+		return fail("challenging the server: %v", err)
+	}
+
+	if challenge.Nonce != hex.EncodeToString(nonce) {
+		return fail("the server answered another challenge")
+	}
+	if challenge.HashAlgorithm != merkleTree.HashAlgorithm {
+		return fail("unsupported hash algorithm %v", challenge.HashAlgorithm)
+	}
+
+	answered := make(map[int]bool)
+	for _, sample := range challenge.Samples {
+		if !slices.Contains(result.Sampled, sample.Index) || answered[sample.Index] {
+			fail("file %v was not challenged", sample.Index)
+			continue
+		}
+		answered[sample.Index] = true
+
+		if sample.Deleted {
+			fail("file %v is deleted but listed as stored", sample.Index)
+			continue
+		}
+
+		err := verifySample(merkleRoot, sample)
+		if err != nil {
+			fail("file %v: %v", sample.Index, err)
+		}
+	}
+
+	for _, index := range result.Sampled {
+		if !answered[index] {
+			fail("file %v was not answered", index)
+		}
+	}
+
+	return result
+}
+
+// verifySample checks the content of a sampled file against merkleRoot with
+// the proof of the sample.
+func verifySample(merkleRoot []byte, sample ChallengeSampleResponse) error {
+	proof, err := decodeProof(sample.Proof)
+	if err != nil {
+		return err
+	}
+
+	hash, err := merkleTree.GetHashFromBytes(sample.Content)
+	if err != nil {
+		return err
+	}
+
+	ok, err := merkleTree.VerifyProof(merkleRoot, sample.Index, hash, proof)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("content does not match the stored root")
+	}
+
+	return nil
+}
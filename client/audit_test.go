@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/vitaliy/file-storage/common/merkleTree"
+)
+
+func TestVerifySample(t *testing.T) {
+	files := [][]byte{[]byte("a"), []byte("b"), []byte("c")}
+
+	hashes := make([][]byte, 0, len(files))
+	for _, file := range files {
+		hash, _ := merkleTree.GetHashFromBytes(file)
+		hashes = append(hashes, hash)
+	}
+
+	tree, err := merkleTree.NewMerkleTree(hashes)
+	if err != nil {
+		t.Fatalf("Error building tree: %v", err)
+	}
+
+	proof := make([]string, 0)
+	for _, hash := range merkleTree.GetProof(tree, 1) {
+		proof = append(proof, hex.EncodeToString(hash))
+	}
+
+	err = verifySample(tree.Root.Hash, ChallengeSampleResponse{Index: 1, Content: files[1], Proof: proof})
+	if err != nil {
+		t.Fatalf("Expected the sample to verify, got %v", err)
+	}
+
+	for _, sample := range []ChallengeSampleResponse{
+		{Index: 1, Content: []byte("changed"), Proof: proof},
+		{Index: 0, Content: files[1], Proof: proof},
+		{Index: 1, Content: files[1], Proof: proof[:1]},
+		{Index: 1, Proof: proof},
+	} {
+		err := verifySample(tree.Root.Hash, sample)
+		if err == nil {
+			t.Fatalf("Expected sample %+v not to verify", sample)
+		}
+	}
+}
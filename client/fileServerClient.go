@@ -10,76 +10,263 @@ import (
 	"mime"
 	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
 type FileServerClient struct {
+	http *http.Client
+	// apiKey is sent as bearer token with every request when it is set.
+	apiKey string
 }
 
+// UploadResponse describes the stored set together with the tree the server
+// computed for it.
 type UploadResponse struct {
-	Key string `json:"key"`
+	Key           string `json:"key"`
+	Version       int    `json:"version"`
+	Root          string `json:"root"`
+	LeafCount     int    `json:"leafCount"`
+	HashAlgorithm string `json:"hashAlgorithm"`
 }
 
 type ProofResponse struct {
-	Proof []string
+	Proof   []string
+	Version int `json:"version"`
+	Index   int `json:"index"`
 }
 
-func NewFileServerClient() *FileServerClient {
-	return &FileServerClient{}
+type ManifestResponse struct {
+	Key           string                 `json:"key"`
+	Version       int                    `json:"version"`
+	Root          string                 `json:"root"`
+	LeafCount     int                    `json:"leafCount"`
+	HashAlgorithm string                 `json:"hashAlgorithm"`
+	Created       time.Time              `json:"created"`
+	Owner         string                 `json:"owner,omitempty"`
+	Expires       *time.Time             `json:"expires,omitempty"`
+	LegalHold     bool                   `json:"legalHold"`
+	Encrypted     bool                   `json:"encrypted"`
+	Files         []ManifestFileResponse `json:"files"`
 }
 
-func (f *FileServerClient) GetFile(key string, num int) ([]byte, string, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%v/files?key=%v&filenumber=%v", FileServerUrl, key, num), nil)
+type ManifestFileResponse struct {
+	Index       int       `json:"index"`
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	LeafHash    string    `json:"leafHash"`
+	ContentType string    `json:"contentType"`
+	Uploaded    time.Time `json:"uploaded"`
+	Deleted     bool      `json:"deleted"`
+}
+
+// ErrorResponse is the body of every error response of the server.
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type VersionsResponse struct {
+	Key      string            `json:"key"`
+	Versions []VersionResponse `json:"versions"`
+}
+
+type VersionResponse struct {
+	Version int       `json:"version"`
+	Root    string    `json:"root"`
+	Created time.Time `json:"created"`
+}
+
+// ShareResponse describes a share link. Path is relative to the server.
+type ShareResponse struct {
+	Path    string    `json:"path"`
+	Key     string    `json:"key"`
+	Version int       `json:"version"`
+	Index   int       `json:"index"`
+	Name    string    `json:"name"`
+	Root    string    `json:"root"`
+	Expires time.Time `json:"expires"`
+}
+
+// CreateAPIKeyRequest is the body of a request for a new API key.
+type CreateAPIKeyRequest struct {
+	Owner string `json:"owner"`
+	Admin bool   `json:"admin"`
+}
+
+// APIKeyResponse describes an API key. The token is only returned when the
+// key is created.
+type APIKeyResponse struct {
+	ID      string    `json:"id"`
+	Owner   string    `json:"owner"`
+	Admin   bool      `json:"admin"`
+	Created time.Time `json:"created"`
+	Token   string    `json:"token,omitempty"`
+}
+
+type APIKeysResponse struct {
+	Keys []APIKeyResponse `json:"keys"`
+}
+
+type RotateMasterKeyResponse struct {
+	Rewrapped int `json:"rewrapped"`
+}
+
+type ChallengeRequest struct {
+	Nonce string `json:"nonce"`
+	Files []int  `json:"files"`
+}
+
+type ChallengeResponse struct {
+	Key           string                    `json:"key"`
+	Version       int                       `json:"version"`
+	Root          string                    `json:"root"`
+	HashAlgorithm string                    `json:"hashAlgorithm"`
+	Nonce         string                    `json:"nonce"`
+	Samples       []ChallengeSampleResponse `json:"samples"`
+}
+
+type ChallengeSampleResponse struct {
+	Index   int      `json:"index"`
+	Content []byte   `json:"content,omitempty"`
+	Proof   []string `json:"proof"`
+	Deleted bool     `json:"deleted,omitempty"`
+}
+
+type AuditEntryResponse struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor,omitempty"`
+	Operation string    `json:"operation"`
+	Key       string    `json:"key,omitempty"`
+	Version   int       `json:"version,omitempty"`
+	File      *int      `json:"file,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	Prev      string    `json:"prev"`
+	Hash      string    `json:"hash"`
+}
+
+type AuditLogResponse struct {
+	Entries []AuditEntryResponse `json:"entries"`
+}
+
+type AuditVerificationResponse struct {
+	Valid   bool   `json:"valid"`
+	Entries int    `json:"entries"`
+	Head    string `json:"head"`
+	Error   string `json:"error,omitempty"`
+}
+
+type UsageResponse struct {
+	Identity       string  `json:"identity"`
+	Bytes          int64   `json:"bytes"`
+	Sets           int     `json:"sets"`
+	MaxBytes       int64   `json:"maxBytes"`
+	MaxSets        int     `json:"maxSets"`
+	MaxFilesPerSet int     `json:"maxFilesPerSet"`
+	RateLimit      float64 `json:"rateLimit"`
+	RateBurst      int     `json:"rateBurst"`
+}
+
+func NewFileServerClient(options TLSOptions, apiKey string) (*FileServerClient, error) {
+	client, err := newHTTPClient(options)
 	if err != nil {
-		return nil, "", err
+		return nil, err
+	}
+
+	return &FileServerClient{http: client, apiKey: apiKey}, nil
+}
+
+// do sends req with the credentials of the client.
+func (f *FileServerClient) do(req *http.Request) (*http.Response, error) {
+	if f.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+f.apiKey)
 	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	return f.http.Do(req)
+}
+
+// GetFile downloads a file together with its proof in a single request, so
+// both always come from the same version of the set.
+func (f *FileServerClient) GetFile(key string, version int, num int) ([]byte, string, [][]byte, error) {
+	file, name, proof, _, err := f.getFile(fmt.Sprintf("%v/files/%v?version=%v&proof=true", setUrl(key), num, version))
+	return file, name, proof, err
+}
+
+// GetFileByName downloads the file called name together with its proof and
+// returns the leaf index the server resolved the name to.
+func (f *FileServerClient) GetFileByName(key string, version int, name string) ([]byte, [][]byte, int, error) {
+	file, _, proof, index, err := f.getFile(fmt.Sprintf("%v/names/%v?version=%v&proof=true", setUrl(key), url.PathEscape(name), version))
+	return file, proof, index, err
+}
+
+func (f *FileServerClient) getFile(fileUrl string) ([]byte, string, [][]byte, int, error) {
+	req, err := http.NewRequest("GET", fileUrl, nil)
+	if err != nil {
+		return nil, "", nil, 0, err
+	}
+
+	resp, err := f.do(req)
 	if err != nil {
-		return nil, "", err
+		return nil, "", nil, 0, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", nil, 0, responseError(resp)
+	}
+
 	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition"))
 	if err != nil {
-		return nil, "", err
+		return nil, "", nil, 0, err
 	}
 	filename := params["filename"]
 
-	response, err := io.ReadAll(resp.Body)
+	proof, err := decodeProofHeader(resp.Header.Get("X-Merkle-Proof"))
 	if err != nil {
-		return nil, "", err
+		return nil, "", nil, 0, err
 	}
 
-	return response, filename, nil
-}
-
-func (f *FileServerClient) GetProof(key string, num int) ([][]byte, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("%v/proof?key=%v&filenumber=%v", FileServerUrl, key, num), nil)
+	index, err := strconv.Atoi(resp.Header.Get("X-Merkle-Index"))
 	if err != nil {
-		return nil, err
+		return nil, "", nil, 0, err
 	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	response, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return nil, "", nil, 0, err
 	}
-	defer resp.Body.Close()
 
-	var proofResponse ProofResponse
-	err = json.NewDecoder(resp.Body).Decode(&proofResponse)
-	if err != nil {
-		return nil, err
+	return response, filename, proof, index, nil
+}
+
+func decodeProofHeader(header string) ([][]byte, error) {
+	proof := make([][]byte, 0)
+	if header == "" {
+		return proof, nil
 	}
 
-	proof := make([][]byte, 0, len(proofResponse.Proof))
+	for _, v := range strings.Split(header, ",") {
+		decoded, err := hex.DecodeString(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		proof = append(proof, decoded)
+	}
+
+	return proof, nil
+}
+
+// decodeProof decodes the hex encoded hashes of a ProofResponse.
+func decodeProof(hashes []string) ([][]byte, error) {
+	proof := make([][]byte, 0, len(hashes))
 
-	for _, v := range proofResponse.Proof {
+	for _, v := range hashes {
 		decoded, err := hex.DecodeString(v)
 		if err != nil {
 			return nil, err
@@ -90,10 +277,13 @@ func (f *FileServerClient) GetProof(key string, num int) ([][]byte, error) {
 	return proof, nil
 }
 
-func (f *FileServerClient) UploadFiles(dirName string) (string, error) {
+// UploadFiles uploads the files in dirName. When key is not empty the set
+// stored under key is replaced, provided its current root is expectedRoot.
+// The server rejects the upload unless it computes merkleRoot for the files.
+func (f *FileServerClient) UploadFiles(dirName string, key string, expectedRoot []byte, merkleRoot []byte) (*UploadResponse, error) {
 	entries, err := os.ReadDir(dirName)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	body := &bytes.Buffer{}
@@ -106,36 +296,435 @@ func (f *FileServerClient) UploadFiles(dirName string) (string, error) {
 	for _, entry := range entries {
 		err := addFileMultipart(writer, filepath.Join(dirName, entry.Name()))
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 	}
 
 	err = writer.Close()
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	// A new set is created without a key; a key names the set to replace.
+	method, uploadUrl := "POST", FileServerUrl+"/v1/sets"
+	if key != "" {
+		method, uploadUrl = "PUT", setUrl(key)
 	}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%v/upload", FileServerUrl), body)
+	req, err := http.NewRequest(method, uploadUrl, body)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("X-Merkle-Root", hex.EncodeToString(merkleRoot))
+	if expectedRoot != nil {
+		req.Header.Set("If-Match", fmt.Sprintf("%q", hex.EncodeToString(expectedRoot)))
+	}
+	if SetTTL != "" {
+		req.Header.Set("X-Set-TTL", SetTTL)
+	}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	resp, err := f.do(req)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return nil, fmt.Errorf("set %v was modified on the server since it was last uploaded", key)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, responseError(resp)
+	}
+
 	var uploadResponse UploadResponse
 	err = json.NewDecoder(resp.Body).Decode(&uploadResponse)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	return &uploadResponse, nil
+}
+
+func (f *FileServerClient) GetVersions(key string) (*VersionsResponse, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%v/versions", setUrl(key)), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	var versionsResponse VersionsResponse
+	err = json.NewDecoder(resp.Body).Decode(&versionsResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return &versionsResponse, nil
+}
+
+func (f *FileServerClient) GetManifest(key string, version int) (*ManifestResponse, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%v?version=%v", setUrl(key), version), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	var manifestResponse ManifestResponse
+	err = json.NewDecoder(resp.Body).Decode(&manifestResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return &manifestResponse, nil
+}
+
+// GetArchive streams a version of key as a tar archive of its manifest,
+// proofs and files. The caller closes the returned reader.
+func (f *FileServerClient) GetArchive(key string, version int) (io.ReadCloser, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%v/archive?version=%v", setUrl(key), version), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+
+	return resp.Body, nil
+}
+
+func (f *FileServerClient) DeleteSet(key string) error {
+	return f.delete(setUrl(key))
+}
+
+func (f *FileServerClient) DeleteFile(key string, version int, num int) error {
+	return f.delete(fmt.Sprintf("%v/files/%v?version=%v", setUrl(key), num, version))
+}
+
+func (f *FileServerClient) SetLegalHold(key string, hold bool) error {
+	method := "DELETE"
+	if hold {
+		method = "PUT"
+	}
+
+	return f.send(method, setUrl(key)+"/hold")
+}
+
+func (f *FileServerClient) delete(deleteUrl string) error {
+	return f.send("DELETE", deleteUrl)
+}
+
+// send makes a request that is answered without content.
+func (f *FileServerClient) send(method string, requestUrl string) error {
+	req, err := http.NewRequest(method, requestUrl, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := f.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return responseError(resp)
+	}
+
+	return nil
+}
+
+// ShareFile asks the server to sign a link to a file of a version of key,
+// addressed by its leaf index or, when byName is set, by its name. An empty
+// ttl uses the default of the server.
+func (f *FileServerClient) ShareFile(key string, version int, file string, byName bool, ttl string) (*ShareResponse, error) {
+	fileUrl := fmt.Sprintf("%v/files/%v", setUrl(key), file)
+	if byName {
+		fileUrl = fmt.Sprintf("%v/names/%v", setUrl(key), url.PathEscape(file))
+	}
+
+	query := url.Values{}
+	query.Set("version", strconv.Itoa(version))
+	if ttl != "" {
+		query.Set("ttl", ttl)
+	}
+
+	req, err := http.NewRequest("POST", fileUrl+"/share?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	var shareResponse ShareResponse
+	err = json.NewDecoder(resp.Body).Decode(&shareResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return &shareResponse, nil
+}
+
+// CreateAPIKey creates an API key for owner. Only admins may create keys.
+func (f *FileServerClient) CreateAPIKey(owner string, admin bool) (*APIKeyResponse, error) {
+	body, err := json.Marshal(CreateAPIKeyRequest{Owner: owner, Admin: admin})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", FileServerUrl+"/v1/keys", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := f.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, responseError(resp)
+	}
+
+	var keyResponse APIKeyResponse
+	err = json.NewDecoder(resp.Body).Decode(&keyResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return &keyResponse, nil
+}
+
+func (f *FileServerClient) ListAPIKeys() (*APIKeysResponse, error) {
+	req, err := http.NewRequest("GET", FileServerUrl+"/v1/keys", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	var keysResponse APIKeysResponse
+	err = json.NewDecoder(resp.Body).Decode(&keysResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return &keysResponse, nil
+}
+
+func (f *FileServerClient) RevokeAPIKey(id string) error {
+	return f.delete(fmt.Sprintf("%v/v1/keys/%v", FileServerUrl, url.PathEscape(id)))
+}
+
+// RotateMasterKey has the server wrap all data keys with its current master key.
+func (f *FileServerClient) RotateMasterKey() (*RotateMasterKeyResponse, error) {
+	req, err := http.NewRequest("POST", FileServerUrl+"/v1/admin/master-key/rotate", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	var rotateResponse RotateMasterKeyResponse
+	err = json.NewDecoder(resp.Body).Decode(&rotateResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rotateResponse, nil
+}
+
+// GetUsage returns the usage and limits of the caller, or of identity when
+// it is set, which only admins may ask for.
+func (f *FileServerClient) GetUsage(identity string) (*UsageResponse, error) {
+	usageUrl := FileServerUrl + "/v1/usage"
+	if identity != "" {
+		usageUrl += "?identity=" + url.QueryEscape(identity)
+	}
+
+	req, err := http.NewRequest("GET", usageUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	var usageResponse UsageResponse
+	err = json.NewDecoder(resp.Body).Decode(&usageResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return &usageResponse, nil
+}
+
+// Challenge asks the server to prove that it stores the files with the
+// given leaf indices in a version of key.
+func (f *FileServerClient) Challenge(key string, version int, nonce string, files []int) (*ChallengeResponse, error) {
+	body, err := json.Marshal(ChallengeRequest{Nonce: nonce, Files: files})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%v/challenge?version=%v", setUrl(key), version), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := f.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	var challengeResponse ChallengeResponse
+	err = json.NewDecoder(resp.Body).Decode(&challengeResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return &challengeResponse, nil
+}
+
+// ExportAuditLog returns the entries of the audit log of the server made from
+// from up to, but excluding, to. Empty times leave the range open.
+func (f *FileServerClient) ExportAuditLog(from string, to string) (*AuditLogResponse, error) {
+	query := url.Values{}
+	if from != "" {
+		query.Set("from", from)
+	}
+	if to != "" {
+		query.Set("to", to)
+	}
+
+	req, err := http.NewRequest("GET", FileServerUrl+"/v1/admin/audit?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	var logResponse AuditLogResponse
+	err = json.NewDecoder(resp.Body).Decode(&logResponse)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logResponse, nil
+}
+
+// VerifyAuditLog has the server verify the chain of its audit log.
+func (f *FileServerClient) VerifyAuditLog() (*AuditVerificationResponse, error) {
+	req, err := http.NewRequest("GET", FileServerUrl+"/v1/admin/audit/verify", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := f.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError(resp)
+	}
+
+	var verification AuditVerificationResponse
+	err = json.NewDecoder(resp.Body).Decode(&verification)
+	if err != nil {
+		return nil, err
+	}
+
+	return &verification, nil
+}
+
+// setUrl returns the URL of the set stored under key.
+func setUrl(key string) string {
+	return fmt.Sprintf("%v/v1/sets/%v", FileServerUrl, url.PathEscape(key))
+}
+
+func responseError(resp *http.Response) error {
+	message, _ := io.ReadAll(resp.Body)
+
+	var errorResponse ErrorResponse
+	if json.Unmarshal(message, &errorResponse) == nil && errorResponse.Code != "" {
+		return fmt.Errorf("server responded with %v (%v): %v", resp.Status, errorResponse.Code, errorResponse.Message)
 	}
 
-	return uploadResponse.Key, nil
+	return fmt.Errorf("server responded with %v: %v", resp.Status, strings.TrimSpace(string(message)))
 }
 
 func addFileMultipart(writer *multipart.Writer, filePath string) error {
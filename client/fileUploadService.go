@@ -1,36 +1,94 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
 
 	"github.com/vitaliy/file-storage/common/merkleTree"
 )
 
 type FileUploadService struct {
-	client *FileServerClient
+	client  *FileServerClient
+	keyring *Keyring
+	// encrypt encrypts files with the current key of the keyring before
+	// they are uploaded.
+	encrypt bool
 }
 
-func NewFileUploadService() *FileUploadService {
-	return &FileUploadService{client: NewFileServerClient()}
+func NewFileUploadService() (*FileUploadService, error) {
+	client, err := NewFileServerClient(TLS, APIKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring, err := LoadKeyring(KeyringFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileUploadService{client: client, keyring: keyring, encrypt: EncryptFiles}, nil
 }
 
-func (f *FileUploadService) UploadFiles(dir string) (string, error) {
-	key, err := f.client.UploadFiles(dir)
+// UploadFiles uploads the files in dir as a new set, or replaces the set
+// stored under key when key is not empty. With encryption the files are
+// encrypted first and the Merkle tree is built over the ciphertext, so the
+// proofs of the server verify without it ever seeing the content.
+func (f *FileUploadService) UploadFiles(dir string, key string) (string, error) {
+	var expectedRoot []byte
+	if key != "" {
+		merkleRoot, err := os.ReadFile(path.Join("merkle_roots", key, "merkle_root"))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		expectedRoot = merkleRoot
+	}
+
+	uploadDir := dir
+	if f.encrypt {
+		encryptedDir, err := f.encryptDir(dir)
+		if err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(encryptedDir)
+		uploadDir = encryptedDir
+	}
+
+	hashes, err := f.GetDirFilesHashes(uploadDir)
 	if err != nil {
 		return "", err
 	}
 
-	hashes, err := f.GetDirFilesHashes(dir)
+	merkleRoot, err := merkleTree.GetMerkleRoot(hashes)
 	if err != nil {
 		return "", err
 	}
 
-	merkleRoot, err := merkleTree.GetMerkleRoot(hashes)
+	uploadResponse, err := f.client.UploadFiles(uploadDir, key, expectedRoot, merkleRoot)
 	if err != nil {
 		return "", err
 	}
+	key = uploadResponse.Key
+
+	// The server checked the root already; the response is checked as well,
+	// so a server that ignores the root is noticed before it is stored.
+	if uploadResponse.HashAlgorithm != merkleTree.HashAlgorithm {
+		return "", fmt.Errorf("unsupported hash algorithm %v", uploadResponse.HashAlgorithm)
+	}
+	if uploadResponse.Root != hex.EncodeToString(merkleRoot) || uploadResponse.LeafCount != len(hashes) {
+		return "", fmt.Errorf("the server stored set %v with root %v of %v files, expected %x of %v files", key, uploadResponse.Root, uploadResponse.LeafCount, merkleRoot, len(hashes))
+	}
 
 	err = os.MkdirAll(path.Join("merkle_roots", key), os.ModePerm)
 	if err != nil {
@@ -45,6 +103,27 @@ func (f *FileUploadService) UploadFiles(dir string) (string, error) {
 
 	file.Write(merkleRoot)
 
+	err = os.WriteFile(path.Join("merkle_roots", key, "version"), []byte(strconv.Itoa(uploadResponse.Version)), os.ModePerm)
+	if err != nil {
+		return "", err
+	}
+
+	// Files deleted from the previous version are not part of the new one.
+	err = os.Remove(path.Join("merkle_roots", key, "deleted"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
+	encryptedMarker := path.Join("merkle_roots", key, "encrypted")
+	if f.encrypt {
+		err = os.WriteFile(encryptedMarker, nil, os.ModePerm)
+	} else {
+		err = os.Remove(encryptedMarker)
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+
 	os.RemoveAll(dir)
 
 	return key, nil
@@ -56,34 +135,511 @@ func (f *FileUploadService) GetFile(key string, num int) ([]byte, string, error)
 		return nil, "", err
 	}
 
-	file, name, err := f.client.GetFile(key, num)
+	version, err := f.getVersion(key)
 	if err != nil {
 		return nil, "", err
 	}
 
-	proof, err := f.client.GetProof(key, num)
+	file, name, proof, err := f.client.GetFile(key, version, num)
 	if err != nil {
 		return nil, "", err
 	}
 
-	hash, err := merkleTree.GetHashFromBytes(file)
+	file, err = f.verifyAndSave(key, merkleRoot, num, name, file, proof)
 	if err != nil {
 		return nil, "", err
 	}
+
+	return file, name, nil
+}
+
+// GetFileByName downloads the file called name and verifies it at the leaf
+// index the verified manifest lists for the name, so the server cannot answer
+// with another file. It returns that index.
+func (f *FileUploadService) GetFileByName(key string, name string) ([]byte, int, error) {
+	merkleRoot, err := os.ReadFile(path.Join("merkle_roots", key, "merkle_root"))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	version, err := f.getVersion(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	manifest, err := f.ListFiles(key)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	i := slices.IndexFunc(manifest.Files, func(file ManifestFileResponse) bool { return file.Name == name })
+	if i < 0 {
+		return nil, 0, fmt.Errorf("set %v has no file called %v", key, name)
+	}
+
+	file, proof, num, err := f.client.GetFileByName(key, version, name)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if num != manifest.Files[i].Index {
+		return nil, 0, fmt.Errorf("the server answered with file %v for %v, which is file %v", num, name, manifest.Files[i].Index)
+	}
+
+	file, err = f.verifyAndSave(key, merkleRoot, num, name, file, proof)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return file, num, nil
+}
+
+// verifyAndSave verifies a file of key as it was downloaded, then decrypts
+// and saves it. It returns the content that was saved.
+func (f *FileUploadService) verifyAndSave(key string, merkleRoot []byte, num int, name string, file []byte, proof [][]byte) ([]byte, error) {
+	hash, err := merkleTree.GetHashFromBytes(file)
+	if err != nil {
+		return nil, err
+	}
 	verificationResult, err := merkleTree.VerifyProof(merkleRoot, num, hash, proof)
 	if err != nil {
-		return nil, "", err
+		return nil, err
 	}
 	if !verificationResult {
-		return nil, "", fmt.Errorf("verification failed for file %v", num)
+		return nil, fmt.Errorf("verification failed for file %v", num)
 	}
 
-	err = os.WriteFile(fmt.Sprintf("downloads/%v", name), file, os.ModePerm)
+	file, err = f.decrypt(key, name, file)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 
-	return file, name, nil
+	return file, os.WriteFile(path.Join("downloads", filepath.Base(name)), file, os.ModePerm)
+}
+
+// GetVersions returns the version history of key as stored on the server.
+func (f *FileUploadService) GetVersions(key string) ([]VersionResponse, error) {
+	versionsResponse, err := f.client.GetVersions(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return versionsResponse.Versions, nil
+}
+
+// ListFiles fetches the manifest of key and verifies that its leaf hashes
+// recompute to the locally stored root.
+func (f *FileUploadService) ListFiles(key string) (*ManifestResponse, error) {
+	merkleRoot, err := os.ReadFile(path.Join("merkle_roots", key, "merkle_root"))
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := f.getVersion(key)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := f.client.GetManifest(key, version)
+	if err != nil {
+		return nil, err
+	}
+
+	err = verifyManifest(merkleRoot, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// verifyManifest checks that the leaf hashes listed by manifest add up to merkleRoot.
+func verifyManifest(merkleRoot []byte, manifest *ManifestResponse) error {
+	if manifest.HashAlgorithm != merkleTree.HashAlgorithm {
+		return fmt.Errorf("unsupported hash algorithm %v", manifest.HashAlgorithm)
+	}
+
+	if manifest.LeafCount != len(manifest.Files) {
+		return fmt.Errorf("manifest lists %v files but %v leaves", len(manifest.Files), manifest.LeafCount)
+	}
+
+	hashes := make([][]byte, 0, len(manifest.Files))
+	for i, file := range manifest.Files {
+		if file.Index != i {
+			return fmt.Errorf("manifest file %v has index %v", i, file.Index)
+		}
+
+		hash, err := hex.DecodeString(file.LeafHash)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, hash)
+	}
+
+	root, err := merkleTree.GetMerkleRoot(hashes)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(root, merkleRoot) {
+		return fmt.Errorf("manifest of %v does not match the stored merkle root", manifest.Key)
+	}
+
+	return nil
+}
+
+// GetAllFiles downloads the latest version of key as one archive into
+// downloads/<key>, verifying the manifest and every file against the locally
+// stored Merkle root. It returns the number of files saved.
+func (f *FileUploadService) GetAllFiles(key string) (int, error) {
+	merkleRoot, err := os.ReadFile(path.Join("merkle_roots", key, "merkle_root"))
+	if err != nil {
+		return 0, err
+	}
+
+	version, err := f.getVersion(key)
+	if err != nil {
+		return 0, err
+	}
+
+	archive, err := f.client.GetArchive(key, version)
+	if err != nil {
+		return 0, err
+	}
+	defer archive.Close()
+
+	dir := path.Join("downloads", filepath.Base(key))
+	err = os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return 0, err
+	}
+
+	reader := tar.NewReader(archive)
+
+	// The manifest comes first, so everything after it can be checked as it arrives.
+	header, err := reader.Next()
+	if err != nil {
+		return 0, err
+	}
+	if header.Name != "manifest.json" {
+		return 0, fmt.Errorf("archive starts with %v instead of the manifest", header.Name)
+	}
+
+	manifest := &ManifestResponse{}
+	err = json.NewDecoder(reader).Decode(manifest)
+	if err != nil {
+		return 0, err
+	}
+
+	err = verifyManifest(merkleRoot, manifest)
+	if err != nil {
+		return 0, err
+	}
+
+	proofs := make(map[int][][]byte)
+	received := make(map[int]bool)
+	saved := 0
+
+	for {
+		header, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return saved, err
+		}
+
+		parts := strings.Split(header.Name, "/")
+		switch {
+		case len(parts) == 2 && parts[0] == "proofs":
+			proofResponse := &ProofResponse{}
+			err := json.NewDecoder(reader).Decode(proofResponse)
+			if err != nil {
+				return saved, err
+			}
+
+			proof, err := decodeProof(proofResponse.Proof)
+			if err != nil {
+				return saved, err
+			}
+			proofs[proofResponse.Index] = proof
+
+		case len(parts) == 3 && parts[0] == "files":
+			num, err := strconv.Atoi(parts[1])
+			if err != nil || num < 0 || num >= len(manifest.Files) {
+				return saved, fmt.Errorf("unexpected archive entry %v", header.Name)
+			}
+
+			proof, ok := proofs[num]
+			if !ok {
+				return saved, fmt.Errorf("archive has no proof for file %v", num)
+			}
+
+			file, err := io.ReadAll(reader)
+			if err != nil {
+				return saved, err
+			}
+
+			hash, err := merkleTree.GetHashFromBytes(file)
+			if err != nil {
+				return saved, err
+			}
+			verificationResult, err := merkleTree.VerifyProof(merkleRoot, num, hash, proof)
+			if err != nil {
+				return saved, err
+			}
+			if !verificationResult {
+				return saved, fmt.Errorf("verification failed for file %v", num)
+			}
+
+			file, err = f.decrypt(key, manifest.Files[num].Name, file)
+			if err != nil {
+				return saved, err
+			}
+
+			err = os.WriteFile(path.Join(dir, filepath.Base(manifest.Files[num].Name)), file, os.ModePerm)
+			if err != nil {
+				return saved, err
+			}
+			received[num] = true
+			saved++
+
+		default:
+			return saved, fmt.Errorf("unexpected archive entry %v", header.Name)
+		}
+	}
+
+	for _, file := range manifest.Files {
+		if !received[file.Index] && !file.Deleted {
+			return saved, fmt.Errorf("archive is missing file %v", file.Index)
+		}
+	}
+
+	return saved, nil
+}
+
+// DeleteSet deletes key on the server and forgets its locally stored root.
+func (f *FileUploadService) DeleteSet(key string) error {
+	err := f.client.DeleteSet(key)
+	if err != nil {
+		return err
+	}
+
+	return os.RemoveAll(path.Join("merkle_roots", key))
+}
+
+// DeleteFile deletes the file with the given number from key on the server.
+// The number is remembered with the stored root, so audits can tell files
+// deleted by this client from files the server deleted on its own.
+func (f *FileUploadService) DeleteFile(key string, num int) error {
+	version, err := f.getVersion(key)
+	if err != nil {
+		return err
+	}
+
+	err = f.client.DeleteFile(key, version, num)
+	if err != nil {
+		return err
+	}
+
+	// Sets without a stored root are not audited.
+	deleted, err := os.OpenFile(path.Join("merkle_roots", key, "deleted"), os.O_WRONLY|os.O_APPEND|os.O_CREATE, os.ModePerm)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer deleted.Close()
+
+	_, err = fmt.Fprintln(deleted, num)
+	return err
+}
+
+// deletedFiles returns the numbers of the files this client deleted from the
+// version of key whose root is stored locally.
+func deletedFiles(key string) ([]int, error) {
+	content, err := os.ReadFile(path.Join("merkle_roots", key, "deleted"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	numbers := make([]int, 0)
+	for _, line := range strings.Fields(string(content)) {
+		number, err := strconv.Atoi(line)
+		if err != nil {
+			return nil, err
+		}
+		numbers = append(numbers, number)
+	}
+
+	return numbers, nil
+}
+
+// SetLegalHold places key under legal hold on the server or clears it, which
+// needs an admin API key.
+func (f *FileUploadService) SetLegalHold(key string, hold bool) error {
+	return f.client.SetLegalHold(key, hold)
+}
+
+// ShareFile creates a link that lets anyone download a file of key, given by
+// its leaf index or, when byName is set, by its name, with its proof until
+// the link expires. The link is
+// only returned when it is bound to the version whose root is stored
+// locally, so the shared file verifies against that root. Files of
+// encrypted sets are shared encrypted.
+func (f *FileUploadService) ShareFile(key string, file string, byName bool, ttl string) (*ShareResponse, error) {
+	merkleRoot, err := os.ReadFile(path.Join("merkle_roots", key, "merkle_root"))
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := f.getVersion(key)
+	if err != nil {
+		return nil, err
+	}
+
+	share, err := f.client.ShareFile(key, version, file, byName, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	if share.Root != hex.EncodeToString(merkleRoot) {
+		return nil, fmt.Errorf("server shared version %v with root %v, expected root %x", share.Version, share.Root, merkleRoot)
+	}
+
+	return share, nil
+}
+
+// CreateAPIKey creates an API key for owner on the server.
+func (f *FileUploadService) CreateAPIKey(owner string, admin bool) (*APIKeyResponse, error) {
+	return f.client.CreateAPIKey(owner, admin)
+}
+
+// ListAPIKeys returns the API keys of the server.
+func (f *FileUploadService) ListAPIKeys() ([]APIKeyResponse, error) {
+	keys, err := f.client.ListAPIKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	return keys.Keys, nil
+}
+
+// RevokeAPIKey revokes the API key with the given ID on the server.
+func (f *FileUploadService) RevokeAPIKey(id string) error {
+	return f.client.RevokeAPIKey(id)
+}
+
+// RotateMasterKey has the server wrap the data keys of all sets with its
+// current master key and returns how many were wrapped again.
+func (f *FileUploadService) RotateMasterKey() (int, error) {
+	rotated, err := f.client.RotateMasterKey()
+	if err != nil {
+		return 0, err
+	}
+
+	return rotated.Rewrapped, nil
+}
+
+// ExportAuditLog returns the entries of the audit log of the server in the
+// given RFC 3339 range, where empty bounds leave it open.
+func (f *FileUploadService) ExportAuditLog(from string, to string) ([]AuditEntryResponse, error) {
+	log, err := f.client.ExportAuditLog(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return log.Entries, nil
+}
+
+// VerifyAuditLog has the server verify the chain of its audit log.
+func (f *FileUploadService) VerifyAuditLog() (*AuditVerificationResponse, error) {
+	return f.client.VerifyAuditLog()
+}
+
+// GetUsage returns what the caller, or the given identity, stores on the
+// server and the limits it is subject to.
+func (f *FileUploadService) GetUsage(identity string) (*UsageResponse, error) {
+	return f.client.GetUsage(identity)
+}
+
+// GenerateKey adds a new key to the keyring that encrypts files from now on.
+// Files encrypted before remain readable with the old keys.
+func (f *FileUploadService) GenerateKey() (string, error) {
+	return f.keyring.Generate()
+}
+
+// ListKeys returns the ID of the current key and of all keys in the keyring.
+func (f *FileUploadService) ListKeys() (string, []string) {
+	return f.keyring.Current, f.keyring.IDs()
+}
+
+// getVersion returns the version of key whose root is stored locally. Roots
+// stored before versions existed address the latest version.
+func (f *FileUploadService) getVersion(key string) (int, error) {
+	version, err := os.ReadFile(path.Join("merkle_roots", key, "version"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(string(version))
+}
+
+// encryptDir writes the files in dir encrypted under the same names to a new
+// temporary directory and returns it. The caller must remove it.
+func (f *FileUploadService) encryptDir(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	encryptedDir, err := os.MkdirTemp("", "encrypted-")
+	if err != nil {
+		return "", err
+	}
+
+	for _, entry := range entries {
+		content, err := os.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			os.RemoveAll(encryptedDir)
+			return "", err
+		}
+
+		sealed, err := f.keyring.Seal(entry.Name(), content)
+		if err != nil {
+			os.RemoveAll(encryptedDir)
+			return "", err
+		}
+
+		err = os.WriteFile(path.Join(encryptedDir, entry.Name()), sealed, 0600)
+		if err != nil {
+			os.RemoveAll(encryptedDir)
+			return "", err
+		}
+	}
+
+	return encryptedDir, nil
+}
+
+// decrypt returns the plaintext of a verified file of key. Files are only
+// decrypted when the set was uploaded encrypted.
+func (f *FileUploadService) decrypt(key string, name string, content []byte) ([]byte, error) {
+	_, err := os.Stat(path.Join("merkle_roots", key, "encrypted"))
+	if errors.Is(err, fs.ErrNotExist) {
+		return content, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return f.keyring.Open(name, content)
 }
 
 func (f *FileUploadService) GetDirFilesHashes(dir string) ([][]byte, error) {
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"time"
+)
+
+// An encrypted file starts with magic, the ID of the key it was encrypted
+// with and a random nonce, followed by the sealed content. The name of the
+// file is authenticated with it, so the server cannot swap the contents of
+// two files.
+const (
+	keyringMagic = "FSC1"
+	keyIDSize    = 8
+	keySize      = 32
+)
+
+var errNoEncryptionKey = errors.New("the keyring has no key, create one with: keyring generate")
+
+// Keyring holds the keys files are encrypted with before they are uploaded.
+// It never leaves this machine, and encrypted sets cannot be read without it.
+type Keyring struct {
+	path string
+	// Current is the ID of the key new files are encrypted with.
+	Current string `json:"current"`
+	// Keys are all keys by ID. Old keys are kept to decrypt the files
+	// encrypted with them.
+	Keys map[string]KeyringKey `json:"keys"`
+}
+
+type KeyringKey struct {
+	Key     []byte    `json:"key"`
+	Created time.Time `json:"created"`
+}
+
+// LoadKeyring reads the keyring stored at path. A missing file is an empty
+// keyring.
+func LoadKeyring(path string) (*Keyring, error) {
+	keyring := &Keyring{path: path, Keys: make(map[string]KeyringKey)}
+
+	content, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return keyring, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(content, keyring)
+	if err != nil {
+		return nil, fmt.Errorf("invalid keyring %v: %w", path, err)
+	}
+
+	return keyring, nil
+}
+
+// Generate adds a random key, makes it the current one and saves the
+// keyring. It returns the ID of the key.
+func (k *Keyring) Generate() (string, error) {
+	key := make([]byte, keySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+
+	id := make([]byte, keyIDSize)
+	_, err = rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+
+	k.Current = hex.EncodeToString(id)
+	k.Keys[k.Current] = KeyringKey{Key: key, Created: time.Now().UTC()}
+
+	content, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return k.Current, os.WriteFile(k.path, content, 0600)
+}
+
+// IDs returns the IDs of all keys, oldest first.
+func (k *Keyring) IDs() []string {
+	ids := make([]string, 0, len(k.Keys))
+	for id := range k.Keys {
+		ids = append(ids, id)
+	}
+
+	sort.Slice(ids, func(i int, j int) bool {
+		return k.Keys[ids[i]].Created.Before(k.Keys[ids[j]].Created)
+	})
+
+	return ids
+}
+
+// Seal encrypts the content of the file called name with the current key.
+func (k *Keyring) Seal(name string, content []byte) ([]byte, error) {
+	if k.Current == "" {
+		return nil, errNoEncryptionKey
+	}
+
+	aead, err := k.aead(k.Current)
+	if err != nil {
+		return nil, err
+	}
+
+	id, _ := hex.DecodeString(k.Current)
+	sealed := append([]byte(keyringMagic), id...)
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	sealed = append(sealed, nonce...)
+
+	return aead.Seal(sealed, nonce, content, []byte(name)), nil
+}
+
+// Open decrypts the content of the file called name with the key it was
+// encrypted with.
+func (k *Keyring) Open(name string, sealed []byte) ([]byte, error) {
+	headerSize := len(keyringMagic) + keyIDSize
+	if len(sealed) < headerSize || string(sealed[:len(keyringMagic)]) != keyringMagic {
+		return nil, fmt.Errorf("%v is not encrypted", name)
+	}
+
+	id := hex.EncodeToString(sealed[len(keyringMagic):headerSize])
+	aead, err := k.aead(id)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sealed) < headerSize+aead.NonceSize() {
+		return nil, fmt.Errorf("%v is not encrypted", name)
+	}
+	nonce := sealed[headerSize : headerSize+aead.NonceSize()]
+
+	content, err := aead.Open(nil, nonce, sealed[headerSize+aead.NonceSize():], []byte(name))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting %v failed: %w", name, err)
+	}
+
+	return content, nil
+}
+
+func (k *Keyring) aead(id string) (cipher.AEAD, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("key %v is not in the keyring", id)
+	}
+
+	block, err := aes.NewCipher(key.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
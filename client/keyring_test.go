@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	keyring, err := LoadKeyring(path)
+	if err != nil {
+		t.Fatalf("Error loading keyring: %v", err)
+	}
+
+	_, err = keyring.Seal("test1", []byte("content"))
+	if !errors.Is(err, errNoEncryptionKey) {
+		t.Fatalf("Expected an empty keyring not to encrypt, got %v", err)
+	}
+
+	first, err := keyring.Generate()
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+
+	sealed, err := keyring.Seal("test1", []byte("content"))
+	if err != nil || bytes.Contains(sealed, []byte("content")) {
+		t.Fatalf("Expected the content to be encrypted (%v)", err)
+	}
+
+	_, err = keyring.Open("test2", sealed)
+	if err == nil {
+		t.Fatalf("Expected the content to be bound to its name")
+	}
+
+	second, _ := keyring.Generate()
+	if keyring.Current != second || second == first {
+		t.Fatalf("Expected the new key to be current")
+	}
+
+	// The saved keyring still holds the first key.
+	keyring, err = LoadKeyring(path)
+	if err != nil || len(keyring.IDs()) != 2 || keyring.IDs()[0] != first {
+		t.Fatalf("Expected both keys to be saved, got %v (%v)", keyring.IDs(), err)
+	}
+
+	content, err := keyring.Open("test1", sealed)
+	if err != nil || string(content) != "content" {
+		t.Fatalf("Expected the old key to decrypt, got %q (%v)", content, err)
+	}
+
+	_, err = keyring.Open("test1", []byte("plaintext"))
+	if err == nil {
+		t.Fatalf("Expected plaintext not to decrypt")
+	}
+}
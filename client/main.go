@@ -1,9 +1,12 @@
 package main
 
 import (
+	"cmp"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -11,6 +14,17 @@ import (
 func main() {
 	godotenv.Load()
 	FileServerUrl = os.Getenv("FILE_SERVER_URL")
+	SetTTL = os.Getenv("SET_TTL")
+	EncryptFiles, _ = strconv.ParseBool(os.Getenv("ENCRYPT_FILES"))
+	KeyringFile = cmp.Or(os.Getenv("KEYRING_FILE"), "keyring.json")
+	AuditSamples, _ = strconv.Atoi(cmp.Or(os.Getenv("AUDIT_SAMPLES"), "3"))
+	APIKey = os.Getenv("FILE_SERVER_API_KEY")
+	TLS = TLSOptions{
+		CAFile:   os.Getenv("FILE_SERVER_CA_FILE"),
+		Pin:      os.Getenv("FILE_SERVER_PIN"),
+		CertFile: os.Getenv("CLIENT_CERT_FILE"),
+		KeyFile:  os.Getenv("CLIENT_KEY_FILE"),
+	}
 	os.Mkdir("downloads", os.ModePerm)
 
 	args := os.Args[1:]
@@ -21,18 +35,26 @@ func main() {
 
 	command := args[0]
 
-	service := NewFileUploadService()
+	service, err := NewFileUploadService()
+	if err != nil {
+		panic(err)
+	}
 
 	switch command {
 	case "upload":
 
-		if len(args) != 2 {
+		if len(args) != 2 && len(args) != 3 {
 			fmt.Println("Invalid number of arguments")
 			return
 		}
 
 		dir := args[1]
-		key, err := service.UploadFiles(dir)
+		key := ""
+		if len(args) == 3 {
+			key = args[2]
+		}
+
+		key, err := service.UploadFiles(dir, key)
 		if err != nil {
 			panic(err)
 		}
@@ -50,7 +72,14 @@ func main() {
 
 		number, err := strconv.Atoi(numberStr)
 		if err != nil {
-			panic(err)
+			// Anything that is not a file number is a file name.
+			_, number, err = service.GetFileByName(key, numberStr)
+			if err != nil {
+				panic(err)
+			}
+
+			fmt.Printf("File %v (%v) downloaded and verified\n", number, numberStr)
+			return
 		}
 
 		_, _, err = service.GetFile(key, number)
@@ -60,6 +89,316 @@ func main() {
 
 		fmt.Printf("File %v downloaded and verified\n", number)
 
+	case "get-all":
+		if len(args) != 2 {
+			fmt.Println("Invalid number of arguments")
+			return
+		}
+
+		saved, err := service.GetAllFiles(args[1])
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("%v files downloaded into 'downloads/%v' and verified\n", saved, args[1])
+
+	case "ls":
+		if len(args) != 2 {
+			fmt.Println("Invalid number of arguments")
+			return
+		}
+
+		manifest, err := service.ListFiles(args[1])
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("Version %v, root %v, %v files (%v), verified\n", manifest.Version, manifest.Root, manifest.LeafCount, manifest.HashAlgorithm)
+		if manifest.Owner != "" {
+			fmt.Printf("Owner %v\n", manifest.Owner)
+		}
+		if manifest.Encrypted {
+			fmt.Println("Encrypted at rest")
+		}
+		for _, file := range manifest.Files {
+			status := ""
+			if file.Deleted {
+				status = "deleted"
+			}
+			fmt.Printf("%v\t%v\t%v\t%v\t%v\n", file.Index, file.Name, file.Size, file.LeafHash, status)
+		}
+
+	case "versions":
+		if len(args) != 2 {
+			fmt.Println("Invalid number of arguments")
+			return
+		}
+
+		versions, err := service.GetVersions(args[1])
+		if err != nil {
+			panic(err)
+		}
+
+		for _, version := range versions {
+			fmt.Printf("%v\t%v\t%v\n", version.Version, version.Root, version.Created.Format(time.RFC3339))
+		}
+
+	case "delete":
+		if len(args) != 2 && len(args) != 3 {
+			fmt.Println("Invalid number of arguments")
+			return
+		}
+
+		key := args[1]
+		if len(args) == 2 {
+			err := service.DeleteSet(key)
+			if err != nil {
+				panic(err)
+			}
+
+			fmt.Printf("Set %v deleted\n", key)
+			return
+		}
+
+		number, err := strconv.Atoi(args[2])
+		if err != nil {
+			panic(err)
+		}
+
+		err = service.DeleteFile(key, number)
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("File %v deleted\n", number)
+
+	case "hold", "release":
+		if len(args) != 2 {
+			fmt.Println("Invalid number of arguments")
+			return
+		}
+
+		err := service.SetLegalHold(args[1], command == "hold")
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("Legal hold of %v updated\n", args[1])
+
+	case "share":
+		if len(args) != 4 && len(args) != 5 || args[2] != "-index" && args[2] != "-name" {
+			fmt.Println("Usage: share <key> -index <number> [ttl] | share <key> -name <name> [ttl]")
+			return
+		}
+
+		byName := args[2] == "-name"
+		if !byName {
+			_, err := strconv.Atoi(args[3])
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		ttl := ""
+		if len(args) == 5 {
+			ttl = args[4]
+		}
+
+		share, err := service.ShareFile(args[1], args[3], byName, ttl)
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("File %v (%v) of version %v is shared until %v:\n", share.Index, share.Name, share.Version, share.Expires.Local().Format(time.RFC3339))
+		fmt.Printf("%v%v\n", FileServerUrl, share.Path)
+		fmt.Printf("It verifies against root %v at leaf index %v\n", share.Root, share.Index)
+
+	case "keys":
+		if len(args) < 2 {
+			fmt.Println("Invalid number of arguments")
+			return
+		}
+
+		switch {
+		case args[1] == "create" && (len(args) == 3 || len(args) == 4 && args[3] == "admin"):
+			key, err := service.CreateAPIKey(args[2], len(args) == 4)
+			if err != nil {
+				panic(err)
+			}
+
+			fmt.Printf("API key %v of %v: %v\n", key.ID, key.Owner, key.Token)
+			fmt.Printf("The key is shown only once, set it as FILE_SERVER_API_KEY\n")
+
+		case args[1] == "list" && len(args) == 2:
+			keys, err := service.ListAPIKeys()
+			if err != nil {
+				panic(err)
+			}
+
+			for _, key := range keys {
+				role := ""
+				if key.Admin {
+					role = "admin"
+				}
+				fmt.Printf("%v\t%v\t%v\t%v\n", key.ID, key.Owner, key.Created.Format(time.RFC3339), role)
+			}
+
+		case args[1] == "revoke" && len(args) == 3:
+			err := service.RevokeAPIKey(args[2])
+			if err != nil {
+				panic(err)
+			}
+
+			fmt.Printf("API key %v revoked\n", args[2])
+
+		default:
+			fmt.Println("Usage: keys create <owner> [admin] | keys list | keys revoke <id>")
+		}
+
+	case "keyring":
+		switch {
+		case len(args) == 2 && args[1] == "generate":
+			id, err := service.GenerateKey()
+			if err != nil {
+				panic(err)
+			}
+
+			fmt.Printf("Key %v generated, files are encrypted with it when ENCRYPT_FILES is set\n", id)
+			fmt.Printf("Back up %v, encrypted sets cannot be read without it\n", KeyringFile)
+
+		case len(args) == 2 && args[1] == "list":
+			current, ids := service.ListKeys()
+			for _, id := range ids {
+				status := ""
+				if id == current {
+					status = "current"
+				}
+				fmt.Printf("%v\t%v\n", id, status)
+			}
+
+		default:
+			fmt.Println("Usage: keyring generate | keyring list")
+		}
+
+	case "rotate-master-key":
+		if len(args) != 1 {
+			fmt.Println("Invalid number of arguments")
+			return
+		}
+
+		rewrapped, err := service.RotateMasterKey()
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("Master key rotated, %v data keys wrapped again\n", rewrapped)
+
+	case "audit":
+		if len(args) > 2 {
+			fmt.Println("Invalid number of arguments")
+			return
+		}
+
+		keys := args[1:]
+		if len(keys) == 0 {
+			keys, err = StoredKeys()
+			if err != nil {
+				panic(err)
+			}
+		}
+
+		failed := 0
+		for _, key := range keys {
+			result := service.Audit(key, AuditSamples)
+			if len(result.Failures) > 0 {
+				failed++
+				for _, failure := range result.Failures {
+					fmt.Printf("FAIL %v: %v\n", key, failure)
+				}
+				continue
+			}
+
+			fmt.Printf("ok   %v: files %v stored", key, result.Sampled)
+			if result.Deleted > 0 {
+				fmt.Printf(", %v deleted", result.Deleted)
+			}
+			fmt.Println()
+		}
+
+		fmt.Printf("%v of %v sets passed\n", len(keys)-failed, len(keys))
+		if failed > 0 {
+			os.Exit(1)
+		}
+
+	case "audit-log":
+		switch {
+		case len(args) == 2 && args[1] == "verify":
+			verification, err := service.VerifyAuditLog()
+			if err != nil {
+				panic(err)
+			}
+
+			if !verification.Valid {
+				fmt.Printf("Audit log is broken after %v entries: %v\n", verification.Entries, verification.Error)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Audit log is intact, %v entries\n", verification.Entries)
+			fmt.Printf("Head: %v\n", verification.Head)
+
+		case len(args) >= 2 && len(args) <= 4 && args[1] == "export":
+			from, to := "", ""
+			if len(args) >= 3 {
+				from = args[2]
+			}
+			if len(args) == 4 {
+				to = args[3]
+			}
+
+			entries, err := service.ExportAuditLog(from, to)
+			if err != nil {
+				panic(err)
+			}
+
+			// One entry per line, like the log on the server.
+			encoder := json.NewEncoder(os.Stdout)
+			for _, entry := range entries {
+				err := encoder.Encode(entry)
+				if err != nil {
+					panic(err)
+				}
+			}
+
+		default:
+			fmt.Println("Usage: audit-log verify | audit-log export [from] [to], with RFC 3339 times")
+		}
+
+	case "usage":
+		if len(args) != 1 && len(args) != 2 {
+			fmt.Println("Invalid number of arguments")
+			return
+		}
+
+		identity := ""
+		if len(args) == 2 {
+			identity = args[1]
+		}
+
+		usage, err := service.GetUsage(identity)
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("Identity: %v\n", cmp.Or(usage.Identity, "admin (unlimited)"))
+		fmt.Printf("Bytes: %v of %v\n", usage.Bytes, limit(usage.MaxBytes))
+		fmt.Printf("Sets: %v of %v\n", usage.Sets, limit(usage.MaxSets))
+		fmt.Printf("Files per set: %v\n", limit(usage.MaxFilesPerSet))
+		if usage.RateLimit > 0 {
+			fmt.Printf("Rate limit: %v requests per second, bursts of %v\n", usage.RateLimit, usage.RateBurst)
+		} else {
+			fmt.Printf("Rate limit: unlimited\n")
+		}
+
 	case "demonstration":
 		if len(args) != 2 {
 			fmt.Println("Invalid number of arguments")
@@ -70,7 +409,7 @@ func main() {
 		fmt.Printf("First we will upload the files from the directory '%v' to the server\n", args[1])
 		fmt.Printf("The client will receive Store Key from the server and store Merkle Root of the set of files to local file system\n")
 		dir := args[1]
-		key, err := service.UploadFiles(dir)
+		key, err := service.UploadFiles(dir, "")
 		if err != nil {
 			panic(err)
 		}
@@ -104,9 +443,22 @@ func getFile(service *FileUploadService, key string, number int) {
 	fmt.Printf("File %v (%v) was downloaded into 'downloads' folder and verified\n", number, name)
 }
 
+// limit formats a limit of the server, where 0 is unlimited.
+func limit[T int | int64](n T) string {
+	if n == 0 {
+		return "unlimited"
+	}
+
+	return fmt.Sprint(n)
+}
+
 func test() {
-	service := NewFileUploadService()
-	key, err := service.UploadFiles("files")
+	service, err := NewFileUploadService()
+	if err != nil {
+		panic(err)
+	}
+
+	key, err := service.UploadFiles("files", "")
 	if err != nil {
 		panic(err)
 	}
@@ -127,3 +479,23 @@ func test() {
 }
 
 var FileServerUrl string
+
+// APIKey authenticates the client with the server. Empty makes anonymous
+// requests.
+var APIKey string
+
+// TLS configures how the client authenticates the server and itself.
+var TLS TLSOptions
+
+// SetTTL is how long the server keeps uploaded sets, e.g. "720h". Empty uses the server default.
+var SetTTL string
+
+// EncryptFiles encrypts files with the current key of the keyring before
+// they are uploaded.
+var EncryptFiles bool
+
+// KeyringFile is where the keys files are encrypted with are stored.
+var KeyringFile string
+
+// AuditSamples is how many files of every set are challenged by an audit.
+var AuditSamples int
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewHTTPClient(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, dir, "ca", nil)
+	server := newTestCertificate(t, dir, "server", ca)
+	newTestCertificate(t, dir, "client", ca)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.Leaf)
+
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	ts.TLS = &tls.Config{
+		Certificates: []tls.Certificate{*server},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	sum := sha256.Sum256(server.Leaf.RawSubjectPublicKeyInfo)
+	pin := hex.EncodeToString(sum[:])
+	otherPin := strings.Repeat("00", sha256.Size)
+
+	clientCert := TLSOptions{CertFile: filepath.Join(dir, "client.pem"), KeyFile: filepath.Join(dir, "client-key.pem")}
+	withCA := clientCert
+	withCA.CAFile = filepath.Join(dir, "ca.pem")
+
+	tests := []struct {
+		name    string
+		options TLSOptions
+		ok      bool
+	}{
+		{"ca bundle", withCA, true},
+		{"unknown ca", clientCert, false},
+		{"pin", TLSOptions{Pin: pin, CertFile: clientCert.CertFile, KeyFile: clientCert.KeyFile}, true},
+		{"wrong pin", TLSOptions{Pin: otherPin, CertFile: clientCert.CertFile, KeyFile: clientCert.KeyFile}, false},
+		{"ca bundle and wrong pin", TLSOptions{CAFile: withCA.CAFile, Pin: otherPin, CertFile: clientCert.CertFile, KeyFile: clientCert.KeyFile}, false},
+		{"no client certificate", TLSOptions{CAFile: withCA.CAFile}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, err := newHTTPClient(test.options)
+			if err != nil {
+				t.Fatalf("Error creating client: %v", err)
+			}
+
+			resp, err := client.Get(ts.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+
+			if test.ok && err != nil {
+				t.Fatalf("Expected the request to succeed, got %v", err)
+			}
+			if !test.ok && err == nil {
+				t.Fatalf("Expected the request to fail")
+			}
+		})
+	}
+
+	client, _ := newHTTPClient(TLSOptions{Pin: otherPin})
+	_, err := client.Get(ts.URL)
+	if !errors.Is(err, errPinMismatch) {
+		t.Fatalf("Expected a pin mismatch, got %v", err)
+	}
+
+	_, err = newHTTPClient(TLSOptions{Pin: "abc"})
+	if err == nil {
+		t.Fatalf("Expected an invalid pin to be rejected")
+	}
+}
+
+// newTestCertificate writes <name>.pem and <name>-key.pem into dir. The
+// certificate is a CA when parent is nil and is signed by parent otherwise.
+func newTestCertificate(t *testing.T, dir string, name string, parent *tls.Certificate) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	signer, signerKey := template, any(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshalling key: %v", err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatalf("Error writing certificate: %v", err)
+	}
+	err = os.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatalf("Error writing key: %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Error parsing certificate: %v", err)
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
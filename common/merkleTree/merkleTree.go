@@ -8,6 +8,9 @@ import (
 	"slices"
 )
 
+// HashAlgorithm names the hash function used for leaves and inner nodes.
+const HashAlgorithm = "sha256"
+
 func GetProof(tree *MerkleTree, index int) [][]byte {
 
 	proof := make([][]byte, 0)
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	fileservice "github.com/vitaliy/file-storage/server/fileService"
+)
+
+// Entries of a set archive. The manifest comes first so that a reader can
+// verify every proof and file as it streams past.
+const (
+	archiveManifest  = "manifest.json"
+	archiveProofsDir = "proofs"
+	archiveFilesDir  = "files"
+)
+
+// archiveWriter adds entries to a tar or zip archive.
+type archiveWriter interface {
+	Create(name string, size int64, modified time.Time) (io.Writer, error)
+	Close() error
+}
+
+type tarArchive struct {
+	w *tar.Writer
+}
+
+func (a tarArchive) Create(name string, size int64, modified time.Time) (io.Writer, error) {
+	err := a.w.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     size,
+		Mode:     0644,
+		ModTime:  modified,
+	})
+
+	return a.w, err
+}
+
+func (a tarArchive) Close() error {
+	return a.w.Close()
+}
+
+type zipArchive struct {
+	w *zip.Writer
+}
+
+func (a zipArchive) Create(name string, size int64, modified time.Time) (io.Writer, error) {
+	return a.w.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: modified,
+	})
+}
+
+func (a zipArchive) Close() error {
+	return a.w.Close()
+}
+
+// getArchiveHandler streams a version of a set as a tar or zip archive
+// holding its manifest, the proof of every file and the content of every
+// file that was not deleted.
+func (s *server) getArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	err := s.authorize(r, key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	versionInt, err := parseVersion(r.URL.Query().Get("version"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "tar"
+	}
+	if format != "tar" && format != "zip" {
+		writeError(w, errInvalidFormat)
+		return
+	}
+
+	opened, err := s.files.As(actor(r)).OpenArchive(key, versionInt)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer opened.Close()
+	manifest := opened.Manifest
+
+	filename := fmt.Sprintf("%s-v%d.%s", key, manifest.Version.Number, format)
+
+	var archive archiveWriter
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		archive = zipArchive{w: zip.NewWriter(w)}
+	} else {
+		w.Header().Set("Content-Type", "application/x-tar")
+		archive = tarArchive{w: tar.NewWriter(w)}
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	w.Header().Set("ETag", etag(manifest.Version.Root))
+	w.Header().Set("X-Merkle-Version", strconv.Itoa(manifest.Version.Number))
+
+	// Once the archive is being streamed the status can no longer change, so
+	// failures only truncate it and are logged.
+	err = writeArchive(archive, opened)
+	if err != nil {
+		slog.Error("writing archive failed", "key", key, "error", err)
+		return
+	}
+
+	err = archive.Close()
+	if err != nil {
+		slog.Error("writing archive failed", "key", key, "error", err)
+	}
+}
+
+func writeArchive(archive archiveWriter, opened *fileservice.Archive) error {
+	manifest := opened.Manifest
+
+	err := writeArchiveJSON(archive, archiveManifest, newManifestResponse(manifest), manifest.Version.Created)
+	if err != nil {
+		return err
+	}
+
+	for i, file := range manifest.Files {
+		proofName := path.Join(archiveProofsDir, strconv.Itoa(file.Index)+".json")
+		err := writeArchiveJSON(archive, proofName, newProofResponse(opened.Proofs[i], manifest.Version.Number, file.Index), manifest.Version.Created)
+		if err != nil {
+			return err
+		}
+
+		if file.Deleted {
+			continue
+		}
+
+		err = writeArchiveFile(archive, file, opened.Contents[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeArchiveFile(archive archiveWriter, file fileservice.ManifestFile, content io.Reader) error {
+	// Files are nested under their index because names are not required to
+	// be unique within a set.
+	name := path.Join(archiveFilesDir, strconv.Itoa(file.Index), path.Base(file.Name))
+
+	entry, err := archive.Create(name, file.Size, file.Uploaded)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(entry, content)
+
+	return err
+}
+
+func writeArchiveJSON(archive archiveWriter, name string, value any, modified time.Time) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	entry, err := archive.Create(name, int64(len(content)), modified)
+	if err != nil {
+		return err
+	}
+
+	_, err = entry.Write(content)
+
+	return err
+}
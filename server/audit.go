@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"time"
+
+	auditlog "github.com/vitaliy/file-storage/server/auditLog"
+)
+
+type AuditEntryResponse struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor,omitempty"`
+	Operation string    `json:"operation"`
+	Key       string    `json:"key,omitempty"`
+	Version   int       `json:"version,omitempty"`
+	File      *int      `json:"file,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	Prev      string    `json:"prev"`
+	Hash      string    `json:"hash"`
+}
+
+type AuditLogResponse struct {
+	Entries []AuditEntryResponse `json:"entries"`
+}
+
+// AuditVerificationResponse reports whether the chain of the audit log is
+// intact. Head is the hash of the last verified entry, which admins should
+// keep elsewhere to detect entries removed from the end later.
+type AuditVerificationResponse struct {
+	Valid   bool   `json:"valid"`
+	Entries int    `json:"entries"`
+	Head    string `json:"head"`
+	Error   string `json:"error,omitempty"`
+}
+
+// exportAuditLogHandler returns the entries of the audit log made in the
+// optional range given by the from and to query parameters.
+func (s *server) exportAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	err := requireAdmin(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	from, err := parseTime(r.URL.Query().Get("from"))
+	if err != nil {
+		writeError(w, errInvalidTime)
+		return
+	}
+
+	to, err := parseTime(r.URL.Query().Get("to"))
+	if err != nil {
+		writeError(w, errInvalidTime)
+		return
+	}
+
+	entries, err := s.files.As(actor(r)).AuditLog(from, to)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := AuditLogResponse{Entries: make([]AuditEntryResponse, 0, len(entries))}
+	for _, entry := range entries {
+		response.Entries = append(response.Entries, newAuditEntryResponse(entry))
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+// verifyAuditLogHandler verifies the chain of the audit log. A broken chain
+// is reported in the response, not as an error.
+func (s *server) verifyAuditLogHandler(w http.ResponseWriter, r *http.Request) {
+	err := requireAdmin(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	verification, err := s.files.VerifyAuditLog()
+	if err != nil && !errors.Is(err, auditlog.ErrBroken) {
+		writeError(w, err)
+		return
+	}
+
+	response := AuditVerificationResponse{
+		Valid:   err == nil,
+		Entries: verification.Entries,
+		Head:    hex.EncodeToString(verification.Head),
+	}
+	if err != nil {
+		response.Error = err.Error()
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func newAuditEntryResponse(entry auditlog.Entry) AuditEntryResponse {
+	return AuditEntryResponse{
+		Seq:       entry.Seq,
+		Time:      entry.Time,
+		Actor:     entry.Actor,
+		Operation: entry.Operation,
+		Key:       entry.Key,
+		Version:   entry.Version,
+		File:      entry.File,
+		Detail:    entry.Detail,
+		Prev:      hex.EncodeToString(entry.Prev),
+		Hash:      hex.EncodeToString(entry.Hash),
+	}
+}
+
+// parseTime parses an optional RFC 3339 time, where empty is the zero time.
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	return time.Parse(time.RFC3339, value)
+}
@@ -0,0 +1,278 @@
+package auditlog
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const FileName = "_audit.log"
+
+// readSyncInterval bounds how long entries of reads may wait to be synced
+// to disk, see AppendRead.
+const readSyncInterval = time.Second
+
+var ErrBroken = errors.New("audit log is broken")
+
+var errIncomplete = fmt.Errorf("%w: the last line is incomplete", ErrBroken)
+
+// Log is an append-only log of operations kept in a file with one JSON
+// entry per line. Every entry includes the hash of the previous one, so
+// changing, removing or reordering entries breaks the chain, see Verify.
+// Removing entries from the end cannot be detected from the log alone, which
+// is why Verify returns the head of the chain to be kept elsewhere.
+type Log struct {
+	mu   sync.Mutex
+	file *os.File
+	seq  int64
+	head []byte
+	// size is the length of the complete lines in the file.
+	size   int64
+	synced time.Time
+}
+
+// Entry records one operation. Entries without an actor were made by the
+// server itself, e.g. when a set expired.
+type Entry struct {
+	Seq       int64     `json:"seq"`
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor,omitempty"`
+	Operation string    `json:"operation"`
+	Key       string    `json:"key,omitempty"`
+	Version   int       `json:"version,omitempty"`
+	File      *int      `json:"file,omitempty"`
+	Detail    string    `json:"detail,omitempty"`
+	// Prev is the hash of the previous entry, nil for the first one.
+	Prev []byte `json:"prev"`
+	// Hash is the SHA-256 of the entry without its hash.
+	Hash []byte `json:"hash"`
+}
+
+// Verification is the result of verifying a log.
+type Verification struct {
+	// Entries is the number of entries that were verified.
+	Entries int
+	// Head is the hash of the last verified entry.
+	Head []byte
+}
+
+// Open opens the log at path, creating it if needed, and continues the
+// chain of its last entry. A last line that is incomplete because its write
+// was cut off is removed, as its operation was never acknowledged. A log
+// with other lines that are not entries must be repaired before it can be
+// opened.
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	log, err := open(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return log, nil
+}
+
+func open(file *os.File) (*Log, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	log := &Log{file: file, synced: time.Now()}
+
+	log.size, err = readEntries(io.NewSectionReader(file, 0, info.Size()), func(entry Entry) error {
+		log.seq = entry.Seq
+		log.head = entry.Hash
+		return nil
+	})
+	if errors.Is(err, errIncomplete) {
+		slog.Warn("removing incomplete last line of the audit log", "path", file.Name(), "bytes", info.Size()-log.size)
+
+		err = file.Truncate(log.size)
+		if err == nil {
+			err = file.Sync()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return log, nil
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return errors.Join(l.file.Sync(), l.file.Close())
+}
+
+// Append chains entry to the log, setting its sequence number, time and
+// hashes, and writes it to disk before it returns.
+func (l *Log) Append(entry Entry) error {
+	return l.append(entry, true)
+}
+
+// AppendRead chains entry like Append, but only syncs it to disk when the
+// log was not synced for readSyncInterval. Entries of reads are frequent and
+// change nothing, so a crash may lose those of the last interval; the chain
+// stays intact. Entries appended later are synced with the next Append.
+func (l *Log) AppendRead(entry Entry) error {
+	return l.append(entry, false)
+}
+
+func (l *Log) append(entry Entry, sync bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry.Seq = l.seq + 1
+	entry.Time = time.Now().UTC()
+	entry.Prev = l.head
+
+	hash, err := entry.hash()
+	if err != nil {
+		return err
+	}
+	entry.Hash = hash
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	line = append(line, '\n')
+	_, err = l.file.Write(line)
+	if err != nil {
+		// A partial line would break every later entry.
+		return errors.Join(err, l.file.Truncate(l.size))
+	}
+
+	l.seq = entry.Seq
+	l.head = entry.Hash
+	l.size += int64(len(line))
+
+	if sync || time.Since(l.synced) >= readSyncInterval {
+		err = l.file.Sync()
+		if err != nil {
+			return err
+		}
+		l.synced = time.Now()
+	}
+
+	return nil
+}
+
+// Read returns the entries made from from up to, but excluding, to. Zero
+// times leave the range open.
+func (l *Log) Read(from time.Time, to time.Time) ([]Entry, error) {
+	entries := make([]Entry, 0)
+
+	err := l.scan(func(entry Entry) error {
+		if (from.IsZero() || !entry.Time.Before(from)) && (to.IsZero() || entry.Time.Before(to)) {
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+
+	return entries, err
+}
+
+// Verify checks that every entry has the hash of its content, follows the
+// previous one and is numbered consecutively. A broken chain is reported
+// with ErrBroken together with what was verified before the break.
+func (l *Log) Verify() (Verification, error) {
+	verification := Verification{}
+
+	err := l.scan(func(entry Entry) error {
+		switch {
+		case entry.Seq != int64(verification.Entries)+1:
+			return fmt.Errorf("%w: entry %v follows entry %v", ErrBroken, entry.Seq, verification.Entries)
+		case !bytes.Equal(entry.Prev, verification.Head):
+			return fmt.Errorf("%w: entry %v does not follow the previous entry", ErrBroken, entry.Seq)
+		}
+
+		hash, err := entry.hash()
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(hash, entry.Hash) {
+			return fmt.Errorf("%w: entry %v was changed", ErrBroken, entry.Seq)
+		}
+
+		verification.Entries++
+		verification.Head = entry.Hash
+		return nil
+	})
+
+	return verification, err
+}
+
+// scan calls fn for every entry the log held when it was called, from the
+// beginning. Entries are only ever added after them, so the log is not
+// locked while they are read and appending goes on meanwhile.
+func (l *Log) scan(fn func(Entry) error) error {
+	l.mu.Lock()
+	size := l.size
+	l.mu.Unlock()
+
+	_, err := readEntries(io.NewSectionReader(l.file, 0, size), fn)
+	return err
+}
+
+// readEntries calls fn for every line of r and returns the length of the
+// complete lines. A last line without a newline is reported with
+// errIncomplete.
+func readEntries(r io.Reader, fn func(Entry) error) (int64, error) {
+	reader := bufio.NewReader(r)
+	size := int64(0)
+	for line := 1; ; line++ {
+		content, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(content) == 0 {
+			return size, nil
+		}
+		if err == io.EOF {
+			return size, errIncomplete
+		}
+		if err != nil {
+			return size, err
+		}
+
+		entry := Entry{}
+		err = json.Unmarshal(content, &entry)
+		if err != nil {
+			return size, fmt.Errorf("%w: line %v: %w", ErrBroken, line, err)
+		}
+
+		err = fn(entry)
+		if err != nil {
+			return size, err
+		}
+		size += int64(len(content))
+	}
+}
+
+// hash returns the SHA-256 of the JSON encoding of the entry without its
+// hash, which includes the hash of the previous entry.
+func (e Entry) hash() ([]byte, error) {
+	e.Hash = nil
+
+	content, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+
+	hash := sha256.Sum256(content)
+	return hash[:], nil
+}
@@ -0,0 +1,144 @@
+package auditlog
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestLog(t *testing.T) {
+	file := path.Join(t.TempDir(), FileName)
+
+	log, err := Open(file)
+	if err != nil {
+		t.Fatalf("Error opening log: %v", err)
+	}
+
+	err = log.Append(Entry{Actor: "alice", Operation: "upload", Key: "set"})
+	if err != nil {
+		t.Fatalf("Error appending: %v", err)
+	}
+	err = log.AppendRead(Entry{Actor: "alice", Operation: "read_file", Key: "set"})
+	if err != nil {
+		t.Fatalf("Error appending: %v", err)
+	}
+	log.Close()
+
+	// The chain continues after reopening.
+	log, err = Open(file)
+	if err != nil {
+		t.Fatalf("Error reopening log: %v", err)
+	}
+	t.Cleanup(func() { log.Close() })
+
+	err = log.Append(Entry{Operation: "expire_set", Key: "set"})
+	if err != nil {
+		t.Fatalf("Error appending: %v", err)
+	}
+
+	entries, err := log.Read(time.Time{}, time.Time{})
+	if err != nil || len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %v (%v)", len(entries), err)
+	}
+	if entries[2].Seq != 3 || !bytes.Equal(entries[2].Prev, entries[1].Hash) {
+		t.Fatalf("Expected the third entry to follow the second, got %+v", entries[2])
+	}
+
+	verification, err := log.Verify()
+	if err != nil || verification.Entries != 3 || !bytes.Equal(verification.Head, entries[2].Hash) {
+		t.Fatalf("Expected a valid chain of 3 entries, got %+v (%v)", verification, err)
+	}
+
+	entries, err = log.Read(time.Time{}, entries[0].Time)
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("Expected no entries before the first one, got %v (%v)", len(entries), err)
+	}
+}
+
+func TestLogIncompleteLine(t *testing.T) {
+	file := path.Join(t.TempDir(), FileName)
+
+	log, err := Open(file)
+	if err != nil {
+		t.Fatalf("Error opening log: %v", err)
+	}
+	for range 2 {
+		log.Append(Entry{Actor: "alice", Operation: "upload", Key: "set"})
+	}
+	log.Close()
+
+	// A write that was cut off leaves part of a line behind.
+	content, _ := os.ReadFile(file)
+	os.WriteFile(file, append(content, `{"seq":3,"time"`...), 0600)
+
+	log, err = Open(file)
+	if err != nil {
+		t.Fatalf("Expected the incomplete line to be removed, got %v", err)
+	}
+	t.Cleanup(func() { log.Close() })
+
+	err = log.Append(Entry{Operation: "expire_set", Key: "set"})
+	if err != nil {
+		t.Fatalf("Error appending: %v", err)
+	}
+
+	verification, err := log.Verify()
+	if err != nil || verification.Entries != 3 {
+		t.Fatalf("Expected a valid chain of 3 entries, got %+v (%v)", verification, err)
+	}
+}
+
+func TestLogTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func([]byte) []byte
+	}{
+		{"changed entry", func(content []byte) []byte {
+			return bytes.Replace(content, []byte(`"actor":"alice"`), []byte(`"actor":"mallory"`), 1)
+		}},
+		{"removed entry", func(content []byte) []byte {
+			lines := bytes.SplitAfter(content, []byte("\n"))
+			return bytes.Join(append(lines[:1:1], lines[2:]...), nil)
+		}},
+		{"swapped entries", func(content []byte) []byte {
+			lines := bytes.SplitAfter(content, []byte("\n"))
+			lines[0], lines[1] = lines[1], lines[0]
+			return bytes.Join(lines, nil)
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			file := path.Join(t.TempDir(), FileName)
+
+			log, err := Open(file)
+			if err != nil {
+				t.Fatalf("Error opening log: %v", err)
+			}
+			for range 3 {
+				log.Append(Entry{Actor: "alice", Operation: "read_file", Key: "set"})
+			}
+			log.Close()
+
+			content, err := os.ReadFile(file)
+			if err != nil {
+				t.Fatalf("Error reading log: %v", err)
+			}
+			os.WriteFile(file, test.tamper(content), 0600)
+
+			log, err = Open(file)
+			if err != nil {
+				t.Fatalf("Error reopening log: %v", err)
+			}
+			t.Cleanup(func() { log.Close() })
+
+			_, err = log.Verify()
+			if !errors.Is(err, ErrBroken) {
+				t.Fatalf("Expected a broken chain, got %v", err)
+			}
+		})
+	}
+}
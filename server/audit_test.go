@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	s := newTestAPI(t, 1<<20)
+	s.adminToken = testAdminToken
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+
+	start := time.Now().Add(-time.Second).UTC().Format(time.RFC3339)
+
+	resp := upload(t, http.MethodPost, ts.URL+"/v1/sets", "", map[string]string{"test1": "test1"})
+	var uploadResponse UploadResponse
+	json.NewDecoder(resp.Body).Decode(&uploadResponse)
+	get(t, ts.URL+"/v1/sets/"+uploadResponse.Key+"/files/0")
+
+	verifyError(t, get(t, ts.URL+"/v1/admin/audit"), http.StatusUnauthorized, "unauthorized")
+	verifyError(t, do(t, newRequest(t, http.MethodGet, ts.URL+"/v1/admin/audit?from=yesterday", testAdminToken)), http.StatusBadRequest, "invalid_time")
+
+	resp = do(t, newRequest(t, http.MethodGet, ts.URL+"/v1/admin/audit?from="+start, testAdminToken))
+	var log AuditLogResponse
+	err := json.NewDecoder(resp.Body).Decode(&log)
+	if resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("Expected the audit log, got %v (%v)", resp.Status, err)
+	}
+
+	if len(log.Entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %+v", log.Entries)
+	}
+	for i, operation := range []string{"upload", "read_file"} {
+		entry := log.Entries[i]
+		if entry.Operation != operation || entry.Key != uploadResponse.Key || entry.Actor != "ip:127.0.0.1" || entry.Version != 1 {
+			t.Fatalf("Expected %v by the client, got %+v", operation, entry)
+		}
+	}
+	if log.Entries[1].Prev != log.Entries[0].Hash {
+		t.Fatalf("Expected the entries to be chained, got %+v", log.Entries)
+	}
+
+	resp = do(t, newRequest(t, http.MethodGet, ts.URL+"/v1/admin/audit/verify", testAdminToken))
+	var verification AuditVerificationResponse
+	json.NewDecoder(resp.Body).Decode(&verification)
+	// The export is recorded too.
+	if !verification.Valid || verification.Entries != 3 {
+		t.Fatalf("Expected a valid chain of 3 entries, got %+v", verification)
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	merkleTree "github.com/vitaliy/file-storage/common/merkleTree"
+)
+
+const (
+	// maxChallengeFiles and maxChallengeBytes limit how many files a
+	// challenge may sample and how large they may be together, since their
+	// whole content is read and returned.
+	maxChallengeFiles = 16
+	maxChallengeBytes = 32 << 20
+	minNonceSize      = 16
+	maxNonceSize      = 64
+)
+
+// ChallengeRequest asks the server to prove that it stores the files with
+// the given distinct leaf indices. Nonce is a random hex string chosen by
+// the client for every challenge.
+type ChallengeRequest struct {
+	Nonce string `json:"nonce"`
+	Files []int  `json:"files"`
+}
+
+// ChallengeResponse answers a challenge with the content and proof of every
+// sampled file, as the challenge must return the sampled data. The client
+// proves storage by hashing the content itself against the root it holds; a
+// hash of the nonce and the content would prove nothing next to the content.
+// The nonce is echoed, so the client can tell its challenge was answered.
+type ChallengeResponse struct {
+	Key           string                    `json:"key"`
+	Version       int                       `json:"version"`
+	Root          string                    `json:"root"`
+	HashAlgorithm string                    `json:"hashAlgorithm"`
+	Nonce         string                    `json:"nonce"`
+	Samples       []ChallengeSampleResponse `json:"samples"`
+}
+
+type ChallengeSampleResponse struct {
+	Index   int      `json:"index"`
+	Content []byte   `json:"content,omitempty"`
+	Proof   []string `json:"proof"`
+	Deleted bool     `json:"deleted,omitempty"`
+}
+
+// challengeHandler answers a proof-of-storage challenge against a version of
+// a set, given by the optional version query parameter.
+func (s *server) challengeHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	err := s.authorize(r, key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	versionInt, err := parseVersion(r.URL.Query().Get("version"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var request ChallengeRequest
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, 4<<10)).Decode(&request)
+	if err != nil {
+		writeError(w, newAPIError(http.StatusBadRequest, "invalid_request", err.Error()))
+		return
+	}
+
+	nonce, err := hex.DecodeString(request.Nonce)
+	if err != nil || len(nonce) < minNonceSize || len(nonce) > maxNonceSize {
+		writeError(w, errInvalidChallenge)
+		return
+	}
+	if len(request.Files) == 0 || len(request.Files) > maxChallengeFiles {
+		writeError(w, errInvalidChallenge)
+		return
+	}
+	sorted := slices.Clone(request.Files)
+	slices.Sort(sorted)
+	if len(slices.Compact(sorted)) != len(request.Files) {
+		writeError(w, errInvalidChallenge)
+		return
+	}
+
+	samples, version, err := s.files.As(actor(r)).Challenge(key, versionInt, request.Files, maxChallengeBytes)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := ChallengeResponse{
+		Key:           key,
+		Version:       version.Number,
+		Root:          hex.EncodeToString(version.Root),
+		HashAlgorithm: merkleTree.HashAlgorithm,
+		Nonce:         request.Nonce,
+		Samples:       make([]ChallengeSampleResponse, 0, len(samples)),
+	}
+	for _, sample := range samples {
+		proof := make([]string, 0, len(sample.Proof))
+		for _, hash := range sample.Proof {
+			proof = append(proof, hex.EncodeToString(hash))
+		}
+
+		response.Samples = append(response.Samples, ChallengeSampleResponse{
+			Index:   sample.Index,
+			Content: sample.Content,
+			Proof:   proof,
+			Deleted: sample.Deleted,
+		})
+	}
+
+	// Every challenge is answered afresh.
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	merkleTree "github.com/vitaliy/file-storage/common/merkleTree"
+)
+
+func TestChallenge(t *testing.T) {
+	ts := newTestServer(t, 1<<20)
+
+	resp := upload(t, http.MethodPost, ts.URL+"/v1/sets", "", map[string]string{"a": "content a", "b": "content b", "c": "content c"})
+	var uploadResponse UploadResponse
+	json.NewDecoder(resp.Body).Decode(&uploadResponse)
+	setURL := ts.URL + "/v1/sets/" + uploadResponse.Key
+
+	var manifest ManifestResponse
+	json.NewDecoder(get(t, setURL).Body).Decode(&manifest)
+	root, _ := hex.DecodeString(manifest.Root)
+
+	do(t, newRequest(t, http.MethodDelete, setURL+"/files/1", ""))
+
+	nonce := strings.Repeat("ab", 16)
+	resp = challenge(t, setURL+"/challenge?version=1", `{"nonce": "`+nonce+`", "files": [0, 1, 2]}`)
+	var response ChallengeResponse
+	err := json.NewDecoder(resp.Body).Decode(&response)
+	if resp.StatusCode != http.StatusOK || err != nil {
+		t.Fatalf("Expected the challenge to be answered, got %v (%v)", resp.Status, err)
+	}
+	if response.Nonce != nonce || response.Root != manifest.Root || len(response.Samples) != 3 {
+		t.Fatalf("Expected the challenge to be echoed with 3 samples, got %+v", response)
+	}
+
+	for _, sample := range response.Samples {
+		if sample.Index == 1 {
+			if !sample.Deleted || sample.Content != nil {
+				t.Fatalf("Expected the deleted file to have no content, got %+v", sample)
+			}
+			continue
+		}
+
+		hash, _ := merkleTree.GetHashFromBytes(sample.Content)
+		proof := make([][]byte, 0, len(sample.Proof))
+		for _, p := range sample.Proof {
+			decoded, _ := hex.DecodeString(p)
+			proof = append(proof, decoded)
+		}
+
+		ok, err := merkleTree.VerifyProof(root, sample.Index, hash, proof)
+		if !ok || err != nil {
+			t.Fatalf("Expected sample %v to verify against the root, got %v (%v)", sample.Index, ok, err)
+		}
+	}
+
+	verifyError(t, challenge(t, setURL+"/challenge", `{"nonce": "abcd", "files": [0]}`), http.StatusBadRequest, "invalid_challenge")
+	verifyError(t, challenge(t, setURL+"/challenge", `{"nonce": "`+nonce+`", "files": []}`), http.StatusBadRequest, "invalid_challenge")
+	verifyError(t, challenge(t, setURL+"/challenge", `{"nonce": "`+nonce+`", "files": [0, 2, 0]}`), http.StatusBadRequest, "invalid_challenge")
+	verifyError(t, challenge(t, setURL+"/challenge", `{"nonce": "`+nonce+`", "files": [3]}`), http.StatusNotFound, "file_not_found")
+}
+
+func challenge(t *testing.T, url string, body string) *http.Response {
+	resp, err := http.Post(url, "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error sending challenge: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
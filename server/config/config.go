@@ -0,0 +1,571 @@
+// Package config loads the settings of the server from defaults, a JSON
+// config file, environment variables and command line flags, each source
+// overriding the ones before it.
+package config
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings of the server.
+type Config struct {
+	// ListenAddr is the TCP address the server listens on.
+	ListenAddr string `json:"listenAddr"`
+	// DataDir is the directory files and metadata are stored in.
+	DataDir string `json:"dataDir"`
+
+	// MaxUploadSize limits the body of an upload in bytes.
+	MaxUploadSize int64 `json:"maxUploadSize"`
+	// MaxUploadMemory is how many bytes of an upload are buffered in memory
+	// before the rest is spooled to temporary files.
+	MaxUploadMemory int64 `json:"maxUploadMemory"`
+	// DefaultTTL is how long a set is kept when an upload does not say.
+	// Zero keeps such sets forever.
+	DefaultTTL Duration `json:"defaultTTL"`
+
+	// TLSCertFile and TLSKeyFile enable HTTPS when both are set.
+	TLSCertFile string `json:"tlsCertFile"`
+	TLSKeyFile  string `json:"tlsKeyFile"`
+	// TLSClientCAFile is a PEM bundle of the CAs that sign client
+	// certificates.
+	TLSClientCAFile string `json:"tlsClientCAFile"`
+	// TLSClientAuth is one of none, optional and require. Optional verifies
+	// client certificates that are presented, require rejects clients
+	// without one.
+	TLSClientAuth string `json:"tlsClientAuth"`
+
+	// AdminToken authenticates an admin that manages API keys. Empty
+	// disables it, which leaves keys to be managed by admin API keys.
+	AdminToken string `json:"adminToken"`
+	// RequireAuth rejects requests without an API key or client
+	// certificate. Otherwise anonymous clients may upload sets without an
+	// owner, which are open to everyone.
+	RequireAuth bool `json:"requireAuth"`
+	// ShareSecret is the key share links are signed with. Changing it
+	// invalidates every link handed out before.
+	ShareSecret string `json:"shareSecret"`
+
+	// MasterKey is the hex encoded 32 byte key that wraps the data keys of
+	// sets. Setting it encrypts new sets at rest.
+	MasterKey string `json:"masterKey"`
+	// PreviousMasterKeys are the master keys used before the current one.
+	// They unwrap data keys until the master key is rotated.
+	PreviousMasterKeys []string `json:"previousMasterKeys"`
+
+	// QuotaBytes, QuotaSets and QuotaFilesPerSet limit what every API key
+	// owner, client certificate and anonymous client IP may store. Zero is
+	// unlimited. Admins are exempt.
+	QuotaBytes       int64 `json:"quotaBytes"`
+	QuotaSets        int64 `json:"quotaSets"`
+	QuotaFilesPerSet int64 `json:"quotaFilesPerSet"`
+	// RateLimit is how many requests per second each of them may make on
+	// average, RateBurst how many at once. Zero disables rate limiting.
+	RateLimit float64 `json:"rateLimit"`
+	RateBurst int64   `json:"rateBurst"`
+
+	// CORSOrigins are the origins of the web pages that may call the API
+	// from a browser, like https://files.example.com, or * for every
+	// origin. The embedded UI is served by the server itself and needs none.
+	CORSOrigins []string `json:"corsOrigins"`
+
+	ReadHeaderTimeout Duration `json:"readHeaderTimeout"`
+	ReadTimeout       Duration `json:"readTimeout"`
+	WriteTimeout      Duration `json:"writeTimeout"`
+	IdleTimeout       Duration `json:"idleTimeout"`
+	// ShutdownTimeout is how long in-flight requests may take to finish
+	// once the server is asked to stop.
+	ShutdownTimeout Duration `json:"shutdownTimeout"`
+
+	// LogLevel is one of debug, info, warn and error.
+	LogLevel string `json:"logLevel"`
+}
+
+// Duration is a time.Duration that is written as a string like "90s" in the
+// config file.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+// Default returns the settings used for everything that is not configured.
+func Default() Config {
+	return Config{
+		ListenAddr:        ":8080",
+		DataDir:           "files",
+		MaxUploadSize:     1 << 30,
+		MaxUploadMemory:   10 << 20,
+		ReadHeaderTimeout: Duration(10 * time.Second),
+		ReadTimeout:       Duration(10 * time.Minute),
+		WriteTimeout:      Duration(10 * time.Minute),
+		IdleTimeout:       Duration(2 * time.Minute),
+		ShutdownTimeout:   Duration(30 * time.Second),
+		TLSClientAuth:     "none",
+		RateBurst:         20,
+		LogLevel:          "info",
+	}
+}
+
+// setting is a value of Config that can be set from the environment and the
+// command line.
+type setting struct {
+	flag  string
+	env   string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{"listen", "LISTEN_ADDR", "address to listen on", func(c *Config, v string) error {
+		c.ListenAddr = v
+		return nil
+	}},
+	{"data-dir", "DATA_DIR", "directory to store files in", func(c *Config, v string) error {
+		c.DataDir = v
+		return nil
+	}},
+	{"max-upload-size", "MAX_UPLOAD_SIZE", "maximum size of an upload in bytes", func(c *Config, v string) error {
+		return parseInt(&c.MaxUploadSize, v)
+	}},
+	{"max-upload-memory", "MAX_UPLOAD_MEMORY", "bytes of an upload to buffer in memory", func(c *Config, v string) error {
+		return parseInt(&c.MaxUploadMemory, v)
+	}},
+	{"default-ttl", "DEFAULT_SET_TTL", "how long sets are kept by default, 0 for forever", func(c *Config, v string) error {
+		return parseDuration(&c.DefaultTTL, v)
+	}},
+	{"tls-cert", "TLS_CERT_FILE", "TLS certificate file", func(c *Config, v string) error {
+		c.TLSCertFile = v
+		return nil
+	}},
+	{"tls-key", "TLS_KEY_FILE", "TLS private key file", func(c *Config, v string) error {
+		c.TLSKeyFile = v
+		return nil
+	}},
+	{"tls-client-ca", "TLS_CLIENT_CA_FILE", "CA bundle for client certificates", func(c *Config, v string) error {
+		c.TLSClientCAFile = v
+		return nil
+	}},
+	{"tls-client-auth", "TLS_CLIENT_AUTH", "one of none, optional and require", func(c *Config, v string) error {
+		c.TLSClientAuth = v
+		return nil
+	}},
+	{"admin-token", "ADMIN_TOKEN", "token of the admin that manages API keys", func(c *Config, v string) error {
+		c.AdminToken = v
+		return nil
+	}},
+	{"require-auth", "REQUIRE_AUTH", "reject anonymous requests", func(c *Config, v string) error {
+		return parseBool(&c.RequireAuth, v)
+	}},
+	{"share-secret", "SHARE_SECRET", "key share links are signed with", func(c *Config, v string) error {
+		c.ShareSecret = v
+		return nil
+	}},
+	{"master-key", "MASTER_KEY", "hex encoded key that encrypts new sets at rest", func(c *Config, v string) error {
+		c.MasterKey = v
+		return nil
+	}},
+	{"previous-master-keys", "PREVIOUS_MASTER_KEYS", "comma separated master keys used before the current one", func(c *Config, v string) error {
+		c.PreviousMasterKeys = strings.Split(v, ",")
+		return nil
+	}},
+	{"quota-bytes", "QUOTA_BYTES", "bytes each identity may store, 0 for unlimited", func(c *Config, v string) error {
+		return parseInt(&c.QuotaBytes, v)
+	}},
+	{"quota-sets", "QUOTA_SETS", "sets each identity may store, 0 for unlimited", func(c *Config, v string) error {
+		return parseInt(&c.QuotaSets, v)
+	}},
+	{"quota-files-per-set", "QUOTA_FILES_PER_SET", "files a set may hold, 0 for unlimited", func(c *Config, v string) error {
+		return parseInt(&c.QuotaFilesPerSet, v)
+	}},
+	{"rate-limit", "RATE_LIMIT", "requests per second each identity may make, 0 for unlimited", func(c *Config, v string) error {
+		return parseFloat(&c.RateLimit, v)
+	}},
+	{"rate-burst", "RATE_BURST", "requests each identity may make at once", func(c *Config, v string) error {
+		return parseInt(&c.RateBurst, v)
+	}},
+	{"cors-origins", "CORS_ORIGINS", "comma separated origins that may call the API from a browser, * for every origin", func(c *Config, v string) error {
+		c.CORSOrigins = strings.Split(v, ",")
+		return nil
+	}},
+	{"read-header-timeout", "READ_HEADER_TIMEOUT", "timeout for reading request headers", func(c *Config, v string) error {
+		return parseDuration(&c.ReadHeaderTimeout, v)
+	}},
+	{"read-timeout", "READ_TIMEOUT", "timeout for reading a request", func(c *Config, v string) error {
+		return parseDuration(&c.ReadTimeout, v)
+	}},
+	{"write-timeout", "WRITE_TIMEOUT", "timeout for writing a response", func(c *Config, v string) error {
+		return parseDuration(&c.WriteTimeout, v)
+	}},
+	{"idle-timeout", "IDLE_TIMEOUT", "timeout for idle keep-alive connections", func(c *Config, v string) error {
+		return parseDuration(&c.IdleTimeout, v)
+	}},
+	{"shutdown-timeout", "SHUTDOWN_TIMEOUT", "time in-flight requests get to finish on shutdown", func(c *Config, v string) error {
+		return parseDuration(&c.ShutdownTimeout, v)
+	}},
+	{"log-level", "LOG_LEVEL", "one of debug, info, warn and error", func(c *Config, v string) error {
+		c.LogLevel = v
+		return nil
+	}},
+}
+
+// Load builds the configuration from the command line arguments args and
+// the environment looked up with getenv, reading the config file named by
+// -config or CONFIG_FILE first. The result is validated.
+func Load(args []string, getenv func(string) string) (*Config, error) {
+	flags := flag.NewFlagSet("server", flag.ContinueOnError)
+	configFile := flags.String("config", getenv("CONFIG_FILE"), "JSON config file")
+
+	// Flags are only applied once the file and the environment are, so they
+	// override both.
+	flagValues := make(map[string]string)
+	for _, s := range settings {
+		s := s
+		flags.Func(s.flag, s.usage+" (env "+s.env+")", func(value string) error {
+			flagValues[s.flag] = value
+			return s.set(&Config{}, value)
+		})
+	}
+
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %v", flags.Args())
+	}
+
+	config := Default()
+
+	if *configFile != "" {
+		err := config.readFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, s := range settings {
+		value := getenv(s.env)
+		if value == "" {
+			continue
+		}
+
+		err := s.set(&config, value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %v: %w", s.env, err)
+		}
+	}
+
+	for _, s := range settings {
+		value, ok := flagValues[s.flag]
+		if ok {
+			s.set(&config, value)
+		}
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &config, nil
+}
+
+func (c *Config) readFile(name string) error {
+	content, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.DisallowUnknownFields()
+
+	err = decoder.Decode(c)
+	if err != nil {
+		return fmt.Errorf("invalid config file %v: %w", name, err)
+	}
+
+	return nil
+}
+
+// minSecretLength keeps the admin token and the share secret from being
+// guessable.
+const minSecretLength = 32
+
+// Validate reports every invalid setting of c.
+func (c *Config) Validate() error {
+	var errs []error
+
+	_, _, err := net.SplitHostPort(c.ListenAddr)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("invalid listen address %q: %w", c.ListenAddr, err))
+	}
+
+	if c.DataDir == "" {
+		errs = append(errs, errors.New("data directory must be set"))
+	}
+
+	if c.MaxUploadSize <= 0 {
+		errs = append(errs, errors.New("maximum upload size must be positive"))
+	}
+	if c.MaxUploadMemory <= 0 {
+		errs = append(errs, errors.New("maximum upload memory must be positive"))
+	}
+	if c.DefaultTTL < 0 {
+		errs = append(errs, errors.New("default TTL must not be negative"))
+	}
+
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		errs = append(errs, errors.New("TLS certificate and key files must be set together"))
+	}
+	for _, name := range []string{c.TLSCertFile, c.TLSKeyFile, c.TLSClientCAFile} {
+		if name == "" {
+			continue
+		}
+		_, err := os.Stat(name)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("TLS file: %w", err))
+		}
+	}
+
+	_, ok := clientAuthTypes[c.TLSClientAuth]
+	if !ok {
+		errs = append(errs, fmt.Errorf("invalid TLS client auth %q", c.TLSClientAuth))
+	}
+	if c.TLSClientAuth != "none" && (!c.TLS() || c.TLSClientCAFile == "") {
+		errs = append(errs, errors.New("TLS client auth needs TLS and a client CA file"))
+	}
+
+	if c.AdminToken != "" && len(c.AdminToken) < minSecretLength {
+		errs = append(errs, fmt.Errorf("admin token must be at least %v characters", minSecretLength))
+	}
+	if c.ShareSecret != "" && len(c.ShareSecret) < minSecretLength {
+		errs = append(errs, fmt.Errorf("share secret must be at least %v characters", minSecretLength))
+	}
+
+	_, _, err = c.MasterKeys()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if c.QuotaBytes < 0 || c.QuotaSets < 0 || c.QuotaFilesPerSet < 0 {
+		errs = append(errs, errors.New("quotas must not be negative"))
+	}
+	if c.RateLimit < 0 {
+		errs = append(errs, errors.New("rate limit must not be negative"))
+	}
+	if c.RateLimit > 0 && c.RateBurst < 1 {
+		errs = append(errs, errors.New("rate burst must be at least 1"))
+	}
+
+	for _, origin := range c.CORSOrigins {
+		err := validateOrigin(origin)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	timeouts := []struct {
+		name    string
+		timeout Duration
+	}{
+		{"read header", c.ReadHeaderTimeout},
+		{"read", c.ReadTimeout},
+		{"write", c.WriteTimeout},
+		{"idle", c.IdleTimeout},
+		{"shutdown", c.ShutdownTimeout},
+	}
+	for _, t := range timeouts {
+		if t.timeout < 0 {
+			errs = append(errs, fmt.Errorf("%v timeout must not be negative", t.name))
+		}
+	}
+
+	_, err = c.Level()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateOrigin checks that origin is * or an origin as browsers send it,
+// a scheme and host without a path.
+func validateOrigin(origin string) error {
+	if origin == "*" {
+		return nil
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil || u.Path != "" || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("invalid CORS origin %q, expected a scheme and host like https://example.com", origin)
+	}
+
+	return nil
+}
+
+// Level returns the configured log level.
+func (c *Config) Level() (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(strings.ToUpper(c.LogLevel)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid log level %q", c.LogLevel)
+	}
+
+	return level, nil
+}
+
+// masterKeySize is the size of a master key in bytes, selecting AES-256.
+const masterKeySize = 32
+
+// MasterKeys returns the decoded current and previous master keys. The
+// current key is nil when encryption at rest is disabled.
+func (c *Config) MasterKeys() ([]byte, [][]byte, error) {
+	if c.MasterKey == "" {
+		if len(c.PreviousMasterKeys) > 0 {
+			return nil, nil, errors.New("previous master keys need a master key")
+		}
+		return nil, nil, nil
+	}
+
+	current, err := decodeMasterKey(c.MasterKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid master key: %w", err)
+	}
+
+	previous := make([][]byte, 0, len(c.PreviousMasterKeys))
+	for i, key := range c.PreviousMasterKeys {
+		decoded, err := decodeMasterKey(key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid previous master key %v: %w", i, err)
+		}
+		previous = append(previous, decoded)
+	}
+
+	return current, previous, nil
+}
+
+func decodeMasterKey(key string) ([]byte, error) {
+	decoded, err := hex.DecodeString(strings.TrimSpace(key))
+	if err != nil {
+		return nil, errors.New("not hex encoded")
+	}
+	if len(decoded) != masterKeySize {
+		return nil, fmt.Errorf("must be %v bytes", masterKeySize)
+	}
+
+	return decoded, nil
+}
+
+// TLS reports whether the server serves HTTPS.
+func (c *Config) TLS() bool {
+	return c.TLSCertFile != ""
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"none":     tls.NoClientCert,
+	"optional": tls.VerifyClientCertIfGiven,
+	"require":  tls.RequireAndVerifyClientCert,
+}
+
+// TLSConfig loads the certificates of the server and the client CAs. It
+// returns nil when TLS is not enabled.
+func (c *Config) TLSConfig() (*tls.Config, error) {
+	if !c.TLS() {
+		return nil, nil
+	}
+
+	certificate, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{certificate},
+		ClientAuth:   clientAuthTypes[c.TLSClientAuth],
+	}
+
+	if c.TLSClientCAFile != "" {
+		bundle, err := os.ReadFile(c.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("no certificates in %v", c.TLSClientCAFile)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+func parseInt(target *int64, value string) error {
+	parsed, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return err
+	}
+
+	*target = parsed
+	return nil
+}
+
+func parseFloat(target *float64, value string) error {
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+
+	*target = parsed
+	return nil
+}
+
+func parseBool(target *bool, value string) error {
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+
+	*target = parsed
+	return nil
+}
+
+func parseDuration(target *Duration, value string) error {
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*target = Duration(parsed)
+	return nil
+}
@@ -0,0 +1,98 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadDefaults(t *testing.T) {
+	config, err := Load(nil, env(nil))
+	if err != nil {
+		t.Fatalf("Error loading configuration: %v", err)
+	}
+
+	if !reflect.DeepEqual(*config, Default()) {
+		t.Fatalf("Expected defaults, got %+v", config)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(file, []byte(`{"listenAddr": ":7000", "dataDir": "from-file", "defaultTTL": "1h", "logLevel": "debug"}`), 0600)
+	if err != nil {
+		t.Fatalf("Error writing config file: %v", err)
+	}
+
+	config, err := Load([]string{"-data-dir", "from-flag"}, env(map[string]string{
+		"CONFIG_FILE": file,
+		"DATA_DIR":    "from-env",
+		"LOG_LEVEL":   "warn",
+	}))
+	if err != nil {
+		t.Fatalf("Error loading configuration: %v", err)
+	}
+
+	if config.ListenAddr != ":7000" || time.Duration(config.DefaultTTL) != time.Hour {
+		t.Fatalf("Expected settings of the config file, got %+v", config)
+	}
+	if config.LogLevel != "warn" {
+		t.Fatalf("Expected the environment to override the config file, got %v", config.LogLevel)
+	}
+	if config.DataDir != "from-flag" {
+		t.Fatalf("Expected flags to override the environment, got %v", config.DataDir)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(file, []byte(`{"listen": ":7000"}`), 0600)
+	if err != nil {
+		t.Fatalf("Error writing config file: %v", err)
+	}
+
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{"unknown field", []string{"-config", file}, nil, "unknown field"},
+		{"bad flag", []string{"-read-timeout", "soon"}, nil, "invalid duration"},
+		{"bad env", nil, map[string]string{"MAX_UPLOAD_SIZE": "big"}, "MAX_UPLOAD_SIZE"},
+		{"listen address", []string{"-listen", "8080"}, nil, "listen address"},
+		{"upload size", []string{"-max-upload-size", "0"}, nil, "upload size"},
+		{"tls pair", []string{"-tls-cert", file}, nil, "set together"},
+		{"tls file", []string{"-tls-cert", "missing.pem", "-tls-key", file}, nil, "missing.pem"},
+		{"client auth", []string{"-tls-client-auth", "always"}, nil, "client auth"},
+		{"client auth without ca", []string{"-tls-client-auth", "require"}, nil, "client CA"},
+		{"admin token", nil, map[string]string{"ADMIN_TOKEN": "secret"}, "admin token"},
+		{"share secret", []string{"-share-secret", "secret"}, nil, "share secret"},
+		{"require auth", []string{"-require-auth", "maybe"}, nil, "invalid syntax"},
+		{"master key", nil, map[string]string{"MASTER_KEY": "00ff"}, "master key"},
+		{"previous master keys", []string{"-previous-master-keys", strings.Repeat("00", 32)}, nil, "need a master key"},
+		{"quota", []string{"-quota-bytes", "-1"}, nil, "quotas"},
+		{"rate burst", nil, map[string]string{"RATE_LIMIT": "0.5", "RATE_BURST": "0"}, "rate burst"},
+		{"cors origin", []string{"-cors-origins", "https://example.com,example.org"}, nil, "CORS origin"},
+		{"cors origin path", nil, map[string]string{"CORS_ORIGINS": "https://example.com/"}, "CORS origin"},
+		{"log level", nil, map[string]string{"LOG_LEVEL": "loud"}, "log level"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Load(test.args, env(test.env))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("Expected an error about %v, got %v", test.want, err)
+			}
+		})
+	}
+}
+
+func env(values map[string]string) func(string) string {
+	return func(name string) string {
+		return values[name]
+	}
+}
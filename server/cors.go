@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var (
+	// corsAllowedHeaders are the request headers of the API that browsers
+	// only send cross-origin after a preflight.
+	corsAllowedHeaders = []string{"Authorization", "Content-Type", "If-Match", "If-None-Match", "If-Modified-Since", "Range", "X-Merkle-Root", "X-Set-TTL"}
+	// corsExposedHeaders are the response headers of the API that pages of
+	// other origins may read, like the proofs of downloads.
+	corsExposedHeaders = []string{"Content-Disposition", "Content-Range", "ETag", "Location", "Retry-After", "WWW-Authenticate",
+		"X-Merkle-Hash-Algorithm", "X-Merkle-Index", "X-Merkle-Proof", "X-Merkle-Root", "X-Merkle-Version"}
+)
+
+// cors lets web pages of the allowed origins call the API from a browser.
+// It answers preflight requests itself, before the caller is authenticated,
+// since browsers send them without credentials. Credentials are bearer
+// tokens, not cookies, so pages never send them on their own.
+func (s *server) cors(next http.Handler) http.Handler {
+	if len(s.corsOrigins) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Origin")
+
+		origin := r.Header.Get("Origin")
+		if origin == "" || !s.allowsOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+
+		if r.Method != http.MethodOptions || r.Header.Get("Access-Control-Request-Method") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+		w.Header().Set("Access-Control-Max-Age", "600")
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+func (s *server) allowsOrigin(origin string) bool {
+	return slices.Contains(s.corsOrigins, "*") || slices.Contains(s.corsOrigins, origin)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	s := newTestAPI(t, 1<<20)
+	s.corsOrigins = []string{"https://ui.example.com"}
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+
+	preflight := func(origin string) *http.Response {
+		req := newRequest(t, http.MethodOptions, ts.URL+"/v1/sets", "")
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		req.Header.Set("Access-Control-Request-Headers", "authorization, x-merkle-root")
+		return do(t, req)
+	}
+
+	resp := preflight("https://ui.example.com")
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Access-Control-Allow-Origin") != "https://ui.example.com" {
+		t.Fatalf("Expected the preflight to be allowed, got %v %v", resp.Status, resp.Header)
+	}
+	for _, header := range []string{"Authorization", "X-Merkle-Root", "If-Match"} {
+		if !strings.Contains(resp.Header.Get("Access-Control-Allow-Headers"), header) {
+			t.Fatalf("Expected %v to be allowed, got %v", header, resp.Header.Get("Access-Control-Allow-Headers"))
+		}
+	}
+
+	resp = preflight("https://evil.example.com")
+	if resp.Header.Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("Expected another origin not to be allowed, got %v", resp.Header)
+	}
+
+	// Errors are readable too, so pages can show them.
+	req := newRequest(t, http.MethodGet, ts.URL+"/v1/sets/missing", "")
+	req.Header.Set("Origin", "https://ui.example.com")
+	resp = do(t, req)
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("Access-Control-Allow-Origin") != "https://ui.example.com" {
+		t.Fatalf("Expected the response to allow the origin, got %v %v", resp.Status, resp.Header)
+	}
+	if !strings.Contains(resp.Header.Get("Access-Control-Expose-Headers"), "X-Merkle-Proof") {
+		t.Fatalf("Expected the proof headers to be exposed, got %v", resp.Header.Get("Access-Control-Expose-Headers"))
+	}
+
+	// Without origins the server answers like before.
+	ts = newTestServer(t, 1<<20)
+	req = newRequest(t, http.MethodGet, ts.URL+"/ping", "")
+	req.Header.Set("Origin", "https://ui.example.com")
+	resp = do(t, req)
+	if resp.Header.Get("Access-Control-Allow-Origin") != "" || resp.Header.Get("Vary") != "" {
+		t.Fatalf("Expected no CORS headers without origins, got %v", resp.Header)
+	}
+}
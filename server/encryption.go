@@ -0,0 +1,40 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	fileservice "github.com/vitaliy/file-storage/server/fileService"
+)
+
+// RotateMasterKeyResponse reports how many data keys were wrapped with the
+// current master key.
+type RotateMasterKeyResponse struct {
+	Rewrapped int `json:"rewrapped"`
+}
+
+// rotateMasterKeyHandler wraps the data keys of all sets with the current
+// master key, after the previous one was moved to the previous master keys.
+// The content of the sets is not encrypted again.
+func (s *server) rotateMasterKeyHandler(w http.ResponseWriter, r *http.Request) {
+	err := requireAdmin(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	rewrapped, err := s.files.As(actor(r)).RotateMasterKey()
+	if errors.Is(err, fileservice.ErrNoMasterKey) {
+		writeError(w, errNoMasterKey)
+		return
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	slog.Info("rotated master key", "rewrapped", rewrapped)
+
+	writeJSON(w, http.StatusOK, RotateMasterKeyResponse{Rewrapped: rewrapped})
+}
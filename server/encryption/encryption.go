@@ -0,0 +1,302 @@
+// Package encryption encrypts the data of sets at rest.
+//
+// Content is encrypted with AES-GCM in segments of SegmentSize bytes, so
+// large files are streamed and can be read from any offset. Every set has
+// its own data key, which is stored wrapped by a master key, see Keyring.
+package encryption
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+const (
+	// KeySize is the size of data and master keys in bytes, selecting AES-256.
+	KeySize = 32
+	// SegmentSize is the number of plaintext bytes encrypted together.
+	SegmentSize = 64 << 10
+)
+
+// An encrypted stream starts with magic and a random nonce prefix, followed
+// by the sealed segments. The nonce of a segment is the prefix and its
+// index, and the last segment is authenticated as such, so segments can be
+// neither reordered nor dropped from the end.
+const (
+	magic      = "FSE1"
+	prefixSize = 8
+	headerSize = len(magic) + prefixSize
+	overhead   = 16
+)
+
+var ErrCorrupt = errors.New("encrypted data is corrupt")
+
+// Writer encrypts what is written to it into an underlying writer. It must
+// be closed to write the last segment.
+type Writer struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	nonce  []byte
+	index  uint32
+	buf    []byte
+	sealed []byte
+}
+
+// NewWriter returns a Writer that encrypts with key into w.
+func NewWriter(w io.Writer, key []byte) (*Writer, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = rand.Read(nonce[:prefixSize])
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = io.WriteString(w, magic)
+	if err != nil {
+		return nil, err
+	}
+	_, err = w.Write(nonce[:prefixSize])
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		w:      w,
+		aead:   aead,
+		nonce:  nonce,
+		buf:    make([]byte, 0, SegmentSize),
+		sealed: make([]byte, 0, SegmentSize+overhead),
+	}, nil
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full segment is only sealed once more content follows, so the
+		// last one is known on Close.
+		if len(w.buf) == SegmentSize {
+			err := w.seal(false)
+			if err != nil {
+				return written, err
+			}
+		}
+
+		n := min(SegmentSize-len(w.buf), len(p))
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Close seals the last segment. It does not close the underlying writer.
+func (w *Writer) Close() error {
+	return w.seal(true)
+}
+
+func (w *Writer) seal(last bool) error {
+	if w.index == math.MaxUint32 {
+		return errors.New("too much content to encrypt")
+	}
+
+	binary.BigEndian.PutUint32(w.nonce[prefixSize:], w.index)
+	w.sealed = w.aead.Seal(w.sealed[:0], w.nonce, w.buf, segmentData(last))
+
+	_, err := w.w.Write(w.sealed)
+	if err != nil {
+		return err
+	}
+
+	w.index++
+	w.buf = w.buf[:0]
+
+	return nil
+}
+
+// Reader decrypts content that was encrypted by a Writer. It reads the
+// segments at the offsets it is asked for, so it can seek.
+type Reader struct {
+	r        io.ReaderAt
+	aead     cipher.AEAD
+	nonce    []byte
+	segments int64
+	size     int64
+	offset   int64
+	// segment is the index of the decrypted segment in plain, or -1.
+	segment int64
+	plain   []byte
+	sealed  []byte
+}
+
+// NewReader returns a Reader of the encrypted content of length size in r.
+func NewReader(r io.ReaderAt, size int64, key []byte) (*Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, headerSize)
+	_, err = r.ReadAt(header, 0)
+	if err != nil || string(header[:len(magic)]) != magic {
+		return nil, ErrCorrupt
+	}
+
+	body := size - int64(headerSize)
+	segments := (body + SegmentSize + overhead - 1) / (SegmentSize + overhead)
+	last := body - (segments-1)*(SegmentSize+overhead)
+	if segments == 0 || last < overhead || segments > math.MaxUint32 {
+		return nil, ErrCorrupt
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	copy(nonce, header[len(magic):])
+
+	reader := &Reader{
+		r:        r,
+		aead:     aead,
+		nonce:    nonce,
+		segments: segments,
+		size:     body - segments*overhead,
+		segment:  -1,
+		sealed:   make([]byte, SegmentSize+overhead),
+	}
+
+	// Empty content is never read, so its only segment is authenticated
+	// right away.
+	if reader.size == 0 {
+		err := reader.load(0)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return reader, nil
+}
+
+// Size returns the length of the decrypted content.
+func (r *Reader) Size() int64 {
+	return r.size
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	segment := r.offset / SegmentSize
+	if segment != r.segment {
+		err := r.load(segment)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.plain[r.offset-segment*SegmentSize:])
+	r.offset += int64(n)
+
+	return n, nil
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	r.offset = offset
+	return offset, nil
+}
+
+func (r *Reader) load(segment int64) error {
+	start := int64(headerSize) + segment*(SegmentSize+overhead)
+	sealed := r.sealed[:min(SegmentSize+overhead, int64(headerSize)+r.size+r.segments*overhead-start)]
+
+	_, err := r.r.ReadAt(sealed, start)
+	if err != nil && !(errors.Is(err, io.EOF) && segment == r.segments-1) {
+		return err
+	}
+
+	binary.BigEndian.PutUint32(r.nonce[prefixSize:], uint32(segment))
+	r.plain, err = r.aead.Open(r.plain[:0], r.nonce, sealed, segmentData(segment == r.segments-1))
+	if err != nil {
+		r.segment = -1
+		return fmt.Errorf("%w: segment %v", ErrCorrupt, segment)
+	}
+
+	r.segment = segment
+	return nil
+}
+
+// Seal encrypts content with key in one go.
+func Seal(key []byte, content []byte) ([]byte, error) {
+	var sealed bytes.Buffer
+
+	w, err := NewWriter(&sealed, key)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = w.Write(content)
+	if err != nil {
+		return nil, err
+	}
+
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return sealed.Bytes(), nil
+}
+
+// Open decrypts content that was encrypted with key.
+func Open(key []byte, sealed []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(sealed), int64(len(sealed)), key)
+	if err != nil {
+		return nil, err
+	}
+
+	return io.ReadAll(r)
+}
+
+// segmentData is the additional data a segment is authenticated with.
+func segmentData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+
+	return []byte{0}
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %v bytes", KeySize)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,147 @@
+package encryption_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/vitaliy/file-storage/server/encryption"
+)
+
+func TestSealOpen(t *testing.T) {
+	key := newKey(t)
+
+	for _, size := range []int{0, 1, encryption.SegmentSize - 1, encryption.SegmentSize, encryption.SegmentSize + 1, 3*encryption.SegmentSize + 5} {
+		content := make([]byte, size)
+		rand.Read(content)
+
+		sealed, err := encryption.Seal(key, content)
+		if err != nil {
+			t.Fatalf("Error sealing %v bytes: %v", size, err)
+		}
+
+		if size > 16 && bytes.Contains(sealed, content) {
+			t.Fatalf("Expected %v bytes to be encrypted", size)
+		}
+
+		opened, err := encryption.Open(key, sealed)
+		if err != nil || !bytes.Equal(opened, content) {
+			t.Fatalf("Expected %v bytes to round trip, got %v bytes (%v)", size, len(opened), err)
+		}
+
+		_, err = encryption.Open(newKey(t), sealed)
+		if !errors.Is(err, encryption.ErrCorrupt) {
+			t.Fatalf("Expected %v bytes not to open with another key, got %v", size, err)
+		}
+	}
+}
+
+func TestReaderSeek(t *testing.T) {
+	key := newKey(t)
+	content := make([]byte, 2*encryption.SegmentSize+100)
+	rand.Read(content)
+
+	sealed, _ := encryption.Seal(key, content)
+	r, err := encryption.NewReader(bytes.NewReader(sealed), int64(len(sealed)), key)
+	if err != nil {
+		t.Fatalf("Error creating reader: %v", err)
+	}
+
+	if r.Size() != int64(len(content)) {
+		t.Fatalf("Expected size %v, got %v", len(content), r.Size())
+	}
+
+	// Ranges within a segment, across segments and up to the end.
+	ranges := [][2]int{{0, 10}, {encryption.SegmentSize - 5, encryption.SegmentSize + 5}, {2 * encryption.SegmentSize, len(content)}}
+	for _, rng := range ranges {
+		_, err := r.Seek(int64(rng[0]), io.SeekStart)
+		if err != nil {
+			t.Fatalf("Error seeking: %v", err)
+		}
+
+		part := make([]byte, rng[1]-rng[0])
+		_, err = io.ReadFull(r, part)
+		if err != nil || !bytes.Equal(part, content[rng[0]:rng[1]]) {
+			t.Fatalf("Expected bytes %v to %v, got %v", rng[0], rng[1], err)
+		}
+	}
+
+	_, err = r.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("Expected EOF, got %v", err)
+	}
+}
+
+func TestTampering(t *testing.T) {
+	key := newKey(t)
+	content := make([]byte, 2*encryption.SegmentSize)
+	sealed, _ := encryption.Seal(key, content)
+
+	flipped := bytes.Clone(sealed)
+	flipped[len(flipped)/2] ^= 1
+
+	// Dropping the last segment leaves a stream that ends early.
+	truncated := sealed[:len(sealed)-len(sealed)/2+8]
+
+	for name, tampered := range map[string][]byte{"flipped": flipped, "truncated": truncated, "empty": nil} {
+		_, err := encryption.Open(key, tampered)
+		if !errors.Is(err, encryption.ErrCorrupt) {
+			t.Errorf("Expected %v content to be rejected, got %v", name, err)
+		}
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	old := newKey(t)
+	keyring, err := encryption.NewKeyring(old)
+	if err != nil {
+		t.Fatalf("Error creating keyring: %v", err)
+	}
+
+	dataKey, wrapped, err := keyring.NewDataKey("set")
+	if err != nil {
+		t.Fatalf("Error creating data key: %v", err)
+	}
+
+	_, err = keyring.Unwrap(wrapped, "other set")
+	if !errors.Is(err, encryption.ErrCorrupt) {
+		t.Fatalf("Expected the key to be bound to its set, got %v", err)
+	}
+
+	rotated, _ := encryption.NewKeyring(newKey(t), old)
+	if rotated.IsCurrent(wrapped) {
+		t.Fatalf("Expected the key to be wrapped by the previous master key")
+	}
+
+	unwrapped, err := rotated.Unwrap(wrapped, "set")
+	if err != nil || !bytes.Equal(unwrapped, dataKey) {
+		t.Fatalf("Expected the previous master key to unwrap, got %v", err)
+	}
+
+	rewrapped, _ := rotated.Wrap(unwrapped, "set")
+	if !rotated.IsCurrent(rewrapped) {
+		t.Fatalf("Expected the key to be wrapped by the current master key")
+	}
+
+	_, err = keyring.Unwrap(rewrapped, "set")
+	if !errors.Is(err, encryption.ErrUnknownMasterKey) {
+		t.Fatalf("Expected the new master key to be unknown, got %v", err)
+	}
+
+	_, err = encryption.NewKeyring([]byte("short"))
+	if err == nil {
+		t.Fatalf("Expected a short master key to be rejected")
+	}
+}
+
+func newKey(t *testing.T) []byte {
+	key := make([]byte, encryption.KeySize)
+	_, err := rand.Read(key)
+	if err != nil {
+		t.Fatalf("Error creating key: %v", err)
+	}
+
+	return key
+}
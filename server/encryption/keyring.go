@@ -0,0 +1,113 @@
+package encryption
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// A wrapped key is its version, the ID of the master key it was wrapped
+// with, a random nonce and the sealed data key.
+const (
+	wrapVersion = 1
+	idSize      = 8
+	nonceSize   = 12
+)
+
+var ErrUnknownMasterKey = errors.New("data key is wrapped by an unknown master key")
+
+// Keyring wraps data keys with the current master key. It unwraps them with
+// the current or any previous master key, so data keys wrapped before a
+// rotation stay readable until they are wrapped again.
+type Keyring struct {
+	current []byte
+	masters map[[idSize]byte]cipher.AEAD
+}
+
+// NewKeyring returns a keyring that wraps with current and also unwraps with
+// previous.
+func NewKeyring(current []byte, previous ...[]byte) (*Keyring, error) {
+	k := &Keyring{masters: make(map[[idSize]byte]cipher.AEAD)}
+
+	for i, key := range append([][]byte{current}, previous...) {
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("master key %v: %w", i, err)
+		}
+
+		k.masters[masterKeyID(key)] = aead
+	}
+
+	id := masterKeyID(current)
+	k.current = id[:]
+
+	return k, nil
+}
+
+// NewDataKey returns a random data key for the set key, in plain and wrapped
+// by the current master key.
+func (k *Keyring) NewDataKey(key string) ([]byte, []byte, error) {
+	dataKey := make([]byte, KeySize)
+	_, err := rand.Read(dataKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wrapped, err := k.Wrap(dataKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return dataKey, wrapped, nil
+}
+
+// Wrap encrypts the data key of the set key with the current master key.
+// The wrapped key is bound to the set, so it cannot be moved to another one.
+func (k *Keyring) Wrap(dataKey []byte, key string) ([]byte, error) {
+	wrapped := make([]byte, 0, 1+idSize+nonceSize+KeySize+overhead)
+	wrapped = append(wrapped, wrapVersion)
+	wrapped = append(wrapped, k.current...)
+
+	nonce := make([]byte, nonceSize)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+	wrapped = append(wrapped, nonce...)
+
+	aead := k.masters[[idSize]byte(k.current)]
+	return aead.Seal(wrapped, nonce, dataKey, []byte(key)), nil
+}
+
+// Unwrap decrypts the data key of the set key.
+func (k *Keyring) Unwrap(wrapped []byte, key string) ([]byte, error) {
+	if len(wrapped) < 1+idSize+nonceSize || wrapped[0] != wrapVersion {
+		return nil, ErrCorrupt
+	}
+
+	aead, ok := k.masters[[idSize]byte(wrapped[1:1+idSize])]
+	if !ok {
+		return nil, ErrUnknownMasterKey
+	}
+
+	nonce := wrapped[1+idSize : 1+idSize+nonceSize]
+	dataKey, err := aead.Open(nil, nonce, wrapped[1+idSize+nonceSize:], []byte(key))
+	if err != nil {
+		return nil, ErrCorrupt
+	}
+
+	return dataKey, nil
+}
+
+// IsCurrent reports whether wrapped was wrapped by the current master key.
+func (k *Keyring) IsCurrent(wrapped []byte) bool {
+	return len(wrapped) >= 1+idSize && string(wrapped[1:1+idSize]) == string(k.current)
+}
+
+// masterKeyID identifies a master key without revealing it.
+func masterKeyID(key []byte) [idSize]byte {
+	sum := sha256.Sum256(key)
+	return [idSize]byte(sum[:idSize])
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	fileservice "github.com/vitaliy/file-storage/server/fileService"
+)
+
+func TestRotateMasterKey(t *testing.T) {
+	s := newTestAPI(t, 1<<20)
+	s.adminToken = testAdminToken
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+
+	rotate := ts.URL + "/v1/admin/master-key/rotate"
+	verifyError(t, do(t, newRequest(t, http.MethodPost, rotate, "")), http.StatusUnauthorized, "unauthorized")
+	verifyError(t, do(t, newRequest(t, http.MethodPost, rotate, testAdminToken)), http.StatusConflict, "no_master_key")
+
+	files, err := fileservice.NewFileService(fileservice.Options{DataDir: t.TempDir(), MasterKey: bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatalf("Error creating file service: %v", err)
+	}
+	t.Cleanup(func() { files.Close() })
+	s.files = files
+
+	resp := upload(t, http.MethodPost, ts.URL+"/v1/sets", "", map[string]string{"test1": "test1"})
+	var uploadResponse UploadResponse
+	json.NewDecoder(resp.Body).Decode(&uploadResponse)
+
+	var manifest ManifestResponse
+	err = json.NewDecoder(get(t, ts.URL+"/v1/sets/"+uploadResponse.Key).Body).Decode(&manifest)
+	if err != nil || !manifest.Encrypted {
+		t.Fatalf("Expected an encrypted set, got %+v (%v)", manifest, err)
+	}
+
+	resp = do(t, newRequest(t, http.MethodPost, rotate, testAdminToken))
+	var rotated RotateMasterKeyResponse
+	err = json.NewDecoder(resp.Body).Decode(&rotated)
+	if resp.StatusCode != http.StatusOK || err != nil || rotated.Rewrapped != 0 {
+		t.Fatalf("Expected no data keys to need wrapping, got %v %+v (%v)", resp.Status, rotated, err)
+	}
+}
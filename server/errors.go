@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	fileservice "github.com/vitaliy/file-storage/server/fileService"
+)
+
+// ErrorResponse is the body of every error response. Code is stable and
+// meant for programs, Message is meant for people.
+type ErrorResponse struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// apiError is an error together with the status and code it is reported with.
+type apiError struct {
+	status  int
+	code    string
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func newAPIError(status int, code string, message string) *apiError {
+	return &apiError{status: status, code: code, message: message}
+}
+
+var (
+	errInvalidVersion   = newAPIError(http.StatusBadRequest, "invalid_version", "invalid version")
+	errInvalidFile      = newAPIError(http.StatusBadRequest, "invalid_file", "invalid file number")
+	errInvalidTTL       = newAPIError(http.StatusBadRequest, "invalid_ttl", "invalid TTL")
+	errInvalidFormat    = newAPIError(http.StatusBadRequest, "invalid_format", "invalid archive format")
+	errNoFiles          = newAPIError(http.StatusBadRequest, "no_files", "upload contains no files")
+	errUploadTooLarge   = newAPIError(http.StatusRequestEntityTooLarge, "upload_too_large", "upload is too large")
+	errRateLimited      = newAPIError(http.StatusTooManyRequests, "rate_limited", "too many requests")
+	errShuttingDown     = newAPIError(http.StatusServiceUnavailable, "shutting_down", "server is shutting down")
+	errUnauthorized     = newAPIError(http.StatusUnauthorized, "unauthorized", "missing or invalid credentials")
+	errForbidden        = newAPIError(http.StatusForbidden, "forbidden", "access denied")
+	errInvalidOwner     = newAPIError(http.StatusBadRequest, "invalid_owner", "API keys need an owner")
+	errReservedOwner    = newAPIError(http.StatusBadRequest, "invalid_owner", "owner names with a colon and admin are reserved")
+	errInvalidShareLink = newAPIError(http.StatusForbidden, "invalid_share_link", "invalid share link")
+	errShareLinkExpired = newAPIError(http.StatusForbidden, "share_link_expired", "share link expired")
+	errShareLinkGone    = newAPIError(http.StatusGone, "share_link_gone", "the shared version no longer exists")
+	errNoMasterKey      = newAPIError(http.StatusConflict, "no_master_key", "no master key configured")
+	errInvalidChallenge = newAPIError(http.StatusBadRequest, "invalid_challenge", "a challenge needs a hex nonce of 16 to 64 bytes and 1 to 16 distinct files")
+	errInvalidRoot      = newAPIError(http.StatusBadRequest, "invalid_root", "invalid root, expected hex")
+	errInvalidTime      = newAPIError(http.StatusBadRequest, "invalid_time", "invalid time, expected RFC 3339")
+	errRouteNotFound    = newAPIError(http.StatusNotFound, "route_not_found", "no such endpoint")
+	errMethodNotAllowed = newAPIError(http.StatusMethodNotAllowed, "method_not_allowed", "method not allowed")
+)
+
+// writeError reports err as an ErrorResponse. Errors of the file service are
+// mapped to their status; anything unexpected is logged and reported without
+// details.
+func writeError(w http.ResponseWriter, err error) {
+	var apiErr *apiError
+	switch {
+	case errors.As(err, &apiErr):
+	case errors.Is(err, fileservice.ErrNotFound):
+		apiErr = newAPIError(http.StatusNotFound, "set_not_found", err.Error())
+	case errors.Is(err, fileservice.ErrVersionNotFound):
+		apiErr = newAPIError(http.StatusNotFound, "version_not_found", err.Error())
+	case errors.Is(err, fileservice.ErrFileNotFound):
+		apiErr = newAPIError(http.StatusNotFound, "file_not_found", err.Error())
+	case errors.Is(err, fileservice.ErrFileDeleted):
+		apiErr = newAPIError(http.StatusGone, "file_deleted", err.Error())
+	case errors.Is(err, fileservice.ErrLegalHold):
+		apiErr = newAPIError(http.StatusConflict, "legal_hold", err.Error())
+	case errors.Is(err, fileservice.ErrPreconditionFailed):
+		apiErr = newAPIError(http.StatusPreconditionFailed, "precondition_failed", err.Error())
+	case errors.Is(err, fileservice.ErrRootMismatch):
+		apiErr = newAPIError(http.StatusConflict, "root_mismatch", err.Error())
+	case errors.Is(err, fileservice.ErrInvalidKey):
+		apiErr = newAPIError(http.StatusBadRequest, "invalid_key", err.Error())
+	case errors.Is(err, fileservice.ErrInvalidName):
+		apiErr = newAPIError(http.StatusBadRequest, "invalid_file_name", err.Error())
+	case errors.Is(err, fileservice.ErrQuotaExceeded):
+		apiErr = newAPIError(http.StatusRequestEntityTooLarge, "quota_exceeded", err.Error())
+	case errors.Is(err, fileservice.ErrChallengeTooLarge):
+		apiErr = newAPIError(http.StatusRequestEntityTooLarge, "challenge_too_large", err.Error())
+	case errors.Is(err, fileservice.ErrAPIKeyNotFound):
+		apiErr = newAPIError(http.StatusNotFound, "api_key_not_found", err.Error())
+	default:
+		slog.Error("request failed", "error", err)
+		apiErr = newAPIError(http.StatusInternalServerError, "internal_error", "internal server error")
+	}
+
+	// Headers describing a successful response must not leak into the error.
+	w.Header().Del("Content-Disposition")
+	w.Header().Del("ETag")
+
+	if apiErr.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="file-storage"`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(apiErr.status)
+	json.NewEncoder(w).Encode(ErrorResponse{Code: apiErr.code, Message: apiErr.message})
+}
+
+// writeJSON writes value as the JSON body of a response with status.
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	jsonResponse, err := json.Marshal(value)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(jsonResponse)
+}
@@ -0,0 +1,140 @@
+package fileservice
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	auditlog "github.com/vitaliy/file-storage/server/auditLog"
+	metastore "github.com/vitaliy/file-storage/server/metaStore"
+)
+
+// apiKeyPrefix starts every token so keys are recognisable, e.g. in secret scanners.
+const apiKeyPrefix = "fsk_"
+
+var (
+	ErrInvalidAPIKey  = errors.New("invalid API key")
+	ErrAPIKeyNotFound = errors.New("API key not found")
+)
+
+// APIKey describes a key clients authenticate with as its owner.
+type APIKey struct {
+	ID      string
+	Owner   string
+	Admin   bool
+	Created time.Time
+}
+
+// CreateAPIKey creates a key for owner, which may manage other keys and
+// access every set when admin is set. It returns the token of the key, which
+// is not stored and cannot be retrieved later.
+func (f FileService) CreateAPIKey(owner string, admin bool) (string, APIKey, error) {
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+
+	id := make([]byte, 8)
+	_, err = rand.Read(id)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+
+	token := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	key := &metastore.APIKey{
+		ID:      hex.EncodeToString(id),
+		Hash:    hashToken(token),
+		Owner:   owner,
+		Admin:   admin,
+		Created: time.Now().UTC(),
+	}
+
+	err = f.meta.PutAPIKey(key)
+	if err != nil {
+		return "", APIKey{}, err
+	}
+
+	f.record(auditlog.Entry{Operation: "create_api_key", Detail: fmt.Sprintf("key %v of %v, admin %v", key.ID, owner, admin)})
+
+	return token, apiKey(key), nil
+}
+
+// Authenticate returns the key a token belongs to.
+func (f FileService) Authenticate(token string) (APIKey, error) {
+	if !strings.HasPrefix(token, apiKeyPrefix) {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+
+	key, err := f.meta.GetAPIKey(hashToken(token))
+	if errors.Is(err, metastore.ErrAPIKeyNotFound) {
+		return APIKey{}, ErrInvalidAPIKey
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	return apiKey(key), nil
+}
+
+// ListAPIKeys returns all keys.
+func (f FileService) ListAPIKeys() ([]APIKey, error) {
+	keys, err := f.meta.ListAPIKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]APIKey, 0, len(keys))
+	for _, key := range keys {
+		result = append(result, apiKey(&key))
+	}
+
+	return result, f.recordRead(auditlog.Entry{Operation: "list_api_keys"})
+}
+
+// RevokeAPIKey deletes the key with the given ID. Its token stops working
+// immediately.
+func (f FileService) RevokeAPIKey(id string) error {
+	err := f.meta.DeleteAPIKey(id)
+	if errors.Is(err, metastore.ErrAPIKeyNotFound) {
+		return ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	f.record(auditlog.Entry{Operation: "revoke_api_key", Detail: "key " + id})
+
+	return nil
+}
+
+// GetOwner returns the owner of key, which is empty for sets that were
+// uploaded anonymously.
+func (f FileService) GetOwner(key string) (string, error) {
+	unlock := f.locks.RLock(key)
+	defer unlock()
+
+	set, err := f.getSet(key)
+	if err != nil {
+		return "", err
+	}
+
+	return set.Owner, nil
+}
+
+// hashToken returns the hash a token is stored under. Tokens carry 256 bits
+// of randomness, so a fast hash is enough.
+func hashToken(token string) []byte {
+	sum := sha256.Sum256([]byte(token))
+	return sum[:]
+}
+
+func apiKey(key *metastore.APIKey) APIKey {
+	return APIKey{ID: key.ID, Owner: key.Owner, Admin: key.Admin, Created: key.Created}
+}
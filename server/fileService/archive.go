@@ -0,0 +1,86 @@
+package fileservice
+
+import (
+	"errors"
+	"io"
+
+	merkleTree "github.com/vitaliy/file-storage/common/merkleTree"
+	auditlog "github.com/vitaliy/file-storage/server/auditLog"
+)
+
+// Archive is a whole version of a set opened for reading.
+type Archive struct {
+	Manifest *Manifest
+	// Proofs are indexed like the files of the manifest.
+	Proofs [][][]byte
+	// Contents are indexed like the files of the manifest. Deleted files
+	// have none.
+	Contents []io.ReadSeekCloser
+}
+
+// Close closes the content of every file.
+func (a *Archive) Close() error {
+	var errs []error
+	for _, content := range a.Contents {
+		if content != nil {
+			errs = append(errs, content.Close())
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// OpenArchive opens a version of key with its manifest, the proof of every
+// file and the content of every file that was not deleted. All of them are
+// read under one lock, so they agree even when the set changes while the
+// archive is streamed: blobs stay readable once they are open. The caller
+// must close the archive.
+func (f FileService) OpenArchive(key string, version int) (*Archive, error) {
+	unlock := f.locks.RLock(key)
+	defer unlock()
+
+	set, manifest, err := f.getVersion(key, version)
+	if err != nil {
+		return nil, err
+	}
+
+	tree, err := f.getTree(key, set, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey, err := f.dataKey(set)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]ManifestFile, 0, len(manifest.Files))
+	archive := &Archive{
+		Proofs:   make([][][]byte, 0, len(manifest.Files)),
+		Contents: make([]io.ReadSeekCloser, len(manifest.Files)),
+	}
+	for i, file := range manifest.Files {
+		listed := manifestFile(set, manifest.Number, file)
+		files = append(files, listed)
+		archive.Proofs = append(archive.Proofs, merkleTree.GetProof(tree, i))
+
+		if listed.Deleted {
+			continue
+		}
+
+		archive.Contents[i], err = f.store.OpenBlob(key, dataKey, file.Hash)
+		if err != nil {
+			archive.Close()
+			return nil, err
+		}
+	}
+	archive.Manifest = newManifest(key, set, manifest, files)
+
+	err = f.recordRead(auditlog.Entry{Operation: "read_archive", Key: key, Version: manifest.Number})
+	if err != nil {
+		archive.Close()
+		return nil, err
+	}
+
+	return archive, nil
+}
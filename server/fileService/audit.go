@@ -0,0 +1,55 @@
+package fileservice
+
+import (
+	"log/slog"
+	"time"
+
+	auditlog "github.com/vitaliy/file-storage/server/auditLog"
+)
+
+// As returns the service acting on behalf of actor, who the operations are
+// recorded for in the audit log.
+func (f FileService) As(actor string) FileService {
+	f.actor = actor
+	return f
+}
+
+// record appends a successful operation to the audit log. Lookups that only
+// resolve or authorize requests, like GetOwner and FindFile, are not
+// recorded. The operation has taken effect when it is recorded, so an entry
+// that cannot be appended is logged instead of failing it.
+func (f FileService) record(entry auditlog.Entry) {
+	entry.Actor = f.actor
+
+	err := f.audit.Append(entry)
+	if err != nil {
+		slog.Error("recording operation failed", "operation", entry.Operation, "key", entry.Key, "error", err)
+	}
+}
+
+// recordRead appends an operation that only read, which may reach the disk
+// after it returned, see auditlog.Log.AppendRead.
+func (f FileService) recordRead(entry auditlog.Entry) error {
+	entry.Actor = f.actor
+	return f.audit.AppendRead(entry)
+}
+
+// AuditLog returns the entries of the audit log made from from up to, but
+// excluding, to. Zero times leave the range open.
+func (f FileService) AuditLog(from time.Time, to time.Time) ([]auditlog.Entry, error) {
+	entries, err := f.audit.Read(from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	return entries, f.recordRead(auditlog.Entry{Operation: "export_audit_log"})
+}
+
+// VerifyAuditLog verifies the chain of the audit log, see auditlog.Log.Verify.
+func (f FileService) VerifyAuditLog() (auditlog.Verification, error) {
+	return f.audit.Verify()
+}
+
+func fileIndex(number int) *int {
+	return &number
+}
@@ -0,0 +1,76 @@
+package fileservice
+
+import (
+	"errors"
+	"fmt"
+
+	merkleTree "github.com/vitaliy/file-storage/common/merkleTree"
+	auditlog "github.com/vitaliy/file-storage/server/auditLog"
+)
+
+var ErrChallengeTooLarge = errors.New("the sampled files are too large for one challenge")
+
+// ChallengeSample is a file sampled by a challenge together with its proof.
+// Deleted files have no content.
+type ChallengeSample struct {
+	Index   int
+	Content []byte
+	Proof   [][]byte
+	Deleted bool
+}
+
+// Challenge reads the files with the given numbers in a version of key
+// together with their proofs, so a client holding the root can check that
+// the files are still stored. Every leaf of the tree is a whole file, so the
+// whole content of every sampled file is read; challenges whose live files
+// add up to more than maxBytes are rejected before anything is read.
+func (f FileService) Challenge(key string, version int, numbers []int, maxBytes int64) ([]ChallengeSample, VersionInfo, error) {
+	unlock := f.locks.RLock(key)
+	defer unlock()
+
+	set, manifest, err := f.getVersion(key, version)
+	if err != nil {
+		return nil, VersionInfo{}, err
+	}
+
+	size := int64(0)
+	for _, number := range numbers {
+		if number < 0 || number >= len(manifest.Files) {
+			return nil, VersionInfo{}, ErrFileNotFound
+		}
+
+		file := manifest.Files[number]
+		if !set.IsTombstoned(manifest.Number, number) {
+			size += file.Size
+		}
+	}
+	if size > maxBytes {
+		return nil, VersionInfo{}, fmt.Errorf("%w: %v bytes, at most %v", ErrChallengeTooLarge, size, maxBytes)
+	}
+
+	tree, err := f.getTree(key, set, manifest)
+	if err != nil {
+		return nil, VersionInfo{}, err
+	}
+
+	samples := make([]ChallengeSample, 0, len(numbers))
+	for _, number := range numbers {
+		sample := ChallengeSample{Index: number, Proof: merkleTree.GetProof(tree, number)}
+
+		sample.Content, _, err = f.getFile(key, set, manifest, number)
+		if errors.Is(err, ErrFileDeleted) {
+			sample.Deleted = true
+		} else if err != nil {
+			return nil, VersionInfo{}, err
+		}
+
+		samples = append(samples, sample)
+	}
+
+	err = f.recordRead(auditlog.Entry{Operation: "challenge", Key: key, Version: manifest.Number, Detail: fmt.Sprintf("files %v", numbers)})
+	if err != nil {
+		return nil, VersionInfo{}, err
+	}
+
+	return samples, versionInfo(manifest), nil
+}
@@ -0,0 +1,104 @@
+package fileservice
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	auditlog "github.com/vitaliy/file-storage/server/auditLog"
+	metastore "github.com/vitaliy/file-storage/server/metaStore"
+)
+
+var ErrNoMasterKey = errors.New("no master key configured")
+
+// newSet returns the metadata of a new set. With a master key the set gets
+// its own data key, so its content is encrypted at rest.
+func (f FileService) newSet(key string, now time.Time, owner string, account string) (*metastore.Set, error) {
+	set := &metastore.Set{Key: key, Created: now, Owner: owner, Account: account}
+
+	if f.keyring != nil {
+		_, wrapped, err := f.keyring.NewDataKey(key)
+		if err != nil {
+			return nil, err
+		}
+		set.DataKey = wrapped
+	}
+
+	return set, nil
+}
+
+// dataKey returns the key the content of set is encrypted with, or nil when
+// it is stored in plaintext.
+func (f FileService) dataKey(set *metastore.Set) ([]byte, error) {
+	if set.DataKey == nil {
+		return nil, nil
+	}
+
+	if f.keyring == nil {
+		return nil, ErrNoMasterKey
+	}
+
+	return f.keyring.Unwrap(set.DataKey, set.Key)
+}
+
+// RotateMasterKey wraps the data keys that were wrapped by a previous master
+// key with the current one. The content of the sets is not touched. Once it
+// succeeds, the previous master keys are no longer needed. Sets stored in
+// plaintext stay so. It returns the number of data keys wrapped again.
+func (f FileService) RotateMasterKey() (int, error) {
+	if f.keyring == nil {
+		return 0, ErrNoMasterKey
+	}
+
+	keys, err := f.meta.ListSets()
+	if err != nil {
+		return 0, err
+	}
+
+	rewrapped := 0
+	var errs []error
+	for _, key := range keys {
+		done, err := f.rewrapDataKey(key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("set %q: %w", key, err))
+			continue
+		}
+		if done {
+			rewrapped++
+		}
+	}
+
+	f.record(auditlog.Entry{Operation: "rotate_master_key", Detail: fmt.Sprintf("%v data keys wrapped again", rewrapped)})
+
+	return rewrapped, errors.Join(errs...)
+}
+
+func (f FileService) rewrapDataKey(key string) (bool, error) {
+	unlock := f.locks.Lock(key)
+	defer unlock()
+
+	set, err := f.meta.GetSet(key)
+	// The set may have been collected since it was listed.
+	if errors.Is(err, metastore.ErrSetNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if set.DataKey == nil || f.keyring.IsCurrent(set.DataKey) {
+		return false, nil
+	}
+
+	dataKey, err := f.keyring.Unwrap(set.DataKey, key)
+	if err != nil {
+		return false, err
+	}
+
+	set.DataKey, err = f.keyring.Wrap(dataKey, key)
+	if err != nil {
+		return false, err
+	}
+
+	return true, f.meta.PutSet(set)
+}
@@ -1,47 +1,666 @@
 package fileservice
 
 import (
+	"bytes"
+	"cmp"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"time"
+
 	"github.com/google/uuid"
 	merkleTree "github.com/vitaliy/file-storage/common/merkleTree"
+	auditlog "github.com/vitaliy/file-storage/server/auditLog"
+	"github.com/vitaliy/file-storage/server/encryption"
 	filestore "github.com/vitaliy/file-storage/server/fileStore"
+	metastore "github.com/vitaliy/file-storage/server/metaStore"
+	"github.com/vitaliy/file-storage/server/names"
+)
+
+// AnyRoot can be passed as the expected root to overwrite a set regardless of its current state.
+const AnyRoot = "*"
+
+// LatestVersion addresses the most recent version of a set.
+const LatestVersion = 0
+
+var (
+	ErrNotFound           = errors.New("set not found")
+	ErrVersionNotFound    = errors.New("version not found")
+	ErrFileNotFound       = errors.New("file not found")
+	ErrFileDeleted        = errors.New("file was deleted")
+	ErrPreconditionFailed = errors.New("set root does not match the expected root")
+	ErrRootMismatch       = errors.New("uploaded files do not have the root computed by the client")
+	ErrLegalHold          = errors.New("set is under legal hold")
+	ErrInvalidKey         = names.ErrInvalidKey
+	ErrInvalidName        = names.ErrInvalidName
 )
 
 type FileService struct {
-	store *filestore.FileStore
+	store   *filestore.FileStore
+	meta    *metastore.MetaStore
+	locks   *keyLocks
+	options Options
+	// keyring wraps the data keys of sets, it is nil without a master key.
+	keyring *encryption.Keyring
+	// audit records the operations of the service.
+	audit *auditlog.Log
+	// actor is who operations are recorded for, see As.
+	actor string
+}
+
+// Options configures a FileService.
+type Options struct {
+	// DataDir is the directory the files and their metadata are stored in.
+	DataDir string
+	// DefaultTTL is how long a set is kept after an upload that does not
+	// specify a TTL. Zero keeps such sets forever.
+	DefaultTTL time.Duration
+	// MasterKey enables encryption at rest for new sets. It wraps their data
+	// keys, see package encryption.
+	MasterKey []byte
+	// PreviousMasterKeys still unwrap the data keys wrapped before the
+	// master key was rotated, see RotateMasterKey.
+	PreviousMasterKeys [][]byte
+	// Quota limits what every account may store.
+	Quota Quota
+}
+
+// Manifest lists the files of one version of a set.
+type Manifest struct {
+	Key       string
+	Version   VersionInfo
+	Owner     string
+	Expires   *time.Time
+	LegalHold bool
+	// Encrypted reports whether the content of the set is encrypted at rest.
+	Encrypted bool
+	Files     []ManifestFile
 }
 
-func NewFileService() *FileService {
-	return &FileService{store: filestore.NewFileStore()}
+// ManifestFile describes a file of a manifest. Deleted files keep their leaf hash.
+type ManifestFile struct {
+	Index       int
+	Name        string
+	Size        int64
+	Hash        []byte
+	ContentType string
+	Uploaded    time.Time
+	Deleted     bool
 }
 
-func (f FileService) StoreFiles(key *string, files []filestore.FileInfo) (string, error) {
+// Download is a file of a set opened for reading.
+type Download struct {
+	Content io.ReadSeekCloser
+	File    ManifestFile
+	Version VersionInfo
+	// Proof is only set when it was requested.
+	Proof [][]byte
+}
+
+// StoreOptions controls how StoreFiles stores a new version.
+type StoreOptions struct {
+	// ExpectedRoot is the hex encoded root of the latest version being
+	// replaced, or AnyRoot. It must be empty for a new set.
+	ExpectedRoot string
+	// TTL is how long the set is kept after this upload. Zero uses the
+	// default TTL of the service.
+	TTL time.Duration
+	// Owner is recorded as the owner of a new set. Later versions keep the
+	// owner the set was created with.
+	Owner string
+	// Root is the Merkle root the client computed over the uploaded files.
+	// When it is set, the version is only created if the server computes
+	// the same root.
+	Root []byte
+	// Account is charged with a new set and limited by the quota. Later
+	// versions are charged to the account of the set. Empty sets are not
+	// charged to anyone.
+	Account string
+}
+
+// VersionInfo describes one immutable version of a set.
+type VersionInfo struct {
+	Number  int
+	Root    []byte
+	Created time.Time
+}
+
+func NewFileService(options Options) (*FileService, error) {
+	err := os.MkdirAll(options.DataDir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	var keyring *encryption.Keyring
+	if options.MasterKey != nil {
+		keyring, err = encryption.NewKeyring(options.MasterKey, options.PreviousMasterKeys...)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	meta, err := metastore.Open(path.Join(options.DataDir, metastore.FileName))
+	if err != nil {
+		return nil, err
+	}
+
+	audit, err := auditlog.Open(path.Join(options.DataDir, auditlog.FileName))
+	if err != nil {
+		meta.Close()
+		return nil, err
+	}
+
+	service := &FileService{store: filestore.NewFileStore(options.DataDir), meta: meta, locks: newKeyLocks(), options: options, keyring: keyring, audit: audit}
+
+	err = service.importLegacySets()
+	if err != nil {
+		service.Close()
+		return nil, err
+	}
+
+	return service, nil
+}
+
+func (f FileService) Close() error {
+	return errors.Join(f.meta.Close(), f.audit.Close())
+}
+
+// StoreFiles stores files as a new version of key, or of a new key when key is nil.
+// The key and the names of the files must be valid, see package names, and
+// the names must be unique.
+// Adding a version to an existing set requires the expected root of its
+// latest version, see StoreOptions. The upload must fit into the quota of the
+// account of the set. Every upload renews the retention of the set. It
+// returns the key and the new version.
+func (f FileService) StoreFiles(key *string, files []filestore.FileInfo, options StoreOptions) (string, VersionInfo, error) {
 	if key == nil {
 		newUuid := uuid.New().String()
 		key = &newUuid
 	}
 
-	hashes, err := f.store.StoreFiles(*key, files)
+	err := names.ValidateKey(*key)
+	if err != nil {
+		return "", VersionInfo{}, err
+	}
+
+	// Files are looked up by name, so every name must be unique.
+	seen := make(map[string]bool, len(files))
+	for _, file := range files {
+		err := names.ValidateFileName(file.Name)
+		if err != nil {
+			return "", VersionInfo{}, err
+		}
+
+		if seen[file.Name] {
+			return "", VersionInfo{}, fmt.Errorf("%w %q: more than one file has this name", ErrInvalidName, file.Name)
+		}
+		seen[file.Name] = true
+	}
+
+	unlock := f.locks.Lock(*key)
+	defer unlock()
+
+	err = f.purgeDeletedSet(*key)
+	if err != nil {
+		return "", VersionInfo{}, err
+	}
+
+	set, current, err := f.getVersion(*key, LatestVersion)
+	if err != nil && !errors.Is(err, ErrNotFound) {
+		return "", VersionInfo{}, err
+	}
+
+	var currentRoot []byte
+	number := 1
+	if current != nil {
+		currentRoot = current.Root
+		number = current.Number + 1
+	}
+
+	if !rootMatches(currentRoot, options.ExpectedRoot) {
+		return "", VersionInfo{}, ErrPreconditionFailed
+	}
+
+	account := options.Account
+	if set != nil {
+		account = set.Account
+	}
+
+	err = f.checkFileQuota(account, set, files)
+	if err != nil {
+		return "", VersionInfo{}, err
+	}
+
+	now := time.Now().UTC()
+	if set == nil {
+		set, err = f.newSet(*key, now, options.Owner, options.Account)
+		if err != nil {
+			return "", VersionInfo{}, err
+		}
+
+		// Until the set is indexed, only the mark tells the garbage
+		// collector that its directory belongs to an upload.
+		err = f.store.MarkPending(*key)
+		if err != nil {
+			return "", VersionInfo{}, err
+		}
+	}
+
+	dataKey, err := f.dataKey(set)
+	if err != nil {
+		return "", VersionInfo{}, err
+	}
+
+	stored, err := f.store.StoreBlobs(*key, dataKey, files)
+	if err != nil {
+		return "", VersionInfo{}, err
+	}
+
+	// Blobs first written by an upload that is rejected are not referenced
+	// by any version and are removed right away.
+	committed := false
+	defer func() {
+		if !committed {
+			f.removeNewBlobs(*key, stored)
+		}
+	}()
+
+	err = f.checkByteQuota(account, set, stored)
 	if err != nil {
-		return "", err
+		return "", VersionInfo{}, err
+	}
+
+	hashes := make([][]byte, 0, len(stored))
+	versionFiles := make([]metastore.File, 0, len(stored))
+	for i, blob := range stored {
+		hashes = append(hashes, blob.Hash)
+		versionFiles = append(versionFiles, metastore.File{
+			Index:       i,
+			Name:        blob.Name,
+			Hash:        blob.Hash,
+			Size:        blob.Size,
+			ContentType: blob.ContentType,
+			Uploaded:    now,
+		})
 	}
 
 	tree, err := merkleTree.NewMerkleTree(hashes)
 	if err != nil {
-		return "", err
+		return "", VersionInfo{}, err
+	}
+
+	if options.Root != nil && !bytes.Equal(options.Root, tree.Root.Hash) {
+		return "", VersionInfo{}, fmt.Errorf("%w: the server computed %x", ErrRootMismatch, tree.Root.Hash)
 	}
 
 	treeBytes, err := merkleTree.MarshalTree(tree)
 	if err != nil {
-		return "", err
+		return "", VersionInfo{}, err
+	}
+
+	err = f.store.StoreTree(*key, dataKey, number, treeBytes)
+	if err != nil {
+		return "", VersionInfo{}, err
+	}
+
+	set.Expires = nil
+	if ttl := cmp.Or(options.TTL, f.options.DefaultTTL); ttl > 0 {
+		expires := now.Add(ttl)
+		set.Expires = &expires
+	}
+
+	version := &metastore.Version{
+		Number:  number,
+		Root:    tree.Root.Hash,
+		Created: now,
+		Files:   versionFiles,
+	}
+
+	err = f.meta.PutVersion(set, version)
+	if err != nil {
+		return "", VersionInfo{}, err
+	}
+	committed = true
+
+	// A mark that is left behind is cleared by the garbage collector.
+	err = f.store.ClearPending(*key)
+	if err != nil {
+		slog.Error("clearing pending mark failed", "key", *key, "error", err)
+	}
+
+	f.record(auditlog.Entry{Operation: "upload", Key: *key, Version: number, Detail: fmt.Sprintf("%v files", len(files))})
+
+	return *key, versionInfo(version), nil
+}
+
+// GetVersion returns the given version of key, or its latest version for LatestVersion.
+func (f FileService) GetVersion(key string, number int) (VersionInfo, error) {
+	unlock := f.locks.RLock(key)
+	defer unlock()
+
+	_, version, err := f.getVersion(key, number)
+	if err != nil {
+		return VersionInfo{}, err
+	}
+
+	return versionInfo(version), nil
+}
+
+// ListVersions returns the history of key, oldest version first.
+func (f FileService) ListVersions(key string) ([]VersionInfo, error) {
+	unlock := f.locks.RLock(key)
+	defer unlock()
+
+	_, err := f.getSet(key)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := f.meta.ListVersions(key)
+	if err != nil {
+		return nil, err
 	}
 
-	f.store.StoreFile(*key, filestore.MerkleTreeFileName, treeBytes)
+	history := make([]VersionInfo, 0, len(versions))
+	for _, version := range versions {
+		history = append(history, versionInfo(&version))
+	}
 
-	return *key, nil
+	return history, f.recordRead(auditlog.Entry{Operation: "list_versions", Key: key})
 }
 
-func (f FileService) GetProof(key string, number int) ([][]byte, error) {
-	treeBytes, err := f.store.GetFileByName(key, filestore.MerkleTreeFileName)
+// FindFile resolves the name of a file in a version of key to its leaf
+// index. It also returns the version it was resolved in, which callers should
+// use for follow-up reads so they see the same state.
+func (f FileService) FindFile(key string, version int, name string) (int, VersionInfo, error) {
+	unlock := f.locks.RLock(key)
+	defer unlock()
+
+	_, manifest, err := f.getVersion(key, version)
+	if err != nil {
+		return 0, VersionInfo{}, err
+	}
+
+	index, err := f.meta.FindFile(key, manifest.Number, name)
+	if errors.Is(err, metastore.ErrFileNotFound) {
+		return 0, VersionInfo{}, ErrFileNotFound
+	}
+	if err != nil {
+		return 0, VersionInfo{}, err
+	}
+
+	return index, versionInfo(manifest), nil
+}
+
+// GetManifest returns the manifest of a version of key.
+func (f FileService) GetManifest(key string, version int) (*Manifest, error) {
+	unlock := f.locks.RLock(key)
+	defer unlock()
+
+	set, manifest, err := f.getVersion(key, version)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]ManifestFile, 0, len(manifest.Files))
+	for _, file := range manifest.Files {
+		files = append(files, manifestFile(set, manifest.Number, file))
+	}
+
+	return newManifest(key, set, manifest, files), f.recordRead(auditlog.Entry{Operation: "read_manifest", Key: key, Version: manifest.Number})
+}
+
+// GetProof returns the proof for the file with the given number in a version
+// of key together with the version it was computed against.
+func (f FileService) GetProof(key string, version int, number int) ([][]byte, VersionInfo, error) {
+	unlock := f.locks.RLock(key)
+	defer unlock()
+
+	set, manifest, err := f.getVersion(key, version)
+	if err != nil {
+		return nil, VersionInfo{}, err
+	}
+
+	proof, err := f.getProof(key, set, manifest, number)
+	if err != nil {
+		return nil, VersionInfo{}, err
+	}
+
+	err = f.recordRead(auditlog.Entry{Operation: "read_proof", Key: key, Version: manifest.Number, File: fileIndex(number)})
+	if err != nil {
+		return nil, VersionInfo{}, err
+	}
+
+	return proof, versionInfo(manifest), nil
+}
+
+// GetFile returns the content and name of the file with the given number in
+// a version of key together with the version it was read from.
+func (f FileService) GetFile(key string, version int, number int) ([]byte, string, VersionInfo, error) {
+	unlock := f.locks.RLock(key)
+	defer unlock()
+
+	set, manifest, err := f.getVersion(key, version)
+	if err != nil {
+		return nil, "", VersionInfo{}, err
+	}
+
+	content, name, err := f.getFile(key, set, manifest, number)
+	if err != nil {
+		return nil, "", VersionInfo{}, err
+	}
+
+	err = f.recordRead(auditlog.Entry{Operation: "read_file", Key: key, Version: manifest.Number, File: fileIndex(number)})
+	if err != nil {
+		return nil, "", VersionInfo{}, err
+	}
+
+	return content, name, versionInfo(manifest), nil
+}
+
+// OpenFile opens the file with the given number in a version of key,
+// together with its proof when withProof is set. The caller must close the content.
+func (f FileService) OpenFile(key string, version int, number int, withProof bool) (*Download, error) {
+	unlock := f.locks.RLock(key)
+	defer unlock()
+
+	set, manifest, err := f.getVersion(key, version)
+	if err != nil {
+		return nil, err
+	}
+
+	if number < 0 || number >= len(manifest.Files) {
+		return nil, ErrFileNotFound
+	}
+
+	file := manifest.Files[number]
+
+	if set.IsTombstoned(manifest.Number, number) {
+		return nil, ErrFileDeleted
+	}
+
+	download := &Download{File: manifestFile(set, manifest.Number, file), Version: versionInfo(manifest)}
+
+	if withProof {
+		download.Proof, err = f.getProof(key, set, manifest, number)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dataKey, err := f.dataKey(set)
+	if err != nil {
+		return nil, err
+	}
+
+	download.Content, err = f.store.OpenBlob(key, dataKey, file.Hash)
+	if err != nil {
+		return nil, err
+	}
+
+	err = f.recordRead(auditlog.Entry{Operation: "read_file", Key: key, Version: manifest.Number, File: fileIndex(number)})
+	if err != nil {
+		download.Content.Close()
+		return nil, err
+	}
+
+	return download, nil
+}
+
+// DeleteSet deletes key with all its versions. The set disappears immediately
+// and its data is reclaimed by the garbage collector.
+func (f FileService) DeleteSet(key string) error {
+	unlock := f.locks.Lock(key)
+	defer unlock()
+
+	set, err := f.getSet(key)
+	if err != nil {
+		return err
+	}
+
+	if set.LegalHold {
+		return ErrLegalHold
+	}
+
+	now := time.Now().UTC()
+	set.Deleted = &now
+
+	err = f.meta.PutSet(set)
+	if err != nil {
+		return err
+	}
+
+	f.record(auditlog.Entry{Operation: "delete_set", Key: key})
+
+	return nil
+}
+
+// DeleteFile replaces the file with the given number in a version of key with
+// a tombstone. The leaf stays in the tree so the root and the proofs of other
+// files remain valid, but the file can no longer be read in that version.
+// Files with the same content at other indices or in other versions are not
+// affected; the content is reclaimed by the garbage collector once no live
+// file refers to it.
+func (f FileService) DeleteFile(key string, version int, number int) error {
+	unlock := f.locks.Lock(key)
+	defer unlock()
+
+	set, manifest, err := f.getVersion(key, version)
+	if err != nil {
+		return err
+	}
+
+	if number < 0 || number >= len(manifest.Files) {
+		return ErrFileNotFound
+	}
+
+	if set.LegalHold {
+		return ErrLegalHold
+	}
+
+	if set.IsTombstoned(manifest.Number, number) {
+		return ErrFileDeleted
+	}
+
+	set.Tombstones = append(set.Tombstones, metastore.Tombstone{Version: manifest.Number, Index: number, Deleted: time.Now().UTC()})
+
+	err = f.meta.PutSet(set)
+	if err != nil {
+		return err
+	}
+
+	f.record(auditlog.Entry{Operation: "delete_file", Key: key, Version: manifest.Number, File: fileIndex(number)})
+
+	return nil
+}
+
+// purgeDeletedSet removes the remains of key when it was deleted or expired
+// but not yet collected, so the key can be reused for a new set.
+func (f FileService) purgeDeletedSet(key string) error {
+	set, err := f.meta.GetSet(key)
+	if errors.Is(err, metastore.ErrSetNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if set.Deleted == nil && !set.IsExpired(time.Now()) {
+		return nil
+	}
+
+	err = f.store.RemoveSet(key)
+	if err != nil {
+		return err
+	}
+
+	return f.meta.DeleteSet(key)
+}
+
+// removeNewBlobs removes the blobs of stored that were first written by an
+// upload that was rejected. Blobs that cannot be removed are left to the
+// garbage collector.
+func (f FileService) removeNewBlobs(key string, stored []filestore.StoredBlob) {
+	for _, blob := range stored {
+		if !blob.New {
+			continue
+		}
+
+		_, err := f.store.DeleteBlob(key, blob.Hash)
+		if err != nil {
+			slog.Error("removing blob of rejected upload failed", "key", key, "error", err)
+		}
+	}
+}
+
+func (f FileService) getFile(key string, set *metastore.Set, manifest *metastore.Version, number int) ([]byte, string, error) {
+	if number < 0 || number >= len(manifest.Files) {
+		return nil, "", ErrFileNotFound
+	}
+
+	file := manifest.Files[number]
+
+	if set.IsTombstoned(manifest.Number, number) {
+		return nil, "", ErrFileDeleted
+	}
+
+	dataKey, err := f.dataKey(set)
+	if err != nil {
+		return nil, "", err
+	}
+
+	content, err := f.store.GetBlob(key, dataKey, file.Hash)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return content, file.Name, nil
+}
+
+func (f FileService) getProof(key string, set *metastore.Set, manifest *metastore.Version, number int) ([][]byte, error) {
+	if number < 0 || number >= len(manifest.Files) {
+		return nil, ErrFileNotFound
+	}
+
+	tree, err := f.getTree(key, set, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return merkleTree.GetProof(tree, number), nil
+}
+
+func (f FileService) getTree(key string, set *metastore.Set, manifest *metastore.Version) (*merkleTree.MerkleTree, error) {
+	dataKey, err := f.dataKey(set)
+	if err != nil {
+		return nil, err
+	}
+
+	treeBytes, err := f.store.GetTree(key, dataKey, manifest.Number)
 	if err != nil {
 		return nil, err
 	}
@@ -52,16 +671,79 @@ func (f FileService) GetProof(key string, number int) ([][]byte, error) {
 		return nil, err
 	}
 
-	proof := merkleTree.GetProof(tree, number)
+	return tree, nil
+}
 
-	return proof, nil
+func (f FileService) getSet(key string) (*metastore.Set, error) {
+	set, err := f.meta.GetSet(key)
+	if errors.Is(err, metastore.ErrSetNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if set.Deleted != nil || set.IsExpired(time.Now()) {
+		return nil, ErrNotFound
+	}
+
+	return set, nil
 }
 
-func (f FileService) GetFile(key string, number int) ([]byte, string, error) {
-	file, name, err := f.store.GetFileByNumber(key, number)
+func (f FileService) getVersion(key string, number int) (*metastore.Set, *metastore.Version, error) {
+	set, err := f.getSet(key)
 	if err != nil {
-		return nil, "", err
+		return nil, nil, err
+	}
+
+	var version *metastore.Version
+	if number == LatestVersion {
+		version, err = f.meta.GetLatestVersion(key)
+	} else {
+		version, err = f.meta.GetVersion(key, number)
+	}
+	if errors.Is(err, metastore.ErrVersionNotFound) {
+		return nil, nil, ErrVersionNotFound
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return set, version, nil
+}
+
+func newManifest(key string, set *metastore.Set, manifest *metastore.Version, files []ManifestFile) *Manifest {
+	return &Manifest{
+		Key:       key,
+		Version:   versionInfo(manifest),
+		Owner:     set.Owner,
+		Expires:   set.Expires,
+		LegalHold: set.LegalHold,
+		Encrypted: set.DataKey != nil,
+		Files:     files,
+	}
+}
+
+func manifestFile(set *metastore.Set, version int, file metastore.File) ManifestFile {
+	return ManifestFile{
+		Index:       file.Index,
+		Name:        file.Name,
+		Size:        file.Size,
+		Hash:        file.Hash,
+		ContentType: file.ContentType,
+		Uploaded:    file.Uploaded,
+		Deleted:     set.IsTombstoned(version, file.Index),
+	}
+}
+
+func versionInfo(version *metastore.Version) VersionInfo {
+	return VersionInfo{Number: version.Number, Root: version.Root, Created: version.Created}
+}
+
+func rootMatches(currentRoot []byte, expectedRoot string) bool {
+	if currentRoot == nil {
+		return expectedRoot == "" || expectedRoot == AnyRoot
 	}
 
-	return file, name, nil
+	return expectedRoot == AnyRoot || expectedRoot == hex.EncodeToString(currentRoot)
 }
@@ -1,17 +1,25 @@
 package fileservice
 
 import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"os"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/vitaliy/file-storage/common/merkleTree"
 	filestore "github.com/vitaliy/file-storage/server/fileStore"
+	"github.com/vitaliy/file-storage/server/names"
 )
 
 func TestStoreFiles(t *testing.T) {
-
-	os.RemoveAll("files")
 	file1 := NewFileInfo("test1")
 	file2 := NewFileInfo("test2")
 	file3 := NewFileInfo("test3")
@@ -20,13 +28,13 @@ func TestStoreFiles(t *testing.T) {
 	file6 := NewFileInfo("test6")
 	file7 := NewFileInfo("test7")
 
-	service := NewFileService()
-	key, err := service.StoreFiles(nil, []filestore.FileInfo{*file1, *file2, *file3, *file4, *file5, *file6, *file7})
+	service := newTestService(t)
+	key, version, err := service.StoreFiles(nil, []filestore.FileInfo{*file1, *file2, *file3, *file4, *file5, *file6, *file7}, StoreOptions{})
 	if err != nil {
 		t.Fatalf("Error storing files: %v", err)
 	}
 
-	merkleTreeBytes, err := filestore.NewFileStore().GetFileByName(key, filestore.MerkleTreeFileName)
+	merkleTreeBytes, err := service.store.GetTree(key, nil, version.Number)
 	if err != nil {
 		t.Fatalf("Error getting merkle tree: %v", err)
 	}
@@ -46,17 +54,941 @@ func TestStoreFiles(t *testing.T) {
 	verifyFile(service, key, t, tree.Root.Hash, 6, "test7")
 }
 
+func TestStoreFilesRootMismatch(t *testing.T) {
+	hashes := make([][]byte, 0, 2)
+	for _, name := range []string{"test1", "test2"} {
+		hash, _ := merkleTree.GetHashFromBytes([]byte(name))
+		hashes = append(hashes, hash)
+	}
+
+	expectedRoot, err := merkleTree.GetMerkleRoot(hashes)
+	if err != nil {
+		t.Fatalf("Error computing root: %v", err)
+	}
+
+	service := newTestService(t)
+	key, version, err := service.StoreFiles(nil, []filestore.FileInfo{*NewFileInfo("test1"), *NewFileInfo("test2")}, StoreOptions{Root: expectedRoot})
+	if err != nil {
+		t.Fatalf("Error storing files with the expected root: %v", err)
+	}
+
+	if !bytes.Equal(expectedRoot, version.Root) {
+		t.Fatalf("Root mismatch")
+	}
+
+	_, _, err = service.StoreFiles(&key, []filestore.FileInfo{*NewFileInfo("test3")}, StoreOptions{ExpectedRoot: AnyRoot, Root: expectedRoot})
+	if !errors.Is(err, ErrRootMismatch) {
+		t.Fatalf("Expected root mismatch, got %v", err)
+	}
+
+	latest, err := service.GetVersion(key, LatestVersion)
+	if err != nil || latest.Number != version.Number {
+		t.Fatalf("Expected no new version after a root mismatch, got %+v (%v)", latest, err)
+	}
+}
+
+func TestFindFile(t *testing.T) {
+	service := newTestService(t)
+	key, version, err := service.StoreFiles(nil, []filestore.FileInfo{*NewFileInfo("test1"), *NewFileInfo("test2"), *NewFileInfo("test3")}, StoreOptions{})
+	if err != nil {
+		t.Fatalf("Error storing files: %v", err)
+	}
+
+	index, resolved, err := service.FindFile(key, LatestVersion, "test2")
+	if err != nil {
+		t.Fatalf("Error finding file: %v", err)
+	}
+
+	if index != 1 || resolved.Number != version.Number {
+		t.Fatalf("Resolved test2 to index %d of version %d", index, resolved.Number)
+	}
+
+	_, _, err = service.FindFile(key, LatestVersion, "missing")
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Fatalf("Expected missing file, got %v", err)
+	}
+}
+
+func TestStoreFilesVersions(t *testing.T) {
+	key := "overwrite"
+
+	service := newTestService(t)
+	_, first, err := service.StoreFiles(&key, []filestore.FileInfo{*NewFileInfo("test1")}, StoreOptions{})
+	if err != nil {
+		t.Fatalf("Error storing files: %v", err)
+	}
+
+	_, _, err = service.StoreFiles(&key, []filestore.FileInfo{*NewFileInfo("test2")}, StoreOptions{})
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("Expected precondition failure without expected root, got %v", err)
+	}
+
+	_, _, err = service.StoreFiles(&key, []filestore.FileInfo{*NewFileInfo("test2")}, StoreOptions{ExpectedRoot: hex.EncodeToString([]byte("stale"))})
+	if !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("Expected precondition failure for stale root, got %v", err)
+	}
+
+	_, second, err := service.StoreFiles(&key, []filestore.FileInfo{*NewFileInfo("test2")}, StoreOptions{ExpectedRoot: hex.EncodeToString(first.Root)})
+	if err != nil {
+		t.Fatalf("Error overwriting files: %v", err)
+	}
+
+	latest, err := service.GetVersion(key, LatestVersion)
+	if err != nil {
+		t.Fatalf("Error getting version: %v", err)
+	}
+
+	if latest.Number != 2 || !bytes.Equal(latest.Root, second.Root) {
+		t.Fatalf("Latest version was not replaced")
+	}
+
+	history, err := service.ListVersions(key)
+	if err != nil {
+		t.Fatalf("Error listing versions: %v", err)
+	}
+
+	if len(history) != 2 || !bytes.Equal(history[0].Root, first.Root) {
+		t.Fatalf("Unexpected history %v", history)
+	}
+
+	file, _, version, err := service.GetFile(key, first.Number, 0)
+	if err != nil {
+		t.Fatalf("Error getting file from first version: %v", err)
+	}
+
+	if string(file) != "test1" || version.Number != first.Number {
+		t.Fatalf("First version was modified")
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	key := "concurrent"
+	service := newTestService(t)
+
+	var mu sync.Mutex
+	stored := make(map[int][][]byte)
+
+	var wg sync.WaitGroup
+	for writer := 0; writer < 4; writer++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				name := fmt.Sprintf("writer%d-%d", writer, i)
+				_, version, err := service.StoreFiles(&key, []filestore.FileInfo{*NewFileInfo(name)}, StoreOptions{ExpectedRoot: AnyRoot})
+				if err != nil {
+					t.Errorf("Error storing files: %v", err)
+					return
+				}
+
+				mu.Lock()
+				stored[version.Number] = append(stored[version.Number], version.Root)
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for reader := 0; reader < 4; reader++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				file, name, version, err := service.GetFile(key, LatestVersion, 0)
+				if errors.Is(err, ErrNotFound) {
+					continue
+				}
+				if err != nil {
+					t.Errorf("Error getting file: %v", err)
+					return
+				}
+
+				hash, _ := merkleTree.GetHashFromBytes(file)
+				root, _ := merkleTree.GetMerkleRoot([][]byte{hash})
+				if string(file) != name || !bytes.Equal(root, version.Root) {
+					t.Errorf("Read %q as %q from version %d with a different root", file, name, version.Number)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 5; i++ {
+			err := service.DeleteSet(key)
+			if err != nil && !errors.Is(err, ErrNotFound) {
+				t.Errorf("Error deleting set: %v", err)
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	if t.Failed() {
+		return
+	}
+
+	history, err := service.ListVersions(key)
+	if errors.Is(err, ErrNotFound) {
+		return
+	}
+	if err != nil {
+		t.Fatalf("Error listing versions: %v", err)
+	}
+
+	for i, version := range history {
+		if version.Number != i+1 {
+			t.Fatalf("Expected version %d, got %d", i+1, version.Number)
+		}
+
+		if !slices.ContainsFunc(stored[version.Number], func(root []byte) bool { return bytes.Equal(root, version.Root) }) {
+			t.Fatalf("Version %d has a root no upload returned", version.Number)
+		}
+	}
+}
+
+func TestAuditFailureAfterCommit(t *testing.T) {
+	service := newTestService(t)
+	service.audit.Close()
+
+	// Mutations have taken effect when they are recorded, so they must
+	// succeed even though the audit log cannot be appended to.
+	key, version, err := service.StoreFiles(nil, []filestore.FileInfo{*NewFileInfo("test1"), *NewFileInfo("test2")}, StoreOptions{})
+	if err != nil {
+		t.Fatalf("Error storing files: %v", err)
+	}
+
+	_, _, err = service.StoreFiles(&key, []filestore.FileInfo{*NewFileInfo("test3")}, StoreOptions{ExpectedRoot: hex.EncodeToString(version.Root)})
+	if err != nil {
+		t.Fatalf("Error storing files after the first upload: %v", err)
+	}
+
+	err = service.DeleteFile(key, LatestVersion, 0)
+	if err != nil {
+		t.Fatalf("Error deleting file: %v", err)
+	}
+
+	err = service.DeleteSet(key)
+	if err != nil {
+		t.Fatalf("Error deleting set: %v", err)
+	}
+}
+
+func TestDeleteFile(t *testing.T) {
+	service := newTestService(t)
+	key, version, err := service.StoreFiles(nil, []filestore.FileInfo{*NewFileInfo("test1"), *NewFileInfo("test2"), *NewFileInfo("test3")}, StoreOptions{})
+	if err != nil {
+		t.Fatalf("Error storing files: %v", err)
+	}
+
+	err = service.DeleteFile(key, LatestVersion, 1)
+	if err != nil {
+		t.Fatalf("Error deleting file: %v", err)
+	}
+
+	_, _, _, err = service.GetFile(key, LatestVersion, 1)
+	if !errors.Is(err, ErrFileDeleted) {
+		t.Fatalf("Expected deleted file, got %v", err)
+	}
+
+	stats, err := service.CollectGarbage()
+	if err != nil {
+		t.Fatalf("Error collecting garbage: %v", err)
+	}
+
+	if stats.Blobs != 1 {
+		t.Fatalf("Expected one blob to be collected, got %d", stats.Blobs)
+	}
+
+	verifyFile(service, key, t, version.Root, 0, "test1")
+	verifyFile(service, key, t, version.Root, 2, "test3")
+}
+
+func TestDeleteFileSameContent(t *testing.T) {
+	service := newTestService(t)
+	same := func() []filestore.FileInfo {
+		return []filestore.FileInfo{{Name: "a", R: strings.NewReader("same")}, {Name: "b", R: strings.NewReader("same")}}
+	}
+
+	key, first, err := service.StoreFiles(nil, same(), StoreOptions{})
+	if err != nil {
+		t.Fatalf("Error storing files: %v", err)
+	}
+	_, second, err := service.StoreFiles(&key, same(), StoreOptions{ExpectedRoot: AnyRoot})
+	if err != nil {
+		t.Fatalf("Error storing files: %v", err)
+	}
+
+	err = service.DeleteFile(key, first.Number, 0)
+	if err != nil {
+		t.Fatalf("Error deleting file: %v", err)
+	}
+
+	_, _, _, err = service.GetFile(key, first.Number, 0)
+	if !errors.Is(err, ErrFileDeleted) {
+		t.Fatalf("Expected deleted file, got %v", err)
+	}
+
+	// Only the file at the deleted index and version is gone.
+	for _, file := range []struct{ version, index int }{{first.Number, 1}, {second.Number, 0}, {second.Number, 1}} {
+		content, _, _, err := service.GetFile(key, file.version, file.index)
+		if err != nil || string(content) != "same" {
+			t.Fatalf("Expected file %v of version %v to be readable, got %q (%v)", file.index, file.version, content, err)
+		}
+	}
+
+	manifest, err := service.GetManifest(key, second.Number)
+	if err != nil || manifest.Files[0].Deleted {
+		t.Fatalf("Expected file 0 of the second version to be listed, got %+v (%v)", manifest, err)
+	}
+
+	stats, err := service.CollectGarbage()
+	if err != nil || stats.Blobs != 0 {
+		t.Fatalf("Expected the shared blob to be kept, got %+v (%v)", stats, err)
+	}
+
+	for _, file := range []struct{ version, index int }{{first.Number, 1}, {second.Number, 0}, {second.Number, 1}} {
+		err := service.DeleteFile(key, file.version, file.index)
+		if err != nil {
+			t.Fatalf("Error deleting file: %v", err)
+		}
+	}
+
+	stats, err = service.CollectGarbage()
+	if err != nil || stats.Blobs != 1 {
+		t.Fatalf("Expected the blob to be collected once no file refers to it, got %+v (%v)", stats, err)
+	}
+}
+
+func TestOpenArchive(t *testing.T) {
+	service := newTestService(t)
+	key, version, err := service.StoreFiles(nil, []filestore.FileInfo{*NewFileInfo("test1"), *NewFileInfo("test2"), *NewFileInfo("test3")}, StoreOptions{})
+	if err != nil {
+		t.Fatalf("Error storing files: %v", err)
+	}
+
+	err = service.DeleteFile(key, LatestVersion, 1)
+	if err != nil {
+		t.Fatalf("Error deleting file: %v", err)
+	}
+
+	archive, err := service.OpenArchive(key, LatestVersion)
+	if err != nil {
+		t.Fatalf("Error opening archive: %v", err)
+	}
+	defer archive.Close()
+	manifest, proofs := archive.Manifest, archive.Proofs
+
+	// The content stays readable after the set changes.
+	err = service.DeleteFile(key, LatestVersion, 2)
+	if err != nil {
+		t.Fatalf("Error deleting file: %v", err)
+	}
+	_, err = service.CollectGarbage()
+	if err != nil {
+		t.Fatalf("Error collecting garbage: %v", err)
+	}
+
+	if archive.Contents[1] != nil {
+		t.Fatalf("Expected no content for the deleted file")
+	}
+	content, err := io.ReadAll(archive.Contents[2])
+	if err != nil || string(content) != "test3" {
+		t.Fatalf("Expected the content of file 2, got %q (%v)", content, err)
+	}
+
+	if len(manifest.Files) != 3 || len(proofs) != 3 {
+		t.Fatalf("Expected 3 files and proofs, got %d and %d", len(manifest.Files), len(proofs))
+	}
+
+	if !manifest.Files[1].Deleted {
+		t.Fatalf("Expected file 1 to be listed as deleted")
+	}
+
+	for i, file := range manifest.Files {
+		ok, err := merkleTree.VerifyProof(version.Root, i, file.Hash, proofs[i])
+		if err != nil {
+			t.Fatalf("Error verifying proof: %v", err)
+		}
+		if !ok {
+			t.Fatalf("Proof of file %d does not verify", i)
+		}
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	service := newTestService(t)
+	key, _, err := service.StoreFiles(nil, []filestore.FileInfo{*NewFileInfo("test1"), *NewFileInfo("test2"), *NewFileInfo("test3")}, StoreOptions{})
+	if err != nil {
+		t.Fatalf("Error storing files: %v", err)
+	}
+
+	err = service.DeleteFile(key, LatestVersion, 2)
+	if err != nil {
+		t.Fatalf("Error deleting file: %v", err)
+	}
+
+	// Deleted files are not read, so they do not count towards the limit.
+	samples, _, err := service.Challenge(key, LatestVersion, []int{0, 2}, 5)
+	if err != nil || len(samples) != 2 {
+		t.Fatalf("Expected 2 samples, got %v (%v)", len(samples), err)
+	}
+
+	if string(samples[0].Content) != "test1" {
+		t.Fatalf("Expected test1, got %+v", samples[0])
+	}
+	if !samples[1].Deleted || samples[1].Content != nil {
+		t.Fatalf("Expected the deleted file to have no content, got %+v", samples[1])
+	}
+
+	_, _, err = service.Challenge(key, LatestVersion, []int{0, 1}, 9)
+	if !errors.Is(err, ErrChallengeTooLarge) {
+		t.Fatalf("Expected the challenge to be too large, got %v", err)
+	}
+
+	_, _, err = service.Challenge(key, LatestVersion, []int{0, 3}, 1<<20)
+	if !errors.Is(err, ErrFileNotFound) {
+		t.Fatalf("Expected a missing file, got %v", err)
+	}
+}
+
+func TestDeleteSet(t *testing.T) {
+	service := newTestService(t)
+	key, _, err := service.StoreFiles(nil, []filestore.FileInfo{*NewFileInfo("test1")}, StoreOptions{})
+	if err != nil {
+		t.Fatalf("Error storing files: %v", err)
+	}
+
+	err = service.DeleteSet(key)
+	if err != nil {
+		t.Fatalf("Error deleting set: %v", err)
+	}
+
+	_, err = service.GetVersion(key, LatestVersion)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected deleted set to be gone, got %v", err)
+	}
+
+	stats, err := service.CollectGarbage()
+	if err != nil {
+		t.Fatalf("Error collecting garbage: %v", err)
+	}
+
+	if stats.Sets != 1 {
+		t.Fatalf("Expected one set to be collected, got %d", stats.Sets)
+	}
+}
+
+func TestStoreFilesNames(t *testing.T) {
+	dir := t.TempDir()
+	service, err := NewFileService(Options{DataDir: dir})
+	if err != nil {
+		t.Fatalf("Error creating service: %v", err)
+	}
+	t.Cleanup(func() { service.Close() })
+
+	key := "../Отчёт"
+	_, _, err = service.StoreFiles(&key, []filestore.FileInfo{*NewFileInfo("test1")}, StoreOptions{})
+	if !errors.Is(err, ErrInvalidKey) {
+		t.Fatalf("Expected invalid key, got %v", err)
+	}
+
+	_, _, err = service.StoreFiles(nil, []filestore.FileInfo{*NewFileInfo(filestore.MerkleTreeFileName)}, StoreOptions{})
+	if !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("Expected reserved name to be rejected, got %v", err)
+	}
+
+	_, _, err = service.StoreFiles(nil, []filestore.FileInfo{*NewFileInfo("test1"), *NewFileInfo("test2"), *NewFileInfo("test1")}, StoreOptions{})
+	if !errors.Is(err, ErrInvalidName) {
+		t.Fatalf("Expected duplicate names to be rejected, got %v", err)
+	}
+
+	// Unicode keys and names are kept as they are and stored under an
+	// encoded directory inside the data directory.
+	key = "Отчёт 2024"
+	_, _, err = service.StoreFiles(&key, []filestore.FileInfo{*NewFileInfo("résumé.pdf")}, StoreOptions{})
+	if err != nil {
+		t.Fatalf("Error storing files: %v", err)
+	}
+
+	manifest, err := service.GetManifest(key, LatestVersion)
+	if err != nil || manifest.Files[0].Name != "résumé.pdf" {
+		t.Fatalf("Expected the original name, got %+v (%v)", manifest, err)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, names.Encode(key)))
+	if err != nil {
+		t.Fatalf("Expected the set under its encoded key: %v", err)
+	}
+
+	stats, err := service.CollectGarbage()
+	if err != nil || stats.Sets != 0 {
+		t.Fatalf("Expected the set to be kept, got %+v (%v)", stats, err)
+	}
+	verifyFile(service, key, t, manifest.Version.Root, 0, "résumé.pdf")
+}
+
+func TestImportLegacySets(t *testing.T) {
+	key := "528137f4-ada0-4a5c-a05d-b1cd5a055bc2"
+	dir := t.TempDir()
+
+	err := os.Mkdir(filepath.Join(dir, key), os.ModePerm)
+	if err != nil {
+		t.Fatalf("Error creating legacy set: %v", err)
+	}
+
+	entries, err := os.ReadDir(filepath.Join("files", key))
+	if err != nil {
+		t.Fatalf("Error reading legacy set: %v", err)
+	}
+
+	for _, entry := range entries {
+		content, err := os.ReadFile(filepath.Join("files", key, entry.Name()))
+		if err != nil {
+			t.Fatalf("Error reading legacy file: %v", err)
+		}
+
+		err = os.WriteFile(filepath.Join(dir, key, entry.Name()), content, os.ModePerm)
+		if err != nil {
+			t.Fatalf("Error copying legacy file: %v", err)
+		}
+	}
+
+	legacyTree, err := os.ReadFile(filepath.Join(dir, key, filestore.MerkleTreeFileName))
+	if err != nil {
+		t.Fatalf("Error reading legacy tree: %v", err)
+	}
+
+	var tree merkleTree.MerkleTree
+	err = merkleTree.UnmarshalTree(legacyTree, &tree)
+	if err != nil {
+		t.Fatalf("Error unmarshalling tree: %v", err)
+	}
+
+	service, err := NewFileService(Options{DataDir: dir})
+	if err != nil {
+		t.Fatalf("Error creating service: %v", err)
+	}
+	t.Cleanup(func() { service.Close() })
+
+	version, err := service.GetVersion(key, LatestVersion)
+	if err != nil {
+		t.Fatalf("Error getting imported version: %v", err)
+	}
+
+	if version.Number != 1 || !bytes.Equal(version.Root, tree.Root.Hash) {
+		t.Fatalf("Imported version %d has a different root", version.Number)
+	}
+
+	for i, name := range []string{"test1", "test2", "test3", "test4", "test5", "test6", "test7"} {
+		verifyFile(service, key, t, tree.Root.Hash, i, name)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, key, filestore.MerkleTreeFileName))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected the legacy tree to be removed, got %v", err)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, key, "test1"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected the legacy files to be removed, got %v", err)
+	}
+}
+
+func TestImportLegacySetsEncodedKey(t *testing.T) {
+	key := "Legacy"
+	dir := t.TempDir()
+
+	hash, _ := merkleTree.GetHashFromBytes([]byte("test1"))
+	tree, err := merkleTree.NewMerkleTree([][]byte{hash})
+	if err != nil {
+		t.Fatalf("Error building tree: %v", err)
+	}
+
+	treeBytes, err := merkleTree.MarshalTree(tree)
+	if err != nil {
+		t.Fatalf("Error marshalling tree: %v", err)
+	}
+
+	// Legacy sets are stored under their plain key.
+	err = os.Mkdir(filepath.Join(dir, key), os.ModePerm)
+	if err != nil {
+		t.Fatalf("Error creating legacy set: %v", err)
+	}
+	err = os.WriteFile(filepath.Join(dir, key, filestore.MerkleTreeFileName), treeBytes, os.ModePerm)
+	if err != nil {
+		t.Fatalf("Error writing legacy tree: %v", err)
+	}
+	err = os.WriteFile(filepath.Join(dir, key, "test1"), []byte("test1"), os.ModePerm)
+	if err != nil {
+		t.Fatalf("Error writing legacy file: %v", err)
+	}
+
+	service, err := NewFileService(Options{DataDir: dir})
+	if err != nil {
+		t.Fatalf("Error creating service: %v", err)
+	}
+	t.Cleanup(func() { service.Close() })
+
+	verifyFile(service, key, t, tree.Root.Hash, 0, "test1")
+
+	_, err = os.Stat(filepath.Join(dir, key))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected the plain directory to be removed, got %v", err)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, names.Encode(key)))
+	if err != nil {
+		t.Fatalf("Expected the set under its encoded key, got %v", err)
+	}
+}
+
+func TestAPIKeys(t *testing.T) {
+	service := newTestService(t)
+
+	token, key, err := service.CreateAPIKey("alice", false)
+	if err != nil {
+		t.Fatalf("Error creating API key: %v", err)
+	}
+
+	authenticated, err := service.Authenticate(token)
+	if err != nil || authenticated.ID != key.ID || authenticated.Owner != "alice" {
+		t.Fatalf("Expected key %v of alice, got %+v (%v)", key.ID, authenticated, err)
+	}
+
+	_, err = service.Authenticate(token + "x")
+	if !errors.Is(err, ErrInvalidAPIKey) {
+		t.Fatalf("Expected invalid API key, got %v", err)
+	}
+
+	setKey, _, err := service.StoreFiles(nil, []filestore.FileInfo{*NewFileInfo("test1")}, StoreOptions{Owner: "alice"})
+	if err != nil {
+		t.Fatalf("Error storing files: %v", err)
+	}
+
+	_, _, err = service.StoreFiles(&setKey, []filestore.FileInfo{*NewFileInfo("test2")}, StoreOptions{ExpectedRoot: AnyRoot, Owner: "bob"})
+	if err != nil {
+		t.Fatalf("Error storing files: %v", err)
+	}
+
+	owner, err := service.GetOwner(setKey)
+	if err != nil || owner != "alice" {
+		t.Fatalf("Expected the set to stay owned by alice, got %q (%v)", owner, err)
+	}
+
+	err = service.RevokeAPIKey(key.ID)
+	if err != nil {
+		t.Fatalf("Error revoking API key: %v", err)
+	}
+
+	_, err = service.Authenticate(token)
+	if !errors.Is(err, ErrInvalidAPIKey) {
+		t.Fatalf("Expected revoked key to be invalid, got %v", err)
+	}
+
+	err = service.RevokeAPIKey(key.ID)
+	if !errors.Is(err, ErrAPIKeyNotFound) {
+		t.Fatalf("Expected missing API key, got %v", err)
+	}
+}
+
+func TestEncryption(t *testing.T) {
+	dir := t.TempDir()
+	oldMasterKey := bytes.Repeat([]byte{1}, 32)
+	service, err := NewFileService(Options{DataDir: dir, MasterKey: oldMasterKey})
+	if err != nil {
+		t.Fatalf("Error creating service: %v", err)
+	}
+
+	content := "content that must not be readable on disk"
+	files := []filestore.FileInfo{{Name: "secret", R: strings.NewReader(content)}, *NewFileInfo("test2")}
+	key, version, err := service.StoreFiles(nil, files, StoreOptions{})
+	if err != nil {
+		t.Fatalf("Error storing files: %v", err)
+	}
+
+	// Hashes are computed over the plaintext, so the root is unchanged.
+	hash, _ := merkleTree.GetHashFromBytes([]byte(content))
+	hash2, _ := merkleTree.GetHashFromBytes([]byte("test2"))
+	expectedRoot, _ := merkleTree.GetMerkleRoot([][]byte{hash, hash2})
+	if !bytes.Equal(version.Root, expectedRoot) {
+		t.Fatalf("Expected the root over the plaintext")
+	}
+
+	blob, err := os.ReadFile(filepath.Join(dir, names.Encode(key), "blobs", hex.EncodeToString(hash)))
+	if err != nil || bytes.Contains(blob, []byte(content)) {
+		t.Fatalf("Expected the blob to be encrypted (%v)", err)
+	}
+
+	manifest, _ := service.GetManifest(key, LatestVersion)
+	if !manifest.Encrypted || manifest.Files[0].Size != int64(len(content)) {
+		t.Fatalf("Expected an encrypted set with plaintext sizes, got %+v", manifest)
+	}
+	verifyFile(service, key, t, version.Root, 0, "secret")
+	service.Close()
+
+	newMasterKey := bytes.Repeat([]byte{2}, 32)
+	service, err = NewFileService(Options{DataDir: dir, MasterKey: newMasterKey, PreviousMasterKeys: [][]byte{oldMasterKey}})
+	if err != nil {
+		t.Fatalf("Error creating service: %v", err)
+	}
+	verifyFile(service, key, t, version.Root, 1, "test2")
+
+	rewrapped, err := service.RotateMasterKey()
+	if err != nil || rewrapped != 1 {
+		t.Fatalf("Expected one data key to be wrapped again, got %v (%v)", rewrapped, err)
+	}
+	service.Close()
+
+	service, err = NewFileService(Options{DataDir: dir, MasterKey: newMasterKey})
+	if err != nil {
+		t.Fatalf("Error creating service: %v", err)
+	}
+	verifyFile(service, key, t, version.Root, 0, "secret")
+	service.Close()
+
+	service, err = NewFileService(Options{DataDir: dir})
+	if err != nil {
+		t.Fatalf("Error creating service: %v", err)
+	}
+	t.Cleanup(func() { service.Close() })
+
+	_, _, _, err = service.GetFile(key, LatestVersion, 0)
+	if !errors.Is(err, ErrNoMasterKey) {
+		t.Fatalf("Expected the set not to be readable without master key, got %v", err)
+	}
+}
+
+func TestQuotas(t *testing.T) {
+	service, err := NewFileService(Options{DataDir: t.TempDir(), Quota: Quota{MaxBytes: 10, MaxSets: 1, MaxFilesPerSet: 2}})
+	if err != nil {
+		t.Fatalf("Error creating service: %v", err)
+	}
+	t.Cleanup(func() { service.Close() })
+
+	files := func(names ...string) []filestore.FileInfo {
+		infos := make([]filestore.FileInfo, 0, len(names))
+		for _, name := range names {
+			infos = append(infos, *NewFileInfo(name))
+		}
+		return infos
+	}
+	alice := StoreOptions{Owner: "alice", Account: "alice"}
+	replace := StoreOptions{ExpectedRoot: AnyRoot, Account: "bob"}
+
+	key, _, err := service.StoreFiles(nil, files("test1"), alice)
+	if err != nil {
+		t.Fatalf("Error storing files: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		key     *string
+		files   []filestore.FileInfo
+		options StoreOptions
+	}{
+		{"sets", nil, files("test2"), alice},
+		{"files per set", &key, files("test1", "test2", "test3"), replace},
+		{"bytes", &key, files("test2", "test3"), replace},
+		{"declared bytes", &key, []filestore.FileInfo{{Name: "large", R: strings.NewReader("large"), Size: 11}}, replace},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, _, err := service.StoreFiles(test.key, test.files, test.options)
+			if !errors.Is(err, ErrQuotaExceeded) {
+				t.Fatalf("Expected the quota to be exceeded, got %v", err)
+			}
+		})
+	}
+
+	// Rejected uploads leave no blobs behind.
+	blobs, err := service.store.ListBlobs(key)
+	if err != nil || len(blobs) != 1 {
+		t.Fatalf("Expected only the blob of the first upload, got %v (%v)", len(blobs), err)
+	}
+
+	// Content the set already holds is not counted again, and versions are
+	// charged to the account of the set.
+	_, _, err = service.StoreFiles(&key, files("test1", "test2"), replace)
+	if err != nil {
+		t.Fatalf("Expected the upload to fit into the quota, got %v", err)
+	}
+
+	usage, err := service.GetUsage("alice")
+	if err != nil || usage != (Usage{Bytes: 10, Sets: 1}) {
+		t.Fatalf("Expected 10 bytes in one set, got %+v (%v)", usage, err)
+	}
+
+	_, _, err = service.StoreFiles(nil, files("test1", "test2", "test3"), StoreOptions{})
+	if err != nil {
+		t.Fatalf("Expected uncharged uploads to be unlimited, got %v", err)
+	}
+
+	err = service.DeleteSet(key)
+	if err != nil {
+		t.Fatalf("Error deleting set: %v", err)
+	}
+
+	usage, _ = service.GetUsage("alice")
+	if usage != (Usage{}) {
+		t.Fatalf("Expected deleted sets not to count, got %+v", usage)
+	}
+}
+
+func TestRetention(t *testing.T) {
+	service := newTestService(t)
+	expiring, _, err := service.StoreFiles(nil, []filestore.FileInfo{*NewFileInfo("test1")}, StoreOptions{TTL: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Error storing files: %v", err)
+	}
+
+	held, _, err := service.StoreFiles(nil, []filestore.FileInfo{*NewFileInfo("test2")}, StoreOptions{TTL: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Error storing files: %v", err)
+	}
+
+	err = service.SetLegalHold(held, true)
+	if err != nil {
+		t.Fatalf("Error placing legal hold: %v", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	expired, err := service.ExpireSets()
+	if err != nil {
+		t.Fatalf("Error expiring sets: %v", err)
+	}
+
+	if expired != 1 {
+		t.Fatalf("Expected one expired set, got %d", expired)
+	}
+
+	_, err = service.GetVersion(expiring, LatestVersion)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected expired set to be gone, got %v", err)
+	}
+
+	err = service.DeleteSet(held)
+	if !errors.Is(err, ErrLegalHold) {
+		t.Fatalf("Expected legal hold to block deletion, got %v", err)
+	}
+
+	err = service.SetLegalHold(held, false)
+	if err != nil {
+		t.Fatalf("Error clearing legal hold: %v", err)
+	}
+
+	_, err = service.GetVersion(held, LatestVersion)
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Expected set to expire once the legal hold is cleared, got %v", err)
+	}
+}
+
+func TestCleanupTemp(t *testing.T) {
+	dir := t.TempDir()
+	service, err := NewFileService(Options{DataDir: dir})
+	if err != nil {
+		t.Fatalf("Error creating service: %v", err)
+	}
+	defer service.Close()
+
+	key, _, err := service.StoreFiles(nil, []filestore.FileInfo{*NewFileInfo("test1")}, StoreOptions{})
+	if err != nil {
+		t.Fatalf("Error storing files: %v", err)
+	}
+
+	partial := filepath.Join(dir, key, "tmp", "blob-partial")
+	err = os.MkdirAll(filepath.Dir(partial), os.ModePerm)
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %v", err)
+	}
+	err = os.WriteFile(partial, []byte("partial"), 0600)
+	if err != nil {
+		t.Fatalf("Error writing partial file: %v", err)
+	}
+
+	err = service.CleanupTemp()
+	if err != nil {
+		t.Fatalf("Error cleaning up: %v", err)
+	}
+
+	_, err = os.Stat(partial)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected partial write to be removed, got %v", err)
+	}
+
+	_, _, _, err = service.GetFile(key, LatestVersion, 0)
+	if err != nil {
+		t.Fatalf("Expected stored files to survive cleanup, got %v", err)
+	}
+}
+
+func TestCollectGarbageUnindexed(t *testing.T) {
+	dir := t.TempDir()
+	service, err := NewFileService(Options{DataDir: dir})
+	if err != nil {
+		t.Fatalf("Error creating service: %v", err)
+	}
+	defer service.Close()
+
+	unknown := filepath.Join(dir, "unknown", "data")
+	err = os.MkdirAll(filepath.Dir(unknown), os.ModePerm)
+	if err != nil {
+		t.Fatalf("Error creating unknown dir: %v", err)
+	}
+	err = os.WriteFile(unknown, []byte("data"), 0600)
+	if err != nil {
+		t.Fatalf("Error writing unknown file: %v", err)
+	}
+
+	err = service.store.MarkPending("interrupted")
+	if err != nil {
+		t.Fatalf("Error marking upload: %v", err)
+	}
+
+	stats, err := service.CollectGarbage()
+	if err != nil {
+		t.Fatalf("Error collecting garbage: %v", err)
+	}
+
+	if stats.Sets != 1 {
+		t.Fatalf("Expected only the interrupted upload to be collected, got %+v", stats)
+	}
+
+	_, err = os.Stat(unknown)
+	if err != nil {
+		t.Fatalf("Expected data that is not indexed to be kept, got %v", err)
+	}
+
+	_, err = os.Stat(filepath.Join(dir, "interrupted"))
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Expected the interrupted upload to be removed, got %v", err)
+	}
+}
+
+func newTestService(t *testing.T) *FileService {
+	service, err := NewFileService(Options{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Error creating service: %v", err)
+	}
+	t.Cleanup(func() { service.Close() })
+
+	return service
+}
+
 func NewFileInfo(name string) *filestore.FileInfo {
-	return &filestore.FileInfo{Name: name, R: strings.NewReader(name)}
+	return &filestore.FileInfo{Name: name, R: strings.NewReader(name), Size: int64(len(name))}
 }
 
 func verifyFile(service *FileService, key string, t *testing.T, rootHash []byte, index int, name string) {
-	file, actualName, err := service.GetFile(key, index)
+	file, actualName, _, err := service.GetFile(key, LatestVersion, index)
 	if err != nil {
 		t.Fatalf("Error getting file: %v", err)
 	}
 
-	proof, err := service.GetProof(key, index)
+	proof, _, err := service.GetProof(key, LatestVersion, index)
 
 	if name != actualName {
 		t.Fatalf("Name mismatch for file %d", index)
@@ -79,4 +1011,19 @@ func verifyFile(service *FileService, key string, t *testing.T, rootHash []byte,
 	if !verificationResult {
 		t.Fatalf("Verification failed for file %d", index)
 	}
+
+	download, err := service.OpenFile(key, LatestVersion, index, true)
+	if err != nil {
+		t.Fatalf("Error opening file with proof: %v", err)
+	}
+	defer download.Content.Close()
+
+	embeddedFile, err := io.ReadAll(download.Content)
+	if err != nil {
+		t.Fatalf("Error reading file: %v", err)
+	}
+
+	if !bytes.Equal(embeddedFile, file) || len(download.Proof) != len(proof) || !bytes.Equal(download.File.Hash, hash) {
+		t.Fatalf("Opened file differs from separate requests for file %d", index)
+	}
 }
@@ -0,0 +1,191 @@
+package fileservice
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	auditlog "github.com/vitaliy/file-storage/server/auditLog"
+	metastore "github.com/vitaliy/file-storage/server/metaStore"
+)
+
+// GCStats summarises one garbage collection run.
+type GCStats struct {
+	Sets  int
+	Blobs int
+	Bytes int64
+}
+
+// RunGarbageCollector collects garbage every interval until ctx is done.
+func (f FileService) RunGarbageCollector(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			stats, err := f.CollectGarbage()
+			if err != nil {
+				slog.Error("garbage collection failed", "error", err)
+				continue
+			}
+			if stats.Sets > 0 || stats.Blobs > 0 {
+				slog.Info("garbage collected", "sets", stats.Sets, "blobs", stats.Blobs, "bytes", stats.Bytes)
+			}
+		}
+	}
+}
+
+// CollectGarbage removes deleted sets, blobs that are not referenced by a
+// live file of any version and leftovers of interrupted writes.
+func (f FileService) CollectGarbage() (GCStats, error) {
+	stats := GCStats{}
+
+	indexed, err := f.meta.ListSets()
+	if err != nil {
+		return stats, err
+	}
+
+	onDisk, err := f.store.ListKeys()
+	if err != nil {
+		return stats, err
+	}
+
+	keys := append(indexed, onDisk...)
+	slices.Sort(keys)
+
+	for _, key := range slices.Compact(keys) {
+		err := f.collectSet(key, &stats)
+		if err != nil {
+			return stats, err
+		}
+	}
+
+	if stats.Sets == 0 && stats.Blobs == 0 {
+		return stats, nil
+	}
+
+	f.record(auditlog.Entry{Operation: "collect_garbage", Detail: fmt.Sprintf("%v sets and %v blobs of %v bytes removed", stats.Sets, stats.Blobs, stats.Bytes)})
+
+	return stats, nil
+}
+
+func (f FileService) collectSet(key string, stats *GCStats) error {
+	unlock := f.locks.Lock(key)
+	defer unlock()
+
+	set, err := f.meta.GetSet(key)
+	if errors.Is(err, metastore.ErrSetNotFound) {
+		return f.collectUnindexed(key, stats)
+	}
+	if err != nil {
+		return err
+	}
+
+	if set.Deleted != nil {
+		return f.removeSet(key, stats)
+	}
+
+	err = f.store.CleanupTemp(key)
+	if err != nil {
+		return err
+	}
+
+	err = f.store.ClearPending(key)
+	if err != nil {
+		return err
+	}
+
+	versions, err := f.meta.ListVersions(key)
+	if err != nil {
+		return err
+	}
+
+	referenced := make(map[string]bool)
+	for _, version := range versions {
+		for _, file := range version.Files {
+			if !set.IsTombstoned(version.Number, file.Index) {
+				referenced[hex.EncodeToString(file.Hash)] = true
+			}
+		}
+	}
+
+	blobs, err := f.store.ListBlobs(key)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range blobs {
+		if referenced[hex.EncodeToString(hash)] {
+			continue
+		}
+
+		size, err := f.store.DeleteBlob(key, hash)
+		if err != nil {
+			return err
+		}
+
+		stats.Blobs++
+		stats.Bytes += size
+	}
+
+	return nil
+}
+
+// collectUnindexed removes the directory of key when it was left by a first
+// upload that never completed. Any other data that is not indexed may be a
+// set that was not imported yet, only its temporary files are removed.
+func (f FileService) collectUnindexed(key string, stats *GCStats) error {
+	pending, err := f.store.IsPending(key)
+	if err != nil {
+		return err
+	}
+
+	if pending {
+		return f.removeSet(key, stats)
+	}
+
+	return f.store.CleanupTemp(key)
+}
+
+// CleanupTemp removes the leftovers of writes to any set that never
+// completed, such as uploads cut off by a shutdown.
+func (f FileService) CleanupTemp() error {
+	keys, err := f.store.ListKeys()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err := f.cleanupTemp(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (f FileService) cleanupTemp(key string) error {
+	unlock := f.locks.Lock(key)
+	defer unlock()
+
+	return f.store.CleanupTemp(key)
+}
+
+func (f FileService) removeSet(key string, stats *GCStats) error {
+	err := f.store.RemoveSet(key)
+	if err != nil {
+		return err
+	}
+
+	stats.Sets++
+
+	return f.meta.DeleteSet(key)
+}
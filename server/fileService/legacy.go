@@ -0,0 +1,151 @@
+package fileservice
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/vitaliy/file-storage/common/merkleTree"
+	auditlog "github.com/vitaliy/file-storage/server/auditLog"
+	metastore "github.com/vitaliy/file-storage/server/metaStore"
+	"github.com/vitaliy/file-storage/server/names"
+)
+
+// importLegacySets imports the sets stored in the layout used before
+// versions, each as the first version of its set in the directory of its
+// encoded key, see names.Encode. A set that cannot be imported is logged and
+// left in place, so the others remain available and it is tried again on
+// the next start.
+func (f FileService) importLegacySets() error {
+	keys, err := f.store.ListLegacySets()
+	if err != nil {
+		return err
+	}
+
+	for _, key := range keys {
+		err := f.importLegacySet(key)
+		if err != nil {
+			slog.Error("importing set failed", "key", key, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// importLegacySet imports key without an owner or expiry, like it was stored.
+// Its leaves must still have the root of its legacy tree.
+func (f FileService) importLegacySet(key string) error {
+	err := names.ValidateKey(key)
+	if err != nil {
+		return err
+	}
+
+	unlock := f.locks.Lock(key)
+	defer unlock()
+
+	legacyTree, err := f.store.GetLegacyTree(key)
+	if err != nil {
+		return err
+	}
+
+	var tree merkleTree.MerkleTree
+	err = merkleTree.UnmarshalTree(legacyTree, &tree)
+	if err != nil {
+		return err
+	}
+
+	if tree.Root == nil {
+		return errors.New("the Merkle tree of the set has no root")
+	}
+
+	// A set that is already indexed with the same root was imported before
+	// its legacy files could be removed. Any other set is left alone.
+	_, err = f.meta.GetSet(key)
+	if err == nil {
+		imported, err := f.meta.GetVersion(key, 1)
+		if err != nil || !bytes.Equal(imported.Root, tree.Root.Hash) {
+			return errors.New("the key is used by another set")
+		}
+
+		return f.store.RemoveLegacySet(key)
+	}
+	if !errors.Is(err, metastore.ErrSetNotFound) {
+		return err
+	}
+
+	set, err := f.newSet(key, time.Now().UTC(), "", "")
+	if err != nil {
+		return err
+	}
+
+	dataKey, err := f.dataKey(set)
+	if err != nil {
+		return err
+	}
+
+	// Blobs of an import that fails are removed, the legacy files stay
+	// until the set is indexed.
+	legacy, err := f.store.ImportLegacySet(key, dataKey)
+	committed := false
+	defer func() {
+		if legacy != nil && !committed {
+			f.removeNewBlobs(key, legacy.Blobs)
+		}
+	}()
+	if err != nil {
+		return err
+	}
+	set.Created = legacy.Modified
+
+	hashes := make([][]byte, 0, len(legacy.Blobs))
+	files := make([]metastore.File, 0, len(legacy.Blobs))
+	for i, blob := range legacy.Blobs {
+		hashes = append(hashes, blob.Hash)
+		files = append(files, metastore.File{
+			Index:       i,
+			Name:        blob.Name,
+			Hash:        blob.Hash,
+			Size:        blob.Size,
+			ContentType: blob.ContentType,
+			Uploaded:    legacy.Modified,
+		})
+	}
+
+	imported, err := merkleTree.NewMerkleTree(hashes)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(imported.Root.Hash, tree.Root.Hash) {
+		return fmt.Errorf("%w: the set has the root %x, its files %x", ErrRootMismatch, tree.Root.Hash, imported.Root.Hash)
+	}
+
+	treeBytes, err := merkleTree.MarshalTree(imported)
+	if err != nil {
+		return err
+	}
+
+	err = f.store.StoreTree(key, dataKey, 1, treeBytes)
+	if err != nil {
+		return err
+	}
+
+	version := &metastore.Version{
+		Number:  1,
+		Root:    imported.Root.Hash,
+		Created: legacy.Modified,
+		Files:   files,
+	}
+
+	err = f.meta.PutVersion(set, version)
+	if err != nil {
+		return err
+	}
+	committed = true
+
+	f.record(auditlog.Entry{Operation: "import_set", Key: key, Version: version.Number, Detail: fmt.Sprintf("%v files", len(files))})
+
+	return f.store.RemoveLegacySet(key)
+}
@@ -0,0 +1,66 @@
+package fileservice
+
+import "sync"
+
+// keyLocks hands out a read/write lock per set key. Entries are reference
+// counted so the map only holds keys that are currently in use.
+type keyLocks struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	sync.RWMutex
+	refs int
+}
+
+func newKeyLocks() *keyLocks {
+	return &keyLocks{locks: make(map[string]*keyLock)}
+}
+
+func (l *keyLocks) acquire(key string) *keyLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock, ok := l.locks[key]
+	if !ok {
+		lock = &keyLock{}
+		l.locks[key] = lock
+	}
+	lock.refs++
+
+	return lock
+}
+
+func (l *keyLocks) release(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock := l.locks[key]
+	lock.refs--
+	if lock.refs == 0 {
+		delete(l.locks, key)
+	}
+}
+
+// Lock takes the write lock for key and returns the function that releases it.
+func (l *keyLocks) Lock(key string) func() {
+	lock := l.acquire(key)
+	lock.Lock()
+
+	return func() {
+		lock.Unlock()
+		l.release(key)
+	}
+}
+
+// RLock takes the read lock for key and returns the function that releases it.
+func (l *keyLocks) RLock(key string) func() {
+	lock := l.acquire(key)
+	lock.RLock()
+
+	return func() {
+		lock.RUnlock()
+		l.release(key)
+	}
+}
@@ -0,0 +1,134 @@
+package fileservice
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	filestore "github.com/vitaliy/file-storage/server/fileStore"
+	metastore "github.com/vitaliy/file-storage/server/metaStore"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota limits what a single account may store. Zero values are unlimited.
+type Quota struct {
+	// MaxBytes limits the content of all live sets of the account. Content
+	// shared by versions of a set is counted once.
+	MaxBytes int64
+	// MaxSets limits the number of live sets of the account.
+	MaxSets int
+	// MaxFilesPerSet limits the number of files in a version.
+	MaxFilesPerSet int
+}
+
+// Usage is what an account stores in its live sets.
+type Usage struct {
+	Bytes int64
+	Sets  int
+}
+
+// GetUsage returns what account stores. The usage of every account is
+// counted by the meta store whenever a set changes, so sets that expired
+// count until the reaper deletes them.
+func (f FileService) GetUsage(account string) (Usage, error) {
+	usage, err := f.meta.GetUsage(account)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	return Usage{Bytes: usage.Bytes, Sets: usage.Sets}, nil
+}
+
+// checkFileQuota checks a new version of set, or a new set when set is nil,
+// before its files are stored. Uploads whose files cannot fit into the byte
+// quota, even where they repeat content the set already holds, are rejected
+// before anything is written.
+func (f FileService) checkFileQuota(account string, set *metastore.Set, files []filestore.FileInfo) error {
+	if account == "" {
+		return nil
+	}
+
+	if f.options.Quota.MaxFilesPerSet > 0 && len(files) > f.options.Quota.MaxFilesPerSet {
+		return fmt.Errorf("%w: a set may hold %v files", ErrQuotaExceeded, f.options.Quota.MaxFilesPerSet)
+	}
+
+	if f.options.Quota.MaxSets == 0 && f.options.Quota.MaxBytes == 0 {
+		return nil
+	}
+
+	usage, err := f.GetUsage(account)
+	if err != nil {
+		return err
+	}
+
+	if set == nil && f.options.Quota.MaxSets > 0 && usage.Sets >= f.options.Quota.MaxSets {
+		return fmt.Errorf("%w: %v sets of %v used", ErrQuotaExceeded, usage.Sets, f.options.Quota.MaxSets)
+	}
+
+	held := int64(0)
+	if set != nil {
+		held = set.Size
+	}
+
+	size := int64(0)
+	for _, file := range files {
+		size += file.Size
+	}
+
+	if f.options.Quota.MaxBytes > 0 && usage.Bytes+size-held > f.options.Quota.MaxBytes {
+		return fmt.Errorf("%w: %v of %v bytes used, the upload has %v bytes", ErrQuotaExceeded, usage.Bytes, f.options.Quota.MaxBytes, size)
+	}
+
+	return nil
+}
+
+// checkByteQuota checks that the content stored for a new version of set
+// fits into the quota of account. Content the set already holds is not
+// counted again. Uploads that run at the same time may together exceed the
+// quota by what each of them adds.
+func (f FileService) checkByteQuota(account string, set *metastore.Set, stored []filestore.StoredBlob) error {
+	if account == "" || f.options.Quota.MaxBytes == 0 {
+		return nil
+	}
+
+	usage, err := f.GetUsage(account)
+	if err != nil {
+		return err
+	}
+
+	content, err := f.setContent(set)
+	if err != nil {
+		return err
+	}
+
+	added := int64(0)
+	for _, blob := range stored {
+		hash := hex.EncodeToString(blob.Hash)
+		if _, ok := content[hash]; !ok {
+			content[hash] = blob.Size
+			added += blob.Size
+		}
+	}
+
+	if usage.Bytes+added > f.options.Quota.MaxBytes {
+		return fmt.Errorf("%w: %v of %v bytes used, the upload adds %v", ErrQuotaExceeded, usage.Bytes, f.options.Quota.MaxBytes, added)
+	}
+
+	return nil
+}
+
+// setContent returns the size of every piece of content that is referenced
+// by a live file of set, by hex leaf hash.
+func (f FileService) setContent(set *metastore.Set) (map[string]int64, error) {
+	// A new set holds no content yet.
+	versions, err := f.meta.ListVersions(set.Key)
+	if errors.Is(err, metastore.ErrSetNotFound) {
+		return make(map[string]int64), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return set.Content(versions), nil
+}
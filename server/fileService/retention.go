@@ -0,0 +1,112 @@
+package fileservice
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	auditlog "github.com/vitaliy/file-storage/server/auditLog"
+	metastore "github.com/vitaliy/file-storage/server/metaStore"
+)
+
+// SetLegalHold places key under legal hold or clears it. A set under legal
+// hold neither expires nor can it or any of its files be deleted.
+func (f FileService) SetLegalHold(key string, hold bool) error {
+	unlock := f.locks.Lock(key)
+	defer unlock()
+
+	set, err := f.getSet(key)
+	if err != nil {
+		return err
+	}
+
+	set.LegalHold = hold
+
+	err = f.meta.PutSet(set)
+	if err != nil {
+		return err
+	}
+
+	operation := "release"
+	if hold {
+		operation = "hold"
+	}
+
+	f.record(auditlog.Entry{Operation: operation, Key: key})
+
+	return nil
+}
+
+// RunReaper deletes expired sets every interval until ctx is done.
+func (f FileService) RunReaper(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			expired, err := f.ExpireSets()
+			if err != nil {
+				slog.Error("expiring sets failed", "error", err)
+				continue
+			}
+			if expired > 0 {
+				slog.Info("expired sets", "sets", expired)
+			}
+		}
+	}
+}
+
+// ExpireSets deletes every set whose retention ran out and returns how many
+// were deleted. Their data is reclaimed by the garbage collector.
+func (f FileService) ExpireSets() (int, error) {
+	keys, err := f.meta.ListSets()
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	for _, key := range keys {
+		ok, err := f.expireSet(key)
+		if err != nil {
+			return expired, err
+		}
+		if ok {
+			expired++
+		}
+	}
+
+	return expired, nil
+}
+
+func (f FileService) expireSet(key string) (bool, error) {
+	unlock := f.locks.Lock(key)
+	defer unlock()
+
+	set, err := f.meta.GetSet(key)
+	if errors.Is(err, metastore.ErrSetNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now().UTC()
+	if set.Deleted != nil || !set.IsExpired(now) {
+		return false, nil
+	}
+
+	set.Deleted = &now
+
+	err = f.meta.PutSet(set)
+	if err != nil {
+		return false, err
+	}
+
+	f.record(auditlog.Entry{Operation: "expire_set", Key: key})
+
+	return true, nil
+}
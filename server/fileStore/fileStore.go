@@ -1,112 +1,515 @@
 package filestore
 
 import (
-	"bytes"
+	"encoding/hex"
+	"errors"
 	"io"
+	"io/fs"
+	"mime"
+	"net/http"
 	"os"
 	"path"
 	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/vitaliy/file-storage/common/merkleTree"
+	"github.com/vitaliy/file-storage/server/encryption"
+	"github.com/vitaliy/file-storage/server/names"
 )
 
 const MerkleTreeFileName = "_merkleTree.json"
 
-const Dir = "files"
+const (
+	blobsDir = "blobs"
+	treesDir = "trees"
+	tmpDir   = "tmp"
+	// pendingFile marks the directory of a set whose first upload has not
+	// completed yet.
+	pendingFile = "pending"
+)
+
+// sniffLen is the number of bytes http.DetectContentType looks at.
+const sniffLen = 512
 
-func NewFileStore() *FileStore {
-	return &FileStore{}
+// NewFileStore returns a store that keeps every set in a directory named
+// by its encoded key under dir, see names.Encode. Blobs and trees are
+// encrypted with the data key passed for their set, or stored in plaintext
+// when it is nil.
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
 }
 
 type FileStore struct {
+	dir string
 }
 
 type FileInfo struct {
 	Name string
 	R    io.Reader
+	// Size is the length of the content when it is known before it is
+	// read, which lets quotas be checked before anything is written.
+	Size int64
 }
 
-func (f FileStore) StoreFile(key string, name string, content []byte) error {
-	return os.WriteFile(path.Join(Dir, key, name), content, os.ModePerm)
+// StoredBlob describes the blob a file was written to. New is set when the
+// blob did not exist before, so it can be removed again when the upload is
+// rejected.
+type StoredBlob struct {
+	Name        string
+	Hash        []byte
+	Size        int64
+	ContentType string
+	New         bool
 }
 
-func (f FileStore) StoreFiles(key string, files []FileInfo) ([][]byte, error) {
-	err := cleanupDir(key)
+// StoreBlobs writes the content of files into the blobs of key, sorted by
+// name, and returns them in leaf order. Hashes, sizes and content types
+// describe the plaintext.
+func (f FileStore) StoreBlobs(key string, dataKey []byte, files []FileInfo) ([]StoredBlob, error) {
+	err := os.MkdirAll(path.Join(f.setDir(key), blobsDir), os.ModePerm)
 	if err != nil {
 		return nil, err
 	}
 
-	hashes := make([][]byte, 0, len(files))
-
 	slices.SortFunc(files, func(a FileInfo, b FileInfo) int {
 		return strings.Compare(a.Name, b.Name)
 	})
 
-	for _, f := range files {
-		filePath := path.Join(Dir, key, f.Name)
-		newFile, err := os.Create(filePath)
+	stored := make([]StoredBlob, 0, len(files))
+
+	for _, file := range files {
+		blob, err := f.storeBlob(key, dataKey, file)
 		if err != nil {
 			return nil, err
 		}
-		defer newFile.Close()
 
-		var buf bytes.Buffer
-		tee := io.TeeReader(f.R, &buf)
+		stored = append(stored, blob)
+	}
+
+	return stored, nil
+}
+
+func (f FileStore) storeBlob(key string, dataKey []byte, file FileInfo) (StoredBlob, error) {
+	tmp, err := f.createTemp(key)
+	if err != nil {
+		return StoredBlob{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
 
-		hash, err := merkleTree.GetHashFromReader(tee)
+	content := io.WriteCloser(nopCloser{tmp})
+	if dataKey != nil {
+		content, err = encryption.NewWriter(tmp, dataKey)
 		if err != nil {
-			return nil, err
+			return StoredBlob{}, err
 		}
+	}
 
-		hashes = append(hashes, hash)
+	counter := &countingWriter{}
+	sum, err := merkleTree.GetHashFromReader(io.TeeReader(file.R, io.MultiWriter(content, counter)))
+	if err != nil {
+		return StoredBlob{}, err
+	}
+
+	err = content.Close()
+	if err != nil {
+		return StoredBlob{}, err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return StoredBlob{}, err
+	}
+
+	_, err = os.Stat(f.blobPath(key, sum))
+	isNew := errors.Is(err, fs.ErrNotExist)
+
+	err = os.Rename(tmp.Name(), f.blobPath(key, sum))
+	if err != nil {
+		return StoredBlob{}, err
+	}
+
+	return StoredBlob{
+		Name:        file.Name,
+		Hash:        sum,
+		Size:        counter.n,
+		ContentType: contentType(file.Name, counter.head),
+		New:         isNew,
+	}, nil
+}
+
+// GetBlob returns the content stored under hash in the blobs of key.
+func (f FileStore) GetBlob(key string, dataKey []byte, hash []byte) ([]byte, error) {
+	content, err := os.ReadFile(f.blobPath(key, hash))
+	if err != nil || dataKey == nil {
+		return content, err
+	}
+
+	return encryption.Open(dataKey, content)
+}
+
+// OpenBlob opens the content stored under hash in the blobs of key for reading.
+func (f FileStore) OpenBlob(key string, dataKey []byte, hash []byte) (io.ReadSeekCloser, error) {
+	file, err := os.Open(f.blobPath(key, hash))
+	if err != nil {
+		return nil, err
+	}
+	if dataKey == nil {
+		return file, nil
+	}
 
-		bytes.NewReader(buf.Bytes())
-		_, err = io.Copy(newFile, bytes.NewReader(buf.Bytes()))
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	reader, err := encryption.NewReader(file, info.Size(), dataKey)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return decryptedFile{reader, file}, nil
+}
+
+// ListBlobs returns the hashes of all blobs stored for key.
+func (f FileStore) ListBlobs(key string) ([][]byte, error) {
+	entries, err := os.ReadDir(path.Join(f.setDir(key), blobsDir))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make([][]byte, 0, len(entries))
+	for _, entry := range entries {
+		hash, err := hex.DecodeString(entry.Name())
 		if err != nil {
-			return nil, err
+			continue
 		}
+		hashes = append(hashes, hash)
 	}
 
 	return hashes, nil
 }
 
-func (f FileStore) GetFileByNumber(key string, number int) ([]byte, string, error) {
-	fileNames, err := os.ReadDir(path.Join(Dir, key))
+// DeleteBlob removes the blob stored under hash and returns the number of bytes reclaimed.
+func (f FileStore) DeleteBlob(key string, hash []byte) (int64, error) {
+	info, err := os.Stat(f.blobPath(key, hash))
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), os.Remove(f.blobPath(key, hash))
+}
+
+// StoreTree atomically writes the marshalled Merkle tree of a version of key.
+func (f FileStore) StoreTree(key string, dataKey []byte, number int, tree []byte) error {
+	err := os.MkdirAll(path.Join(f.setDir(key), treesDir), os.ModePerm)
 	if err != nil {
-		return nil, "", err
+		return err
 	}
 
-	for i, file := range fileNames {
-		if file.Name() == MerkleTreeFileName {
-			fileNames = append(fileNames[:i], fileNames[i+1:]...)
-			break
+	if dataKey != nil {
+		tree, err = encryption.Seal(dataKey, tree)
+		if err != nil {
+			return err
 		}
 	}
 
-	slices.SortFunc(fileNames, func(a os.DirEntry, b os.DirEntry) int {
-		return strings.Compare(a.Name(), b.Name())
-	})
+	tmp, err := f.createTemp(key)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	_, err = tmp.Write(tree)
+	if err != nil {
+		return err
+	}
 
-	file, err := os.ReadFile(path.Join(Dir, key, fileNames[number].Name()))
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
 
-	return file, fileNames[number].Name(), err
+	return os.Rename(tmp.Name(), f.treePath(key, number))
 }
 
-func (f FileStore) GetFileByName(key string, name string) ([]byte, error) {
-	return os.ReadFile(path.Join(Dir, key, name))
+// GetTree returns the marshalled Merkle tree of the given version of key.
+func (f FileStore) GetTree(key string, dataKey []byte, number int) ([]byte, error) {
+	tree, err := os.ReadFile(f.treePath(key, number))
+	if err != nil || dataKey == nil {
+		return tree, err
+	}
+
+	return encryption.Open(dataKey, tree)
 }
 
-func cleanupDir(key string) error {
-	err := os.RemoveAll(path.Join(Dir, key))
+// ListKeys returns the keys of all sets on disk.
+func (f FileStore) ListKeys() ([]string, error) {
+	entries, err := os.ReadDir(f.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		// Directories that are not encoded keys are not sets of the store.
+		key, err := names.Decode(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+// LegacySet is a set read from the layout used before versions.
+type LegacySet struct {
+	// Blobs are the files of the set in leaf order.
+	Blobs []StoredBlob
+	// Modified is when the tree was written, that is when the set was uploaded.
+	Modified time.Time
+}
+
+// ListLegacySets returns the keys of the sets stored in the layout used
+// before versions: the files of a set directly in the directory of its plain
+// key, next to its Merkle tree.
+func (f FileStore) ListLegacySets() ([]string, error) {
+	entries, err := os.ReadDir(f.dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		_, err := os.Stat(path.Join(f.dir, entry.Name(), MerkleTreeFileName))
+		if err != nil {
+			continue
+		}
+
+		keys = append(keys, entry.Name())
+	}
+
+	return keys, nil
+}
+
+// GetLegacyTree returns the marshalled Merkle tree of the legacy set key.
+func (f FileStore) GetLegacyTree(key string) ([]byte, error) {
+	return os.ReadFile(path.Join(f.dir, key, MerkleTreeFileName))
+}
+
+// ImportLegacySet writes the files of the legacy set key into its blobs.
+// The legacy files are kept until RemoveLegacySet is called.
+func (f FileStore) ImportLegacySet(key string, dataKey []byte) (*LegacySet, error) {
+	dir := path.Join(f.dir, key)
+
+	info, err := os.Stat(path.Join(dir, MerkleTreeFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(path.Join(f.setDir(key), blobsDir), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	// The leaves were in the order of the names, which is the order
+	// ReadDir returns them in.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	legacy := &LegacySet{Modified: info.ModTime().UTC()}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || entry.Name() == MerkleTreeFileName {
+			continue
+		}
+
+		blob, err := f.importLegacyFile(key, dataKey, path.Join(dir, entry.Name()))
+		if err != nil {
+			return legacy, err
+		}
+
+		legacy.Blobs = append(legacy.Blobs, blob)
+	}
+
+	return legacy, nil
+}
+
+func (f FileStore) importLegacyFile(key string, dataKey []byte, name string) (StoredBlob, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return StoredBlob{}, err
+	}
+	defer file.Close()
+
+	return f.storeBlob(key, dataKey, FileInfo{Name: path.Base(name), R: file})
+}
+
+// RemoveLegacySet removes the files of the legacy set key once they were
+// imported. Its directory is only removed when it is not the directory the
+// set is now stored in.
+func (f FileStore) RemoveLegacySet(key string) error {
+	dir := path.Join(f.dir, key)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	// The tree goes last, it marks the set as not yet imported.
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || entry.Name() == MerkleTreeFileName {
+			continue
+		}
+
+		err := os.Remove(path.Join(dir, entry.Name()))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Remove(path.Join(dir, MerkleTreeFileName))
 	if err != nil {
 		return err
 	}
 
-	err = os.MkdirAll(path.Join(Dir, key), os.ModePerm)
+	if dir == f.setDir(key) {
+		return nil
+	}
+
+	return os.Remove(dir)
+}
+
+// RemoveSet removes everything stored for key.
+func (f FileStore) RemoveSet(key string) error {
+	return os.RemoveAll(f.setDir(key))
+}
+
+// MarkPending marks key as being uploaded for the first time, until
+// ClearPending is called. Only the directories of such sets may be removed
+// without knowing what they contain, see IsPending.
+func (f FileStore) MarkPending(key string) error {
+	err := os.MkdirAll(f.setDir(key), os.ModePerm)
 	if err != nil {
 		return err
 	}
 
+	return os.WriteFile(path.Join(f.setDir(key), pendingFile), nil, os.ModePerm)
+}
+
+// ClearPending removes the mark of MarkPending.
+func (f FileStore) ClearPending(key string) error {
+	err := os.Remove(path.Join(f.setDir(key), pendingFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// IsPending reports whether key was marked by MarkPending.
+func (f FileStore) IsPending(key string) (bool, error) {
+	_, err := os.Stat(path.Join(f.setDir(key), pendingFile))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// CleanupTemp removes leftovers of writes to key that never completed.
+func (f FileStore) CleanupTemp(key string) error {
+	return os.RemoveAll(path.Join(f.setDir(key), tmpDir))
+}
+
+func (f FileStore) createTemp(key string) (*os.File, error) {
+	dir := path.Join(f.setDir(key), tmpDir)
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.CreateTemp(dir, "blob-")
+}
+
+// setDir returns the directory of key.
+func (f FileStore) setDir(key string) string {
+	return path.Join(f.dir, names.Encode(key))
+}
+
+func (f FileStore) blobPath(key string, hash []byte) string {
+	return path.Join(f.setDir(key), blobsDir, hex.EncodeToString(hash))
+}
+
+func (f FileStore) treePath(key string, number int) string {
+	return path.Join(f.setDir(key), treesDir, strconv.Itoa(number)+MerkleTreeFileName)
+}
+
+// contentType picks the MIME type of a file from its extension, falling back
+// to sniffing its first bytes.
+func contentType(name string, head []byte) string {
+	byExtension := mime.TypeByExtension(path.Ext(name))
+	if byExtension != "" {
+		return byExtension
+	}
+
+	return http.DetectContentType(head)
+}
+
+// countingWriter counts the bytes written to it and keeps the first ones for sniffing.
+type countingWriter struct {
+	n    int64
+	head []byte
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	if len(c.head) < sniffLen {
+		c.head = append(c.head, p[:min(len(p), sniffLen-len(c.head))]...)
+	}
+	c.n += int64(len(p))
+
+	return len(p), nil
+}
+
+// decryptedFile reads a blob through its decryption and closes the file.
+type decryptedFile struct {
+	*encryption.Reader
+	file *os.File
+}
+
+func (d decryptedFile) Close() error {
+	return d.file.Close()
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
 	return nil
 }
@@ -5,6 +5,9 @@ go 1.22.2
 require (
 	github.com/google/uuid v1.6.0
 	github.com/vitaliy/file-storage/common v0.0.0-00010101000000-000000000000
+	go.etcd.io/bbolt v1.3.11
 )
 
+require golang.org/x/sys v0.4.0 // indirect
+
 replace github.com/vitaliy/file-storage/common => ../common
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	fileservice "github.com/vitaliy/file-storage/server/fileService"
+)
+
+// adminName is the caller name of requests made with the admin token.
+const adminName = "admin"
+
+// caller is who a request was made by. Anonymous callers have no name.
+type caller struct {
+	name  string
+	admin bool
+}
+
+type callerKey struct{}
+
+// callerOf returns the caller authenticate resolved for r.
+func callerOf(r *http.Request) caller {
+	c, _ := r.Context().Value(callerKey{}).(caller)
+	return c
+}
+
+func withCaller(r *http.Request, c caller) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), callerKey{}, c))
+}
+
+// authenticate resolves the caller of every request from its bearer token,
+// which is either the admin token or an API key, or else from its client
+// certificate, unless limitRate already did. Requests with an invalid token
+// are rejected; whether anonymous callers are allowed is up to the handlers.
+func (s *server) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(callerKey{}).(caller); ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		c, err := s.resolveCaller(r)
+		if err != nil {
+			slog.Info("authentication failed", "method", r.Method, "path", r.URL.Path, "remote", r.RemoteAddr, "error", err)
+			writeError(w, err)
+			return
+		}
+
+		next.ServeHTTP(w, withCaller(r, c))
+	})
+}
+
+func (s *server) resolveCaller(r *http.Request) (caller, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return caller{name: clientIdentity(r)}, nil
+	}
+
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		return caller{}, errUnauthorized
+	}
+
+	if s.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1 {
+		return caller{name: adminName, admin: true}, nil
+	}
+
+	key, err := s.files.Authenticate(token)
+	if errors.Is(err, fileservice.ErrInvalidAPIKey) {
+		return caller{}, errUnauthorized
+	}
+	if err != nil {
+		return caller{}, err
+	}
+
+	return caller{name: key.Owner, admin: key.Admin}, nil
+}
+
+// authorize checks that the caller of r may access the set key. Sets without
+// an owner are open to every caller, and admins may access every set.
+func (s *server) authorize(r *http.Request, key string) error {
+	c := callerOf(r)
+	if c.name == "" && s.requireAuth {
+		return errUnauthorized
+	}
+	if c.admin {
+		return nil
+	}
+
+	owner, err := s.files.GetOwner(key)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case owner == "" || owner == c.name:
+		return nil
+	case c.name == "":
+		return errUnauthorized
+	default:
+		return errForbidden
+	}
+}
+
+// authorizeUpload checks that the caller of r may upload to the set key, or
+// create a new set when key is nil.
+func (s *server) authorizeUpload(r *http.Request, key *string) error {
+	if key == nil {
+		if callerOf(r).name == "" && s.requireAuth {
+			return errUnauthorized
+		}
+		return nil
+	}
+
+	// Uploading to a key that is not taken creates a new set.
+	err := s.authorize(r, *key)
+	if errors.Is(err, fileservice.ErrNotFound) {
+		return s.authorizeUpload(r, nil)
+	}
+
+	return err
+}
+
+// requireAdmin checks that r was made by an admin.
+func requireAdmin(r *http.Request) error {
+	c := callerOf(r)
+	switch {
+	case c.admin:
+		return nil
+	case c.name == "":
+		return errUnauthorized
+	default:
+		return errForbidden
+	}
+}
+
+// identity returns who quotas and rate limits apply to for r: the caller, or
+// the IP address of anonymous clients. Admins are exempt and have none.
+func identity(r *http.Request) string {
+	if callerOf(r).admin {
+		return ""
+	}
+
+	return actor(r)
+}
+
+// actor returns who the operations of r are recorded for in the audit log:
+// the caller, or the IP address of anonymous clients.
+func actor(r *http.Request) string {
+	if name := callerOf(r).name; name != "" {
+		return name
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	return "ip:" + host
+}
+
+// certificatePrefix starts the identities of client certificates, so that
+// a certificate never acts as the owner of an API key or as the admin.
+const certificatePrefix = "cert:"
+
+// clientIdentity returns the identity of the client certificate a request
+// was made with, which is cert: and the common name of the verified
+// certificate, or "" when the client did not present one.
+func clientIdentity(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return ""
+	}
+
+	name := r.TLS.VerifiedChains[0][0].Subject.CommonName
+	if name == "" {
+		return ""
+	}
+
+	return certificatePrefix + name
+}
+
+// logRequests logs every request with its outcome and caller at debug level.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(recorder, r)
+
+		slog.Debug("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"caller", callerOf(r).name,
+			"duration", time.Since(start))
+	})
+}
+
+// statusWriter remembers the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusWriter) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (s *statusWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
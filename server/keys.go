@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	fileservice "github.com/vitaliy/file-storage/server/fileService"
+)
+
+// CreateAPIKeyRequest is the body of a request for a new API key.
+type CreateAPIKeyRequest struct {
+	Owner string `json:"owner"`
+	Admin bool   `json:"admin"`
+}
+
+// APIKeyResponse describes an API key. The token is only returned when the
+// key is created.
+type APIKeyResponse struct {
+	ID      string    `json:"id"`
+	Owner   string    `json:"owner"`
+	Admin   bool      `json:"admin"`
+	Created time.Time `json:"created"`
+	Token   string    `json:"token,omitempty"`
+}
+
+type APIKeysResponse struct {
+	Keys []APIKeyResponse `json:"keys"`
+}
+
+func (s *server) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	err := requireAdmin(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	var request CreateAPIKeyRequest
+	err = json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10)).Decode(&request)
+	if err != nil {
+		writeError(w, newAPIError(http.StatusBadRequest, "invalid_request", err.Error()))
+		return
+	}
+
+	owner := strings.TrimSpace(request.Owner)
+	if owner == "" {
+		writeError(w, errInvalidOwner)
+		return
+	}
+	// Names with a colon identify certificates and anonymous clients.
+	if owner == adminName || strings.Contains(owner, ":") {
+		writeError(w, errReservedOwner)
+		return
+	}
+
+	token, key, err := s.files.As(actor(r)).CreateAPIKey(owner, request.Admin)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := newAPIKeyResponse(key)
+	response.Token = token
+
+	w.Header().Set("Location", "/v1/keys/"+key.ID)
+	writeJSON(w, http.StatusCreated, response)
+}
+
+func (s *server) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	err := requireAdmin(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	keys, err := s.files.As(actor(r)).ListAPIKeys()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := APIKeysResponse{Keys: make([]APIKeyResponse, 0, len(keys))}
+	for _, key := range keys {
+		response.Keys = append(response.Keys, newAPIKeyResponse(key))
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (s *server) revokeAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	err := requireAdmin(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = s.files.As(actor(r)).RevokeAPIKey(r.PathValue("id"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newAPIKeyResponse(key fileservice.APIKey) APIKeyResponse {
+	return APIKeyResponse{ID: key.ID, Owner: key.Owner, Admin: key.Admin, Created: key.Created}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	fileservice "github.com/vitaliy/file-storage/server/fileService"
+)
+
+const testAdminToken = "test-admin-token-that-is-long-enough"
+
+func TestAPIKeys(t *testing.T) {
+	s := newTestAPI(t, 1<<20)
+	s.adminToken = testAdminToken
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+
+	alice := createAPIKey(t, ts.URL, testAdminToken, "alice")
+	bob := createAPIKey(t, ts.URL, testAdminToken, "bob")
+
+	// Owners must not be mistaken for the admin or a client certificate.
+	for _, owner := range []string{adminName, "cert:alice", "ip:127.0.0.1"} {
+		body, _ := json.Marshal(CreateAPIKeyRequest{Owner: owner})
+		req := newRequest(t, http.MethodPost, ts.URL+"/v1/keys", testAdminToken)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		verifyError(t, do(t, req), http.StatusBadRequest, "invalid_owner")
+	}
+
+	req := newUploadRequest(t, http.MethodPost, ts.URL+"/v1/sets", "", map[string]string{"test1": "test1"})
+	req.Header.Set("Authorization", "Bearer "+alice.Token)
+	resp := do(t, req)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201, got %v", resp.Status)
+	}
+
+	var uploadResponse UploadResponse
+	json.NewDecoder(resp.Body).Decode(&uploadResponse)
+	set := ts.URL + "/v1/sets/" + uploadResponse.Key
+
+	var manifest ManifestResponse
+	resp = do(t, newRequest(t, http.MethodGet, set, alice.Token))
+	err := json.NewDecoder(resp.Body).Decode(&manifest)
+	if err != nil || manifest.Owner != "alice" {
+		t.Fatalf("Expected a set owned by alice, got %+v (%v)", manifest, err)
+	}
+
+	resp = do(t, newRequest(t, http.MethodGet, set, testAdminToken))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected admins to read every set, got %v", resp.Status)
+	}
+
+	req = newUploadRequest(t, http.MethodPut, set, fileservice.AnyRoot, map[string]string{"test2": "test2"})
+	req.Header.Set("Authorization", "Bearer "+bob.Token)
+	verifyError(t, do(t, req), http.StatusForbidden, "forbidden")
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		token  string
+		status int
+		code   string
+	}{
+		{"other owner", http.MethodGet, set + "/files/0", bob.Token, http.StatusForbidden, "forbidden"},
+		{"other owner delete", http.MethodDelete, set, bob.Token, http.StatusForbidden, "forbidden"},
+		{"anonymous", http.MethodGet, set, "", http.StatusUnauthorized, "unauthorized"},
+		{"invalid token", http.MethodGet, set, "fsk_invalid", http.StatusUnauthorized, "unauthorized"},
+		{"list keys", http.MethodGet, ts.URL + "/v1/keys", alice.Token, http.StatusForbidden, "forbidden"},
+		{"missing key", http.MethodDelete, ts.URL + "/v1/keys/missing", testAdminToken, http.StatusNotFound, "api_key_not_found"},
+		{"owner places hold", http.MethodPut, set + "/hold", alice.Token, http.StatusForbidden, "forbidden"},
+		{"owner releases hold", http.MethodDelete, set + "/hold", alice.Token, http.StatusForbidden, "forbidden"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resp := do(t, newRequest(t, test.method, test.url, test.token))
+			verifyError(t, resp, test.status, test.code)
+		})
+	}
+
+	resp = do(t, newRequest(t, http.MethodDelete, ts.URL+"/v1/keys/"+alice.ID, testAdminToken))
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %v", resp.Status)
+	}
+
+	resp = do(t, newRequest(t, http.MethodGet, set, alice.Token))
+	if resp.Header.Get("WWW-Authenticate") == "" {
+		t.Fatalf("Expected a bearer challenge")
+	}
+	verifyError(t, resp, http.StatusUnauthorized, "unauthorized")
+}
+
+func TestRequireAuth(t *testing.T) {
+	s := newTestAPI(t, 1<<20)
+	s.requireAuth = true
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+
+	resp := upload(t, http.MethodPost, ts.URL+"/v1/sets", "", map[string]string{"test1": "test1"})
+	verifyError(t, resp, http.StatusUnauthorized, "unauthorized")
+
+	resp = get(t, ts.URL+"/ping")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected ping to be public, got %v", resp.Status)
+	}
+}
+
+func createAPIKey(t *testing.T, url string, token string, owner string) APIKeyResponse {
+	body, _ := json.Marshal(CreateAPIKeyRequest{Owner: owner})
+
+	req, err := http.NewRequest(http.MethodPost, url+"/v1/keys", bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp := do(t, req)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201, got %v", resp.Status)
+	}
+
+	var key APIKeyResponse
+	err = json.NewDecoder(resp.Body).Decode(&key)
+	if err != nil || !strings.HasPrefix(key.Token, "fsk_") || key.Owner != owner {
+		t.Fatalf("Expected a key of %v, got %+v (%v)", owner, key, err)
+	}
+
+	return key
+}
+
+// newRequest creates a request without body, authenticated with token
+// unless it is empty.
+func newRequest(t *testing.T, method string, url string, token string) *http.Request {
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return req
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the requests of every identity with a token bucket
+// that holds up to burst requests and refills at rate per second.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{rate: rate, burst: float64(max(burst, 1)), buckets: make(map[string]*bucket)}
+}
+
+// take takes a request from the bucket of identity. When the bucket is
+// empty it returns how long it takes to refill one request.
+func (l *rateLimiter) take(identity string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.sweep(now)
+
+	b, ok := l.buckets[identity]
+	if !ok {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[identity] = b
+	}
+
+	b.tokens = min(l.burst, b.tokens+now.Sub(b.updated).Seconds()*l.rate)
+	b.updated = now
+
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+
+	return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// sweep forgets the buckets that refilled completely, which are no different
+// from new ones, so idle clients take no memory.
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+
+	full := time.Duration(l.burst / l.rate * float64(time.Second))
+	for identity, b := range l.buckets {
+		if now.Sub(b.updated) >= full {
+			delete(l.buckets, identity)
+		}
+	}
+}
+
+// limitRate rejects requests of identities that exceed the rate limit, and
+// tells them when to retry. It runs before authenticate, so requests with
+// invalid credentials are limited by their address like anonymous ones.
+// Admins and health checks are not limited.
+func (s *server) limitRate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.limiter == nil || r.URL.Path == "/ping" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// A resolved caller is passed on, so authenticate only resolves
+		// callers again whose credentials were rejected.
+		c, err := s.resolveCaller(r)
+		if err == nil {
+			r = withCaller(r, c)
+		}
+
+		id := identity(r)
+		if id == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		ok, wait := s.limiter.take(id, time.Now())
+		if !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeError(w, errRateLimited)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// UsageResponse reports what an identity stores and the limits it is
+// subject to. Zero limits are unlimited.
+type UsageResponse struct {
+	Identity       string  `json:"identity"`
+	Bytes          int64   `json:"bytes"`
+	Sets           int     `json:"sets"`
+	MaxBytes       int64   `json:"maxBytes"`
+	MaxSets        int     `json:"maxSets"`
+	MaxFilesPerSet int     `json:"maxFilesPerSet"`
+	RateLimit      float64 `json:"rateLimit"`
+	RateBurst      int     `json:"rateBurst"`
+}
+
+// getUsageHandler reports the usage of the caller. Admins may ask for any
+// identity with the identity query parameter.
+func (s *server) getUsageHandler(w http.ResponseWriter, r *http.Request) {
+	if callerOf(r).name == "" && s.requireAuth {
+		writeError(w, errUnauthorized)
+		return
+	}
+
+	id := identity(r)
+	if requested := r.URL.Query().Get("identity"); requested != "" && requested != id {
+		err := requireAdmin(r)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		id = requested
+	}
+
+	usage, err := s.files.GetUsage(id)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	response := UsageResponse{
+		Identity:       id,
+		Bytes:          usage.Bytes,
+		Sets:           usage.Sets,
+		MaxBytes:       s.quota.MaxBytes,
+		MaxSets:        s.quota.MaxSets,
+		MaxFilesPerSet: s.quota.MaxFilesPerSet,
+	}
+	if s.limiter != nil {
+		response.RateLimit = s.limiter.rate
+		response.RateBurst = int(s.limiter.burst)
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
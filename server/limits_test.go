@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	fileservice "github.com/vitaliy/file-storage/server/fileService"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter(2, 3)
+	now := time.Unix(1000, 0)
+
+	for i := range 3 {
+		ok, _ := limiter.take("a", now)
+		if !ok {
+			t.Fatalf("Expected request %v of the burst to be allowed", i)
+		}
+	}
+
+	ok, wait := limiter.take("a", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("Expected to wait 500ms, got %v %v", ok, wait)
+	}
+
+	ok, _ = limiter.take("b", now)
+	if !ok {
+		t.Fatalf("Expected identities to be limited separately")
+	}
+
+	ok, _ = limiter.take("a", now.Add(500*time.Millisecond))
+	if !ok {
+		t.Fatalf("Expected a request to be allowed after refilling")
+	}
+
+	limiter.take("a", now.Add(time.Hour))
+	if len(limiter.buckets) != 1 {
+		t.Fatalf("Expected full buckets to be swept, got %v", len(limiter.buckets))
+	}
+}
+
+func TestUsage(t *testing.T) {
+	quota := fileservice.Quota{MaxBytes: 10, MaxSets: 1, MaxFilesPerSet: 2}
+	files, err := fileservice.NewFileService(fileservice.Options{DataDir: t.TempDir(), Quota: quota})
+	if err != nil {
+		t.Fatalf("Error creating file service: %v", err)
+	}
+	t.Cleanup(func() { files.Close() })
+
+	s := newTestAPI(t, 1<<20)
+	s.files = files
+	s.quota = quota
+	s.adminToken = testAdminToken
+	s.limiter = newRateLimiter(0.001, 6)
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+
+	verifyError(t, upload(t, http.MethodPost, ts.URL+"/v1/sets", "", map[string]string{"a": "a", "b": "b", "c": "c"}), http.StatusRequestEntityTooLarge, "quota_exceeded")
+	verifyError(t, upload(t, http.MethodPost, ts.URL+"/v1/sets", "", map[string]string{"a": "0123456789a"}), http.StatusRequestEntityTooLarge, "quota_exceeded")
+
+	resp := upload(t, http.MethodPost, ts.URL+"/v1/sets", "", map[string]string{"a": "01234", "b": "56789"})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected the upload to fit into the quota, got %v", resp.Status)
+	}
+	verifyError(t, upload(t, http.MethodPost, ts.URL+"/v1/sets", "", map[string]string{"a": "a"}), http.StatusRequestEntityTooLarge, "quota_exceeded")
+
+	var usage UsageResponse
+	err = json.NewDecoder(get(t, ts.URL+"/v1/usage").Body).Decode(&usage)
+	if err != nil {
+		t.Fatalf("Error decoding usage: %v", err)
+	}
+	expected := UsageResponse{Identity: "ip:127.0.0.1", Bytes: 10, Sets: 1, MaxBytes: 10, MaxSets: 1, MaxFilesPerSet: 2, RateLimit: 0.001, RateBurst: 6}
+	if usage != expected {
+		t.Fatalf("Expected usage %+v, got %+v", expected, usage)
+	}
+
+	verifyError(t, get(t, ts.URL+"/v1/usage?identity=other"), http.StatusUnauthorized, "unauthorized")
+
+	// The burst is used up by now, admins are not limited.
+	resp = get(t, ts.URL+"/v1/usage")
+	verifyError(t, resp, http.StatusTooManyRequests, "rate_limited")
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("Expected Retry-After to be set")
+	}
+
+	// Invalid tokens are limited by the address they come from.
+	verifyError(t, do(t, newRequest(t, http.MethodGet, ts.URL+"/v1/usage", "invalid")), http.StatusTooManyRequests, "rate_limited")
+
+	resp = do(t, newRequest(t, http.MethodGet, ts.URL+"/v1/usage?identity=ip:127.0.0.1", testAdminToken))
+	usage = UsageResponse{}
+	json.NewDecoder(resp.Body).Decode(&usage)
+	if resp.StatusCode != http.StatusOK || usage.Bytes != 10 {
+		t.Fatalf("Expected admins to see the usage of any identity, got %v %+v", resp.Status, usage)
+	}
+}
@@ -1,146 +1,647 @@
 package main
 
 import (
-	"bytes"
+	"cmp"
+	"context"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io"
 	"log"
+	"log/slog"
+	"mime"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
+	"github.com/vitaliy/file-storage/common/merkleTree"
+	"github.com/vitaliy/file-storage/server/config"
 	fileservice "github.com/vitaliy/file-storage/server/fileService"
 	filestore "github.com/vitaliy/file-storage/server/fileStore"
 )
 
-func uploadFilesHandler(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseMultipartForm(10 << 20)
+type server struct {
+	files *fileservice.FileService
+	// maxUploadSize limits the body of an upload.
+	maxUploadSize int64
+	// maxUploadMemory is how much of an upload is buffered in memory.
+	maxUploadMemory int64
+	uploads         uploadTracker
+	// adminToken authenticates the admin, when it is set.
+	adminToken string
+	// requireAuth rejects anonymous callers.
+	requireAuth bool
+	// shareSecret is the key share links are signed with.
+	shareSecret []byte
+	// quota limits what every identity may store.
+	quota fileservice.Quota
+	// limiter limits the requests of every identity, it is nil without a
+	// rate limit.
+	limiter *rateLimiter
+	// corsOrigins are the origins of the web pages that may call the API
+	// from a browser.
+	corsOrigins []string
+}
+
+// uploadFilesHandler stores the uploaded files as a new set, or as a new
+// version of the set named in the path.
+func (s *server) uploadFilesHandler(w http.ResponseWriter, r *http.Request) {
+	if !s.uploads.begin() {
+		w.Header().Set("Retry-After", retryAfterShutdown)
+		writeError(w, errShuttingDown)
+		return
+	}
+	defer s.uploads.end()
+
+	var key *string
+	if k := r.PathValue("key"); k != "" {
+		key = &k
+	}
+
+	err := s.authorizeUpload(r, key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, s.maxUploadSize)
+
+	err = r.ParseMultipartForm(s.maxUploadMemory)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, errUploadTooLarge)
+		return
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		writeError(w, newAPIError(http.StatusBadRequest, "invalid_upload", err.Error()))
 		return
 	}
 
 	fileHeaders := r.MultipartForm.File["files"]
+	if len(fileHeaders) == 0 {
+		writeError(w, errNoFiles)
+		return
+	}
 
 	files := make([]filestore.FileInfo, 0, len(fileHeaders))
 
 	for _, file := range fileHeaders {
 		f, err := file.Open()
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+			writeError(w, err)
 			return
 		}
 		defer f.Close()
 
-		files = append(files, filestore.FileInfo{R: f, Name: file.Filename})
+		files = append(files, filestore.FileInfo{R: f, Name: file.Filename, Size: file.Size})
+	}
+
+	ttl, err := parseTTL(cmp.Or(r.Header.Get("X-Set-TTL"), r.FormValue("ttl")))
+	if err != nil {
+		writeError(w, errInvalidTTL)
+		return
+	}
+
+	root, err := parseRoot(cmp.Or(r.Header.Get("X-Merkle-Root"), r.FormValue("root")))
+	if err != nil {
+		writeError(w, errInvalidRoot)
+		return
+	}
+
+	options := fileservice.StoreOptions{
+		ExpectedRoot: parseIfMatch(r.Header.Get("If-Match")),
+		TTL:          ttl,
+		Owner:        callerOf(r).name,
+		Root:         root,
+		Account:      identity(r),
 	}
 
-	key, err := fileservice.NewFileService().StoreFiles(nil, files)
+	storedKey, version, err := s.files.As(actor(r)).StoreFiles(key, files, options)
 	if err != nil {
-		fmt.Println(err)
-		http.Error(w, "Error uploading files", http.StatusInternalServerError)
+		writeError(w, err)
+		return
 	}
 
 	response := UploadResponse{
-		Key: key,
+		Key:           storedKey,
+		Version:       version.Number,
+		Root:          hex.EncodeToString(version.Root),
+		LeafCount:     len(files),
+		HashAlgorithm: merkleTree.HashAlgorithm,
+	}
+
+	status := http.StatusOK
+	if key == nil {
+		status = http.StatusCreated
+		w.Header().Set("Location", "/v1/sets/"+url.PathEscape(storedKey))
+	}
+
+	w.Header().Set("ETag", etag(version.Root))
+	writeJSON(w, status, response)
+}
+
+func (s *server) getFileHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	err := s.authorize(r, key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	versionInt, numberInt, err := s.resolveFile(r)
+	if err != nil {
+		writeError(w, err)
+		return
 	}
 
-	jsonResponse, err := json.Marshal(response)
+	withProof := r.URL.Query().Get("proof") == "true"
+
+	download, err := s.files.As(actor(r)).OpenFile(key, versionInt, numberInt, withProof)
 	if err != nil {
-		http.Error(w, "Error creating JSON response", http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
+	defer download.Content.Close()
+
+	serveDownload(w, r, download, numberInt, withProof)
+}
+
+// serveDownload writes the content of a downloaded file, with its proof
+// headers when withProof is set.
+func serveDownload(w http.ResponseWriter, r *http.Request, download *fileservice.Download, index int, withProof bool) {
+	if withProof {
+		setProofHeaders(w.Header(), index, download.Proof, download.Version)
+	}
+
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": download.File.Name}))
+	w.Header().Set("Content-Type", download.File.ContentType)
+	w.Header().Set("ETag", etag(download.File.Hash))
+	w.Header().Set("X-Merkle-Root", hex.EncodeToString(download.Version.Root))
+	w.Header().Set("X-Merkle-Version", strconv.Itoa(download.Version.Number))
+	w.Header().Set("X-Merkle-Index", strconv.Itoa(index))
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(jsonResponse)
+	// ServeContent answers range and conditional requests against the ETag,
+	// which is the leaf hash and therefore changes whenever the content does.
+	http.ServeContent(w, r, download.File.Name, download.File.Uploaded, download.Content)
 }
 
-func getFileHandler(w http.ResponseWriter, r *http.Request) {
-	number := r.URL.Query().Get("filenumber")
-	key := r.URL.Query().Get("key")
+func newProofResponse(proof [][]byte, version int, index int) ProofResponse {
+	proofResponse := ProofResponse{Version: version, Index: index}
+
+	for _, v := range proof {
+		proofResponse.Proof = append(proofResponse.Proof, hex.EncodeToString(v))
+	}
+
+	return proofResponse
+}
 
-	numberInt, err := strconv.Atoi(number)
+// setProofHeaders embeds the proof of a downloaded file in the response
+// headers so file and proof arrive in a single round trip.
+func setProofHeaders(header http.Header, index int, proof [][]byte, version fileservice.VersionInfo) {
+	encoded := make([]string, 0, len(proof))
+	for _, v := range proof {
+		encoded = append(encoded, hex.EncodeToString(v))
+	}
+
+	header.Set("X-Merkle-Proof", strings.Join(encoded, ","))
+	header.Set("X-Merkle-Root", hex.EncodeToString(version.Root))
+	header.Set("X-Merkle-Version", strconv.Itoa(version.Number))
+	header.Set("X-Merkle-Index", strconv.Itoa(index))
+	header.Set("X-Merkle-Hash-Algorithm", merkleTree.HashAlgorithm)
+}
+
+func (s *server) getProofHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	err := s.authorize(r, key)
 	if err != nil {
-		http.Error(w, "Invalid file number", http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
-	file, name, err := fileservice.NewFileService().GetFile(key, numberInt)
+	versionInt, numberInt, err := s.resolveFile(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
+	proof, version, err := s.files.As(actor(r)).GetProof(key, versionInt, numberInt)
 	if err != nil {
-		http.Error(w, "Error getting file", http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%v", name))
-	io.Copy(w, bytes.NewReader(file))
+	w.Header().Set("ETag", etag(version.Root))
+	writeJSON(w, http.StatusOK, newProofResponse(proof, version.Number, numberInt))
 }
 
-func getProofHandler(w http.ResponseWriter, r *http.Request) {
-	number := r.URL.Query().Get("filenumber")
-	key := r.URL.Query().Get("key")
+func (s *server) deleteFileHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
 
-	numberInt, err := strconv.Atoi(number)
+	err := s.authorize(r, key)
 	if err != nil {
-		http.Error(w, "Invalid file number", http.StatusBadRequest)
+		writeError(w, err)
 		return
 	}
 
-	proof, err := fileservice.NewFileService().GetProof(key, numberInt)
+	versionInt, numberInt, err := s.resolveFile(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
 
+	err = s.files.As(actor(r)).DeleteFile(key, versionInt, numberInt)
 	if err != nil {
-		http.Error(w, "Error getting proof", http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
-	proofResponse := ProofResponse{}
 
-	for _, v := range proof {
-		proofResponse.Proof = append(proofResponse.Proof, hex.EncodeToString(v))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) deleteSetHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	err := s.authorize(r, key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = s.files.As(actor(r)).DeleteSet(key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) getManifestHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	err := s.authorize(r, key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	versionInt, err := parseVersion(r.URL.Query().Get("version"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	manifest, err := s.files.As(actor(r)).GetManifest(key, versionInt)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	w.Header().Set("ETag", etag(manifest.Version.Root))
+	writeJSON(w, http.StatusOK, newManifestResponse(manifest))
+}
+
+func newManifestResponse(manifest *fileservice.Manifest) ManifestResponse {
+	manifestResponse := ManifestResponse{
+		Key:           manifest.Key,
+		Version:       manifest.Version.Number,
+		Root:          hex.EncodeToString(manifest.Version.Root),
+		LeafCount:     len(manifest.Files),
+		HashAlgorithm: merkleTree.HashAlgorithm,
+		Created:       manifest.Version.Created,
+		Owner:         manifest.Owner,
+		Expires:       manifest.Expires,
+		LegalHold:     manifest.LegalHold,
+		Encrypted:     manifest.Encrypted,
+		Files:         make([]ManifestFileResponse, 0, len(manifest.Files)),
+	}
+	for _, file := range manifest.Files {
+		manifestResponse.Files = append(manifestResponse.Files, ManifestFileResponse{
+			Index:       file.Index,
+			Name:        file.Name,
+			Size:        file.Size,
+			LeafHash:    hex.EncodeToString(file.Hash),
+			ContentType: file.ContentType,
+			Uploaded:    file.Uploaded,
+			Deleted:     file.Deleted,
+		})
+	}
+
+	return manifestResponse
+}
+
+// legalHoldHandler places or releases the legal hold of a set. Only admins
+// may, so owners cannot release a hold to delete their set.
+func (s *server) legalHoldHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	err := requireAdmin(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	err = s.files.As(actor(r)).SetLegalHold(key, r.Method == http.MethodPut)
+	if err != nil {
+		writeError(w, err)
+		return
 	}
-	jsonResponse, err := json.Marshal(proofResponse)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *server) getVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	err := s.authorize(r, key)
 	if err != nil {
-		http.Error(w, "Error creating JSON response", http.StatusInternalServerError)
+		writeError(w, err)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.Write(jsonResponse)
+	history, err := s.files.As(actor(r)).ListVersions(key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	versionsResponse := VersionsResponse{Key: key, Versions: make([]VersionResponse, 0, len(history))}
+	for _, version := range history {
+		versionsResponse.Versions = append(versionsResponse.Versions, VersionResponse{
+			Version: version.Number,
+			Root:    hex.EncodeToString(version.Root),
+			Created: version.Created,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, versionsResponse)
+}
+
+// resolveFile returns the version and leaf index addressed by the version
+// query parameter and either the {n} or the {name} path value. A name is
+// resolved in a fixed version so later reads see the same state.
+func (s *server) resolveFile(r *http.Request) (int, int, error) {
+	version, err := parseVersion(r.URL.Query().Get("version"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	name := r.PathValue("name")
+	if name == "" {
+		number, err := strconv.Atoi(r.PathValue("n"))
+		if err != nil || number < 0 {
+			return 0, 0, errInvalidFile
+		}
+
+		return version, number, nil
+	}
+
+	number, resolved, err := s.files.FindFile(r.PathValue("key"), version, name)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return resolved.Number, number, nil
+}
+
+// parseTTL parses the optional TTL of an upload. A missing TTL uses the
+// server default.
+func parseTTL(ttl string) (time.Duration, error) {
+	if ttl == "" {
+		return 0, nil
+	}
+
+	duration, err := time.ParseDuration(ttl)
+	if err != nil {
+		return 0, err
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("TTL must be positive")
+	}
+
+	return duration, nil
+}
+
+// parseVersion parses the optional version query parameter. A missing
+// version addresses the latest one.
+func parseVersion(version string) (int, error) {
+	if version == "" {
+		return fileservice.LatestVersion, nil
+	}
+
+	number, err := strconv.Atoi(version)
+	if err != nil || number < 0 {
+		return 0, errInvalidVersion
+	}
+
+	return number, nil
 }
 
+// etag formats a root or leaf hash as a strong entity tag.
+func etag(hash []byte) string {
+	return fmt.Sprintf("%q", hex.EncodeToString(hash))
+}
+
+// parseRoot parses the optional hex root a client computed for an upload.
+// Without one it returns nil, and the server does not compare roots.
+func parseRoot(root string) ([]byte, error) {
+	if root == "" {
+		return nil, nil
+	}
+
+	return hex.DecodeString(root)
+}
+
+// parseIfMatch extracts the expected root from an If-Match header value.
+func parseIfMatch(header string) string {
+	header = strings.TrimSpace(header)
+	if header == fileservice.AnyRoot {
+		return header
+	}
+
+	return strings.Trim(strings.TrimPrefix(header, "W/"), `"`)
+}
+
+// UploadResponse reports the stored version with the root the server
+// computed, so clients can compare it with their own.
 type UploadResponse struct {
-	Key string `json:"key"`
+	Key           string `json:"key"`
+	Version       int    `json:"version"`
+	Root          string `json:"root"`
+	LeafCount     int    `json:"leafCount"`
+	HashAlgorithm string `json:"hashAlgorithm"`
 }
 
 type ProofResponse struct {
-	Proof []string
+	Proof   []string
+	Version int `json:"version"`
+	Index   int `json:"index"`
 }
 
+type ManifestResponse struct {
+	Key           string                 `json:"key"`
+	Version       int                    `json:"version"`
+	Root          string                 `json:"root"`
+	LeafCount     int                    `json:"leafCount"`
+	HashAlgorithm string                 `json:"hashAlgorithm"`
+	Created       time.Time              `json:"created"`
+	Owner         string                 `json:"owner,omitempty"`
+	Expires       *time.Time             `json:"expires,omitempty"`
+	LegalHold     bool                   `json:"legalHold"`
+	Encrypted     bool                   `json:"encrypted"`
+	Files         []ManifestFileResponse `json:"files"`
+}
+
+type ManifestFileResponse struct {
+	Index       int       `json:"index"`
+	Name        string    `json:"name"`
+	Size        int64     `json:"size"`
+	LeafHash    string    `json:"leafHash"`
+	ContentType string    `json:"contentType"`
+	Uploaded    time.Time `json:"uploaded"`
+	Deleted     bool      `json:"deleted"`
+}
+
+type VersionsResponse struct {
+	Key      string            `json:"key"`
+	Versions []VersionResponse `json:"versions"`
+}
+
+type VersionResponse struct {
+	Version int       `json:"version"`
+	Root    string    `json:"root"`
+	Created time.Time `json:"created"`
+}
+
+const (
+	gcInterval     = 10 * time.Minute
+	reaperInterval = time.Minute
+)
+
 func main() {
-	http.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		uploadFilesHandler(w, r)
-	})
-	http.HandleFunc("/files", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-			return
-		}
-		getFileHandler(w, r)
+	cfg, err := config.Load(os.Args[1:], os.Getenv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatalf("Invalid configuration: %v", err)
+	}
+
+	level, _ := cfg.Level()
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	err = run(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run serves the API until SIGINT or SIGTERM and then shuts down gracefully.
+func run(cfg *config.Config) error {
+	tlsConfig, err := cfg.TLSConfig()
+	if err != nil {
+		return err
+	}
+
+	shareSecret, err := newShareSecret(cfg.ShareSecret)
+	if err != nil {
+		return err
+	}
+
+	masterKey, previousMasterKeys, err := cfg.MasterKeys()
+	if err != nil {
+		return err
+	}
+
+	quota := fileservice.Quota{
+		MaxBytes:       cfg.QuotaBytes,
+		MaxSets:        int(cfg.QuotaSets),
+		MaxFilesPerSet: int(cfg.QuotaFilesPerSet),
+	}
+
+	files, err := fileservice.NewFileService(fileservice.Options{
+		DataDir:            cfg.DataDir,
+		DefaultTTL:         time.Duration(cfg.DefaultTTL),
+		MasterKey:          masterKey,
+		PreviousMasterKeys: previousMasterKeys,
+		Quota:              quota,
 	})
-	http.HandleFunc("/proof", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodGet {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	if err != nil {
+		return err
+	}
+
+	s := &server{
+		files:           files,
+		maxUploadSize:   cfg.MaxUploadSize,
+		maxUploadMemory: cfg.MaxUploadMemory,
+		adminToken:      cfg.AdminToken,
+		requireAuth:     cfg.RequireAuth,
+		shareSecret:     shareSecret,
+		quota:           quota,
+		corsOrigins:     cfg.CORSOrigins,
+	}
+	if cfg.RateLimit > 0 {
+		s.limiter = newRateLimiter(cfg.RateLimit, int(cfg.RateBurst))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var background sync.WaitGroup
+	background.Add(2)
+	go func() {
+		defer background.Done()
+		files.RunGarbageCollector(ctx, gcInterval)
+	}()
+	go func() {
+		defer background.Done()
+		files.RunReaper(ctx, reaperInterval)
+	}()
+
+	httpServer := &http.Server{
+		Addr:              cfg.ListenAddr,
+		TLSConfig:         tlsConfig,
+		Handler:           s.routes(),
+		ReadHeaderTimeout: time.Duration(cfg.ReadHeaderTimeout),
+		ReadTimeout:       time.Duration(cfg.ReadTimeout),
+		WriteTimeout:      time.Duration(cfg.WriteTimeout),
+		IdleTimeout:       time.Duration(cfg.IdleTimeout),
+	}
+
+	served := make(chan error, 1)
+	go func() {
+		slog.Info("listening", "addr", cfg.ListenAddr, "tls", cfg.TLS(), "clientAuth", cfg.TLSClientAuth, "requireAuth", cfg.RequireAuth, "encryption", masterKey != nil, "rateLimit", cfg.RateLimit, "corsOrigins", cfg.CORSOrigins, "dataDir", cfg.DataDir)
+
+		if tlsConfig != nil {
+			// The certificates are already loaded into the TLS config.
+			served <- httpServer.ListenAndServeTLS("", "")
 			return
 		}
-		getProofHandler(w, r)
-	})
-	http.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("pong"))
-	})
+		served <- httpServer.ListenAndServe()
+	}()
+
+	select {
+	case err = <-served:
+	case <-ctx.Done():
+		slog.Info("shutting down", "timeout", time.Duration(cfg.ShutdownTimeout))
+		err = s.shutdown(httpServer, time.Duration(cfg.ShutdownTimeout))
+	}
+
+	stop()
+	background.Wait()
+
+	cleanupErr := files.CleanupTemp()
+	if cleanupErr != nil {
+		cleanupErr = fmt.Errorf("cleaning up partial writes: %w", cleanupErr)
+	}
 
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	return errors.Join(err, cleanupErr, files.Close())
 }
@@ -0,0 +1,581 @@
+package metastore
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"slices"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const FileName = "_meta.db"
+
+var (
+	ErrSetNotFound     = errors.New("set not found")
+	ErrVersionNotFound = errors.New("version not found")
+	ErrFileNotFound    = errors.New("file not found")
+	ErrAPIKeyNotFound  = errors.New("API key not found")
+)
+
+var (
+	setsBucket     = []byte("sets")
+	versionsBucket = []byte("versions")
+	namesBucket    = []byte("names")
+	setKey         = []byte("set")
+	apiKeysBucket  = []byte("apiKeys")
+	usageBucket    = []byte("usage")
+)
+
+// MetaStore indexes the sets, versions and files kept by the file store in
+// an embedded database.
+type MetaStore struct {
+	db *bolt.DB
+}
+
+// Set is the metadata of a set that is shared by all its versions.
+type Set struct {
+	Key        string      `json:"key"`
+	Created    time.Time   `json:"created"`
+	Owner      string      `json:"owner,omitempty"`
+	Expires    *time.Time  `json:"expires,omitempty"`
+	LegalHold  bool        `json:"legalHold,omitempty"`
+	Deleted    *time.Time  `json:"deleted,omitempty"`
+	Tombstones []Tombstone `json:"tombstones,omitempty"`
+	// Account is who the set is charged to for quotas, see
+	// fileservice.Quota.
+	Account string `json:"account,omitempty"`
+	// Size is the size of the content referenced by live files of the set,
+	// counting content shared by files once. It is kept up to date when the
+	// set is stored.
+	Size int64 `json:"size,omitempty"`
+	// DataKey is the key the content of the set is encrypted with, wrapped
+	// by a master key. Sets without one are stored in plaintext.
+	DataKey []byte `json:"dataKey,omitempty"`
+}
+
+// Tombstone marks the file at Index of version Version as deleted from a set.
+type Tombstone struct {
+	Version int       `json:"version"`
+	Index   int       `json:"index"`
+	Deleted time.Time `json:"deleted"`
+}
+
+// Version is the manifest of one immutable state of a set.
+type Version struct {
+	Number  int       `json:"number"`
+	Root    []byte    `json:"root"`
+	Created time.Time `json:"created"`
+	Files   []File    `json:"files"`
+}
+
+// File is a file of a version, stored in the blob named by its leaf hash.
+type File struct {
+	Index       int       `json:"index"`
+	Name        string    `json:"name"`
+	Hash        []byte    `json:"hash"`
+	Size        int64     `json:"size"`
+	ContentType string    `json:"contentType"`
+	Uploaded    time.Time `json:"uploaded"`
+}
+
+// APIKey is a key clients authenticate with. Only the hash of the token is
+// stored.
+type APIKey struct {
+	ID      string    `json:"id"`
+	Hash    []byte    `json:"hash"`
+	Owner   string    `json:"owner"`
+	Admin   bool      `json:"admin,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// Usage is what an account stores in the sets charged to it.
+type Usage struct {
+	Bytes int64 `json:"bytes"`
+	Sets  int   `json:"sets"`
+}
+
+// IsExpired reports whether the retention of the set ran out. Sets under
+// legal hold never expire.
+func (s *Set) IsExpired(now time.Time) bool {
+	return !s.LegalHold && s.Expires != nil && !now.Before(*s.Expires)
+}
+
+// IsTombstoned reports whether the file at index was deleted from the
+// version with the given number. Other files with the same content are not
+// affected.
+func (s *Set) IsTombstoned(version int, index int) bool {
+	return slices.ContainsFunc(s.Tombstones, func(t Tombstone) bool {
+		return t.Version == version && t.Index == index
+	})
+}
+
+// Content returns the size of every piece of content that is referenced by
+// a live file of versions of the set, by hex leaf hash.
+func (s *Set) Content(versions []Version) map[string]int64 {
+	content := make(map[string]int64)
+	for _, version := range versions {
+		for _, file := range version.Files {
+			if !s.IsTombstoned(version.Number, file.Index) {
+				content[hex.EncodeToString(file.Hash)] = file.Size
+			}
+		}
+	}
+
+	return content
+}
+
+// Open opens the metadata database at path, creating it if needed.
+func Open(path string) (*MetaStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(setsBucket)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(apiKeysBucket)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.CreateBucketIfNotExists(usageBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &MetaStore{db: db}, nil
+}
+
+func (m *MetaStore) Close() error {
+	return m.db.Close()
+}
+
+// GetSet returns the metadata of key.
+func (m *MetaStore) GetSet(key string) (*Set, error) {
+	set := &Set{}
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		bucket := setBucket(tx, key)
+		if bucket == nil {
+			return ErrSetNotFound
+		}
+
+		return json.Unmarshal(bucket.Get(setKey), set)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return set, nil
+}
+
+// PutSet updates the metadata of an existing set and its size.
+func (m *MetaStore) PutSet(set *Set) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		bucket := setBucket(tx, set.Key)
+		if bucket == nil {
+			return ErrSetNotFound
+		}
+
+		return putSet(tx, bucket, set)
+	})
+}
+
+// DeleteSet removes key and all its versions from the index.
+func (m *MetaStore) DeleteSet(key string) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		if bucket := setBucket(tx, key); bucket != nil {
+			old, err := getSet(bucket)
+			if err != nil {
+				return err
+			}
+
+			err = chargeUsage(tx, old, -1)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := tx.Bucket(setsBucket).DeleteBucket([]byte(key))
+		if errors.Is(err, bolt.ErrBucketNotFound) {
+			return nil
+		}
+
+		return err
+	})
+}
+
+// ListSets returns the keys of all indexed sets, including deleted ones.
+func (m *MetaStore) ListSets() ([]string, error) {
+	keys := make([]string, 0)
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(setsBucket).ForEachBucket(func(k []byte) error {
+			keys = append(keys, string(k))
+			return nil
+		})
+	})
+
+	return keys, err
+}
+
+// PutVersion stores set together with a new version of it in one
+// transaction and indexes the files of the version by name.
+func (m *MetaStore) PutVersion(set *Set, version *Version) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := createSetBucket(tx, set.Key)
+		if err != nil {
+			return err
+		}
+
+		err = putJSON(bucket.Bucket(versionsBucket), itob(version.Number), version)
+		if err != nil {
+			return err
+		}
+
+		names := bucket.Bucket(namesBucket)
+		for _, file := range version.Files {
+			err := names.Put(nameKey(version.Number, file.Name), itob(file.Index))
+			if err != nil {
+				return err
+			}
+		}
+
+		return putSet(tx, bucket, set)
+	})
+}
+
+// GetVersion returns the given version of key.
+func (m *MetaStore) GetVersion(key string, number int) (*Version, error) {
+	version := &Version{}
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		bucket := setBucket(tx, key)
+		if bucket == nil {
+			return ErrSetNotFound
+		}
+
+		content := bucket.Bucket(versionsBucket).Get(itob(number))
+		if content == nil {
+			return ErrVersionNotFound
+		}
+
+		return json.Unmarshal(content, version)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return version, nil
+}
+
+// GetLatestVersion returns the most recent version of key.
+func (m *MetaStore) GetLatestVersion(key string) (*Version, error) {
+	version := &Version{}
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		bucket := setBucket(tx, key)
+		if bucket == nil {
+			return ErrSetNotFound
+		}
+
+		_, content := bucket.Bucket(versionsBucket).Cursor().Last()
+		if content == nil {
+			return ErrVersionNotFound
+		}
+
+		return json.Unmarshal(content, version)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return version, nil
+}
+
+// ListVersions returns all versions of key, oldest first.
+func (m *MetaStore) ListVersions(key string) ([]Version, error) {
+	versions := make([]Version, 0)
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		bucket := setBucket(tx, key)
+		if bucket == nil {
+			return ErrSetNotFound
+		}
+
+		var err error
+		versions, err = getVersions(bucket)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return versions, nil
+}
+
+// FindFile returns the index of the file called name in the given version of key.
+func (m *MetaStore) FindFile(key string, number int, name string) (int, error) {
+	index := 0
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		bucket := setBucket(tx, key)
+		if bucket == nil {
+			return ErrSetNotFound
+		}
+
+		content := bucket.Bucket(namesBucket).Get(nameKey(number, name))
+		if content == nil {
+			return ErrFileNotFound
+		}
+
+		index = btoi(content)
+		return nil
+	})
+
+	return index, err
+}
+
+// GetUsage returns what account stores in the sets charged to it that are
+// not deleted. Sets that expired count until they are deleted.
+func (m *MetaStore) GetUsage(account string) (Usage, error) {
+	usage := Usage{}
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		content := tx.Bucket(usageBucket).Get([]byte(account))
+		if content == nil {
+			return nil
+		}
+
+		return json.Unmarshal(content, &usage)
+	})
+
+	return usage, err
+}
+
+// PutAPIKey stores key under the hash of its token.
+func (m *MetaStore) PutAPIKey(key *APIKey) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(apiKeysBucket), key.Hash, key)
+	})
+}
+
+// GetAPIKey returns the key whose token has the given hash.
+func (m *MetaStore) GetAPIKey(hash []byte) (*APIKey, error) {
+	key := &APIKey{}
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		content := tx.Bucket(apiKeysBucket).Get(hash)
+		if content == nil {
+			return ErrAPIKeyNotFound
+		}
+
+		return json.Unmarshal(content, key)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// ListAPIKeys returns all keys.
+func (m *MetaStore) ListAPIKeys() ([]APIKey, error) {
+	keys := make([]APIKey, 0)
+
+	err := m.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(apiKeysBucket).ForEach(func(k, v []byte) error {
+			key := APIKey{}
+			err := json.Unmarshal(v, &key)
+			if err != nil {
+				return err
+			}
+
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// DeleteAPIKey removes the key with the given ID.
+func (m *MetaStore) DeleteAPIKey(id string) error {
+	return m.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(apiKeysBucket)
+
+		// Keys are indexed by the hash of their token, and there are few
+		// enough of them to look the ID up by scanning.
+		cursor := bucket.Cursor()
+		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
+			key := APIKey{}
+			err := json.Unmarshal(v, &key)
+			if err != nil {
+				return err
+			}
+
+			if key.ID == id {
+				return cursor.Delete()
+			}
+		}
+
+		return ErrAPIKeyNotFound
+	})
+}
+
+// putSet stores set in its bucket with the size of its content, and moves
+// the charge of the previous record to the new one.
+func putSet(tx *bolt.Tx, bucket *bolt.Bucket, set *Set) error {
+	old, err := getSet(bucket)
+	if err != nil {
+		return err
+	}
+
+	err = chargeUsage(tx, old, -1)
+	if err != nil {
+		return err
+	}
+
+	err = sizeSet(bucket, set)
+	if err != nil {
+		return err
+	}
+
+	err = chargeUsage(tx, set, 1)
+	if err != nil {
+		return err
+	}
+
+	return putJSON(bucket, setKey, set)
+}
+
+// getSet returns the record in bucket, or nil for a set that was not stored
+// yet.
+func getSet(bucket *bolt.Bucket) (*Set, error) {
+	content := bucket.Get(setKey)
+	if content == nil {
+		return nil, nil
+	}
+
+	set := &Set{}
+	return set, json.Unmarshal(content, set)
+}
+
+func getVersions(bucket *bolt.Bucket) ([]Version, error) {
+	versions := make([]Version, 0)
+
+	err := bucket.Bucket(versionsBucket).ForEach(func(k, v []byte) error {
+		version := Version{}
+		err := json.Unmarshal(v, &version)
+		if err != nil {
+			return err
+		}
+
+		versions = append(versions, version)
+		return nil
+	})
+
+	return versions, err
+}
+
+// sizeSet sets the size of set from the versions in its bucket.
+func sizeSet(bucket *bolt.Bucket, set *Set) error {
+	versions, err := getVersions(bucket)
+	if err != nil {
+		return err
+	}
+
+	set.Size = 0
+	for _, size := range set.Content(versions) {
+		set.Size += size
+	}
+
+	return nil
+}
+
+// chargeUsage adds set to the usage of its account, or removes it when sign
+// is -1. Deleted sets are not charged.
+func chargeUsage(tx *bolt.Tx, set *Set, sign int) error {
+	if set == nil || set.Deleted != nil || set.Account == "" {
+		return nil
+	}
+
+	bucket := tx.Bucket(usageBucket)
+	account := []byte(set.Account)
+
+	usage := Usage{}
+	if content := bucket.Get(account); content != nil {
+		err := json.Unmarshal(content, &usage)
+		if err != nil {
+			return err
+		}
+	}
+
+	usage.Bytes += int64(sign) * set.Size
+	usage.Sets += sign
+	if usage == (Usage{}) {
+		return bucket.Delete(account)
+	}
+
+	return putJSON(bucket, account, usage)
+}
+
+func setBucket(tx *bolt.Tx, key string) *bolt.Bucket {
+	return tx.Bucket(setsBucket).Bucket([]byte(key))
+}
+
+func createSetBucket(tx *bolt.Tx, key string) (*bolt.Bucket, error) {
+	bucket, err := tx.Bucket(setsBucket).CreateBucketIfNotExists([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = bucket.CreateBucketIfNotExists(versionsBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = bucket.CreateBucketIfNotExists(namesBucket)
+	if err != nil {
+		return nil, err
+	}
+
+	return bucket, nil
+}
+
+func putJSON(bucket *bolt.Bucket, key []byte, value any) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+
+	return bucket.Put(key, content)
+}
+
+// itob encodes n so that keys sort in numeric order.
+func itob(n int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(n))
+	return b
+}
+
+func btoi(b []byte) int {
+	return int(binary.BigEndian.Uint64(b))
+}
+
+func nameKey(number int, name string) []byte {
+	return append(itob(number), name...)
+}
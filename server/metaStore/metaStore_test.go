@@ -0,0 +1,215 @@
+package metastore
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVersions(t *testing.T) {
+	meta := newTestMetaStore(t)
+	set := &Set{Key: "set", Created: time.Now()}
+
+	// Numbers are encoded so that 10 sorts after 9.
+	for number := 1; number <= 10; number++ {
+		err := meta.PutVersion(set, &Version{Number: number, Root: []byte{byte(number)}})
+		if err != nil {
+			t.Fatalf("Error putting version %v: %v", number, err)
+		}
+	}
+
+	latest, err := meta.GetLatestVersion("set")
+	if err != nil || latest.Number != 10 {
+		t.Fatalf("Expected version 10 to be the latest, got %+v (%v)", latest, err)
+	}
+
+	versions, err := meta.ListVersions("set")
+	if err != nil || len(versions) != 10 {
+		t.Fatalf("Expected 10 versions, got %v (%v)", len(versions), err)
+	}
+	for i, version := range versions {
+		if version.Number != i+1 {
+			t.Fatalf("Expected versions in order, got %v at %v", version.Number, i)
+		}
+	}
+
+	_, err = meta.GetVersion("set", 11)
+	if !errors.Is(err, ErrVersionNotFound) {
+		t.Fatalf("Expected a missing version, got %v", err)
+	}
+
+	err = meta.DeleteSet("set")
+	if err != nil {
+		t.Fatalf("Error deleting set: %v", err)
+	}
+
+	_, err = meta.GetLatestVersion("set")
+	if !errors.Is(err, ErrSetNotFound) {
+		t.Fatalf("Expected the set to be gone, got %v", err)
+	}
+
+	// A set created again under the key starts over without the old versions.
+	err = meta.PutVersion(set, &Version{Number: 1})
+	if err != nil {
+		t.Fatalf("Error putting version: %v", err)
+	}
+
+	versions, err = meta.ListVersions("set")
+	if err != nil || len(versions) != 1 {
+		t.Fatalf("Expected only the new version, got %v (%v)", versions, err)
+	}
+
+	err = meta.DeleteSet("missing")
+	if err != nil {
+		t.Fatalf("Expected deleting a missing set to succeed, got %v", err)
+	}
+}
+
+func TestFindFile(t *testing.T) {
+	meta := newTestMetaStore(t)
+	set := &Set{Key: "set"}
+
+	versions := []*Version{
+		{Number: 1, Files: []File{{Index: 0, Name: "a"}, {Index: 1, Name: "ab"}}},
+		{Number: 2, Files: []File{{Index: 0, Name: "ab"}, {Index: 1, Name: "a"}}},
+		// Names are only found in their own version, even where the
+		// numbers share bytes.
+		{Number: 256, Files: []File{{Index: 0, Name: "b"}, {Index: 1, Name: "a"}}},
+	}
+	for _, version := range versions {
+		err := meta.PutVersion(set, version)
+		if err != nil {
+			t.Fatalf("Error putting version: %v", err)
+		}
+	}
+
+	for _, version := range versions {
+		for _, file := range version.Files {
+			index, err := meta.FindFile("set", version.Number, file.Name)
+			if err != nil || index != file.Index {
+				t.Fatalf("Expected %v of version %v at %v, got %v (%v)", file.Name, version.Number, file.Index, index, err)
+			}
+		}
+	}
+
+	for _, missing := range []struct {
+		number int
+		name   string
+	}{{1, "b"}, {1, ""}, {3, "a"}, {0, "a"}} {
+		_, err := meta.FindFile("set", missing.number, missing.name)
+		if !errors.Is(err, ErrFileNotFound) {
+			t.Fatalf("Expected %q of version %v to be missing, got %v", missing.name, missing.number, err)
+		}
+	}
+
+	_, err := meta.FindFile("missing", 1, "a")
+	if !errors.Is(err, ErrSetNotFound) {
+		t.Fatalf("Expected a missing set, got %v", err)
+	}
+}
+
+func TestIsExpired(t *testing.T) {
+	now := time.Now()
+	past, future := now.Add(-time.Hour), now.Add(time.Hour)
+
+	tests := []struct {
+		name    string
+		set     Set
+		expired bool
+	}{
+		{"forever", Set{}, false},
+		{"expired", Set{Expires: &past}, true},
+		{"expires now", Set{Expires: &now}, true},
+		{"not yet", Set{Expires: &future}, false},
+		{"legal hold", Set{Expires: &past, LegalHold: true}, false},
+	}
+	for _, test := range tests {
+		if test.set.IsExpired(now) != test.expired {
+			t.Errorf("%v: expected expired to be %v", test.name, test.expired)
+		}
+	}
+}
+
+func TestIsTombstoned(t *testing.T) {
+	set := Set{Tombstones: []Tombstone{{Version: 2, Index: 1}}}
+
+	tests := []struct {
+		version int
+		index   int
+		deleted bool
+	}{
+		{2, 1, true},
+		{2, 0, false},
+		{1, 1, false},
+	}
+	for _, test := range tests {
+		if set.IsTombstoned(test.version, test.index) != test.deleted {
+			t.Errorf("Expected file %v of version %v to be deleted: %v", test.index, test.version, test.deleted)
+		}
+	}
+}
+
+func TestUsage(t *testing.T) {
+	meta := newTestMetaStore(t)
+
+	verifyUsage := func(expected Usage) {
+		t.Helper()
+		usage, err := meta.GetUsage("alice")
+		if err != nil || usage != expected {
+			t.Fatalf("Expected %+v, got %+v (%v)", expected, usage, err)
+		}
+	}
+
+	// Content shared by files is counted once, and sets without an account
+	// are not charged to anyone.
+	first := &Set{Key: "first", Account: "alice"}
+	second := &Set{Key: "second", Owner: "bob", Account: "alice"}
+	third := &Set{Key: "third", Owner: "alice"}
+	files := []File{{Index: 0, Hash: []byte("a"), Size: 3}, {Index: 1, Hash: []byte("b"), Size: 5}}
+	for _, set := range []*Set{first, second, third} {
+		err := meta.PutVersion(set, &Version{Number: 1, Files: files})
+		if err != nil {
+			t.Fatalf("Error putting version: %v", err)
+		}
+	}
+	err := meta.PutVersion(first, &Version{Number: 2, Files: files[:1]})
+	if err != nil {
+		t.Fatalf("Error putting version: %v", err)
+	}
+	verifyUsage(Usage{Bytes: 16, Sets: 2})
+
+	second.Tombstones = []Tombstone{{Version: 1, Index: 1}}
+	err = meta.PutSet(second)
+	if err != nil || second.Size != 3 {
+		t.Fatalf("Expected the deleted file not to count, got %v (%v)", second.Size, err)
+	}
+	verifyUsage(Usage{Bytes: 11, Sets: 2})
+
+	now := time.Now()
+	first.Deleted = &now
+	err = meta.PutSet(first)
+	if err != nil {
+		t.Fatalf("Error putting set: %v", err)
+	}
+	verifyUsage(Usage{Bytes: 3, Sets: 1})
+
+	err = meta.DeleteSet("first")
+	if err == nil {
+		err = meta.DeleteSet("second")
+	}
+	if err != nil {
+		t.Fatalf("Error deleting sets: %v", err)
+	}
+	verifyUsage(Usage{})
+}
+
+func newTestMetaStore(t *testing.T) *MetaStore {
+	meta, err := Open(filepath.Join(t.TempDir(), FileName))
+	if err != nil {
+		t.Fatalf("Error opening meta store: %v", err)
+	}
+	t.Cleanup(func() { meta.Close() })
+
+	return meta
+}
@@ -0,0 +1,150 @@
+// Package names validates the keys of sets and the names of files, and
+// encodes keys into directory names that are safe on any file system.
+//
+// Clients always see the original keys and names; only the store uses the
+// encoded form.
+package names
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+var (
+	ErrInvalidKey  = errors.New("invalid key")
+	ErrInvalidName = errors.New("invalid file name")
+)
+
+const (
+	// MaxKeyLength is the maximum length of a key in bytes. Encoding can
+	// triple the length, which keeps encoded keys below the 255 bytes most
+	// file systems allow for a name.
+	MaxKeyLength = 80
+	// MaxNameLength is the maximum length of a file name in bytes.
+	MaxNameLength = 255
+)
+
+// reserved are the names the server uses for its own data. Files must not be
+// called like them, in any case, so they are never mistaken for it.
+var reserved = []string{"_merkleTree.json", "_meta.db"}
+
+// ValidateKey checks that key can name a set. Keys are single path segments
+// of printable Unicode.
+func ValidateKey(key string) error {
+	if len(key) > MaxKeyLength {
+		return fmt.Errorf("%w: longer than %v bytes", ErrInvalidKey, MaxKeyLength)
+	}
+
+	err := validate(key)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidKey, err)
+	}
+
+	return nil
+}
+
+// ValidateFileName checks that name can name a file of a set. Names are
+// base names of printable Unicode that are not reserved.
+func ValidateFileName(name string) error {
+	if len(name) > MaxNameLength {
+		return fmt.Errorf("%w: longer than %v bytes", ErrInvalidName, MaxNameLength)
+	}
+
+	err := validate(name)
+	if err != nil {
+		return fmt.Errorf("%w %q: %v", ErrInvalidName, name, err)
+	}
+
+	for _, r := range reserved {
+		if strings.EqualFold(name, r) {
+			return fmt.Errorf("%w %q: reserved", ErrInvalidName, name)
+		}
+	}
+
+	return nil
+}
+
+func validate(name string) error {
+	switch {
+	case name == "":
+		return errors.New("empty")
+	case name == "." || name == "..":
+		return errors.New("relative path")
+	case !utf8.ValidString(name):
+		return errors.New("not UTF-8")
+	case strings.ContainsAny(name, `/\`):
+		return errors.New("contains a path separator")
+	case strings.IndexFunc(name, isControl) >= 0:
+		return errors.New("contains a control character")
+	}
+
+	return nil
+}
+
+func isControl(r rune) bool {
+	return unicode.IsControl(r) || unicode.Is(unicode.Cf, r)
+}
+
+// Encode returns the name key is stored under on disk. Lower case letters,
+// digits, hyphens and dots after the first byte are kept, every other byte
+// is written as _ and two hex digits. The result is unique even on case
+// insensitive file systems and never collides with the reserved names.
+func Encode(key string) string {
+	var encoded strings.Builder
+
+	for i := 0; i < len(key); i++ {
+		b := key[i]
+		if isPlain(b) || b == '.' && i > 0 {
+			encoded.WriteByte(b)
+			continue
+		}
+
+		fmt.Fprintf(&encoded, "_%02x", b)
+	}
+
+	return encoded.String()
+}
+
+// Decode returns the key that was encoded to name. It fails for names that
+// Encode does not produce.
+func Decode(name string) (string, error) {
+	var key strings.Builder
+
+	for i := 0; i < len(name); i++ {
+		b := name[i]
+		switch {
+		case isPlain(b) || b == '.' && i > 0:
+			key.WriteByte(b)
+		case b == '_' && i+2 < len(name) && isLowerHex(name[i+1]) && isLowerHex(name[i+2]):
+			key.WriteByte(unhex(name[i+1])<<4 | unhex(name[i+2]))
+			i += 2
+		default:
+			return "", fmt.Errorf("%q is not an encoded key", name)
+		}
+	}
+
+	if Encode(key.String()) != name {
+		return "", fmt.Errorf("%q is not an encoded key", name)
+	}
+
+	return key.String(), nil
+}
+
+func isPlain(b byte) bool {
+	return 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || b == '-'
+}
+
+func isLowerHex(b byte) bool {
+	return '0' <= b && b <= '9' || 'a' <= b && b <= 'f'
+}
+
+func unhex(b byte) byte {
+	if b <= '9' {
+		return b - '0'
+	}
+
+	return b - 'a' + 10
+}
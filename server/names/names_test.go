@@ -0,0 +1,82 @@
+package names_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	filestore "github.com/vitaliy/file-storage/server/fileStore"
+	metastore "github.com/vitaliy/file-storage/server/metaStore"
+	"github.com/vitaliy/file-storage/server/names"
+)
+
+func TestValidateKey(t *testing.T) {
+	valid := []string{"528137f4-ada0-4a5c-a05d-b1cd5a055bc2", "Reports 2024", "отчёт", "_meta.db", strings.Repeat("k", names.MaxKeyLength)}
+	for _, key := range valid {
+		err := names.ValidateKey(key)
+		if err != nil {
+			t.Errorf("Expected %q to be valid, got %v", key, err)
+		}
+	}
+
+	invalid := []string{"", ".", "..", "../files", `a\b`, "a\x00b", "a‮b", "\xff", strings.Repeat("k", names.MaxKeyLength+1)}
+	for _, key := range invalid {
+		err := names.ValidateKey(key)
+		if !errors.Is(err, names.ErrInvalidKey) {
+			t.Errorf("Expected %q to be invalid, got %v", key, err)
+		}
+	}
+}
+
+func TestValidateFileName(t *testing.T) {
+	valid := []string{"test1", ".env", "résumé.pdf", "日本語.txt", "_config.yml"}
+	for _, name := range valid {
+		err := names.ValidateFileName(name)
+		if err != nil {
+			t.Errorf("Expected %q to be valid, got %v", name, err)
+		}
+	}
+
+	// Internal names are reserved in every case.
+	invalid := []string{"", "..", "a/b", "a\nb", filestore.MerkleTreeFileName, strings.ToUpper(metastore.FileName)}
+	for _, name := range invalid {
+		err := names.ValidateFileName(name)
+		if !errors.Is(err, names.ErrInvalidName) {
+			t.Errorf("Expected %q to be invalid, got %v", name, err)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	tests := []struct {
+		key     string
+		encoded string
+	}{
+		{"528137f4-ada0-4a5c-a05d-b1cd5a055bc2", "528137f4-ada0-4a5c-a05d-b1cd5a055bc2"},
+		{"Key", "_4bey"},
+		{"key", "key"},
+		{".hidden", "_2ehidden"},
+		{"a.b c", "a.b_20c"},
+		{"_meta.db", "_5fmeta.db"},
+		{"ключ", "_d0_ba_d0_bb_d1_8e_d1_87"},
+	}
+
+	for _, test := range tests {
+		encoded := names.Encode(test.key)
+		if encoded != test.encoded {
+			t.Errorf("Expected %q to encode to %q, got %q", test.key, test.encoded, encoded)
+		}
+
+		decoded, err := names.Decode(encoded)
+		if err != nil || decoded != test.key {
+			t.Errorf("Expected %q to decode to %q, got %q (%v)", encoded, test.key, decoded, err)
+		}
+	}
+
+	for _, name := range []string{"Key", "_4", "_4B", ".hidden", "_6b", metastore.FileName} {
+		_, err := names.Decode(name)
+		if err == nil {
+			t.Errorf("Expected %q not to decode", name)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+
+	fileservice "github.com/vitaliy/file-storage/server/fileService"
+)
+
+type openAPIDocument struct {
+	OpenAPI    string                                `json:"openapi"`
+	Paths      map[string]map[string]json.RawMessage `json:"paths"`
+	Components struct {
+		Responses map[string]openAPIResponse `json:"responses"`
+		Schemas   map[string]openAPISchema   `json:"schemas"`
+	} `json:"components"`
+}
+
+type openAPIOperation struct {
+	RequestBody json.RawMessage            `json:"requestBody"`
+	Responses   map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPIResponse struct {
+	Ref     string `json:"$ref"`
+	Content map[string]struct {
+		Schema openAPISchema `json:"schema"`
+	} `json:"content"`
+}
+
+type openAPISchema struct {
+	Ref      string   `json:"$ref"`
+	Required []string `json:"required"`
+}
+
+var openAPIMethods = []string{"get", "put", "post", "delete", "patch", "head", "options"}
+
+func TestOpenAPIReferences(t *testing.T) {
+	var document any
+	err := json.Unmarshal(openAPISpec, &document)
+	if err != nil {
+		t.Fatalf("Error parsing openapi.json: %v", err)
+	}
+
+	var check func(node any)
+	check = func(node any) {
+		switch node := node.(type) {
+		case map[string]any:
+			if ref, ok := node["$ref"].(string); ok && resolvePointer(document, ref) == nil {
+				t.Errorf("Reference %v does not resolve", ref)
+			}
+			for _, child := range node {
+				check(child)
+			}
+		case []any:
+			for _, child := range node {
+				check(child)
+			}
+		}
+	}
+	check(document)
+}
+
+func TestOpenAPIMatchesRoutes(t *testing.T) {
+	spec := parseOpenAPI(t)
+
+	documented := make([]string, 0)
+	for path, operations := range spec.Paths {
+		for method := range operations {
+			if slices.Contains(openAPIMethods, method) {
+				documented = append(documented, strings.ToUpper(method)+" "+path)
+			}
+		}
+	}
+
+	routed := make([]string, 0)
+	for _, route := range (&server{}).apiRoutes() {
+		routed = append(routed, route.pattern)
+	}
+
+	slices.Sort(documented)
+	slices.Sort(routed)
+
+	if !slices.Equal(documented, routed) {
+		t.Fatalf("Routes do not match the specification\nrouted:     %v\ndocumented: %v", routed, documented)
+	}
+}
+
+// TestOpenAPIResponses calls every documented operation on an existing and
+// on a missing set and checks that the live response is documented and
+// carries the documented JSON schema.
+func TestOpenAPIResponses(t *testing.T) {
+	spec := parseOpenAPI(t)
+	ts := newTestServer(t, 1<<20)
+
+	for path, operations := range spec.Paths {
+		for method, content := range operations {
+			if !slices.Contains(openAPIMethods, method) {
+				continue
+			}
+
+			var operation openAPIOperation
+			err := json.Unmarshal(content, &operation)
+			if err != nil {
+				t.Fatalf("Error parsing %v %v: %v", method, path, err)
+			}
+
+			for _, existing := range []bool{true, false} {
+				name := strings.ToUpper(method) + " " + path + " existing=" + strconv.FormatBool(existing)
+				t.Run(name, func(t *testing.T) {
+					key := "missing"
+					if existing {
+						resp := upload(t, http.MethodPost, ts.URL+"/v1/sets", "", map[string]string{"test1": "test1", "test2": "test2"})
+						var uploadResponse UploadResponse
+						json.NewDecoder(resp.Body).Decode(&uploadResponse)
+						key = uploadResponse.Key
+					}
+
+					url := ts.URL + strings.NewReplacer("{key}", key, "{n}", "1", "{name}", "test2").Replace(path)
+
+					var resp *http.Response
+					if operation.RequestBody != nil {
+						resp = upload(t, strings.ToUpper(method), url, fileservice.AnyRoot, map[string]string{"test3": "test3"})
+					} else {
+						req, err := http.NewRequest(strings.ToUpper(method), url, nil)
+						if err != nil {
+							t.Fatalf("Error creating request: %v", err)
+						}
+						resp, err = http.DefaultClient.Do(req)
+						if err != nil {
+							t.Fatalf("Error sending request: %v", err)
+						}
+						defer resp.Body.Close()
+					}
+
+					response, ok := operation.Responses[strconv.Itoa(resp.StatusCode)]
+					if !ok {
+						t.Fatalf("Status %v is not documented", resp.Status)
+					}
+					if response.Ref != "" {
+						response = spec.Components.Responses[strings.TrimPrefix(response.Ref, "#/components/responses/")]
+					}
+
+					mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+					if mediaType == "" || len(response.Content) == 0 {
+						return
+					}
+
+					schema, ok := response.Content[mediaType]
+					if !ok {
+						if _, ok := response.Content["application/octet-stream"]; ok {
+							return
+						}
+						t.Fatalf("Content type %v is not documented", mediaType)
+					}
+					if schema.Schema.Ref == "" {
+						return
+					}
+
+					body, err := io.ReadAll(resp.Body)
+					if err != nil {
+						t.Fatalf("Error reading response: %v", err)
+					}
+
+					var fields map[string]any
+					err = json.Unmarshal(body, &fields)
+					if err != nil {
+						t.Fatalf("Response is not a JSON object: %v", err)
+					}
+
+					required := spec.Components.Schemas[strings.TrimPrefix(schema.Schema.Ref, "#/components/schemas/")].Required
+					for _, field := range required {
+						if _, ok := fields[field]; !ok {
+							t.Errorf("Response lacks required field %v: %s", field, body)
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+func parseOpenAPI(t *testing.T) openAPIDocument {
+	var spec openAPIDocument
+	err := json.Unmarshal(openAPISpec, &spec)
+	if err != nil {
+		t.Fatalf("Error parsing openapi.json: %v", err)
+	}
+
+	if !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Fatalf("Expected an OpenAPI 3 document, got %v", spec.OpenAPI)
+	}
+
+	return spec
+}
+
+// resolvePointer resolves a local JSON pointer such as #/components/schemas/X.
+func resolvePointer(document any, ref string) any {
+	if !strings.HasPrefix(ref, "#/") {
+		return nil
+	}
+
+	node := document
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		object, ok := node.(map[string]any)
+		if !ok {
+			return nil
+		}
+		node = object[part]
+	}
+
+	return node
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+)
+
+// route is an endpoint of the API, registered under a method pattern.
+type route struct {
+	pattern string
+	handler http.HandlerFunc
+}
+
+// apiRoutes lists every endpoint of the versioned API. Files are addressed
+// by leaf index under files/ and by name under names/; reads take an
+// optional version query parameter and default to the latest version. Set
+// handlers authorize the caller against the owner of the set, API keys, the
+// master key and the audit log are managed by admins. Share links under
+// shared/ are authorized by their signature instead. Usage reports the
+// quotas of the caller. Every route is described in openapi.json.
+func (s *server) apiRoutes() []route {
+	return []route{
+		{"POST /v1/sets", s.uploadFilesHandler},
+		{"PUT /v1/sets/{key}", s.uploadFilesHandler},
+		{"GET /v1/sets/{key}", s.getManifestHandler},
+		{"DELETE /v1/sets/{key}", s.deleteSetHandler},
+		{"GET /v1/sets/{key}/versions", s.getVersionsHandler},
+		{"GET /v1/sets/{key}/archive", s.getArchiveHandler},
+		{"PUT /v1/sets/{key}/hold", s.legalHoldHandler},
+		{"DELETE /v1/sets/{key}/hold", s.legalHoldHandler},
+
+		{"GET /v1/sets/{key}/files/{n}", s.getFileHandler},
+		{"DELETE /v1/sets/{key}/files/{n}", s.deleteFileHandler},
+		{"GET /v1/sets/{key}/files/{n}/proof", s.getProofHandler},
+		{"GET /v1/sets/{key}/names/{name}", s.getFileHandler},
+		{"DELETE /v1/sets/{key}/names/{name}", s.deleteFileHandler},
+		{"GET /v1/sets/{key}/names/{name}/proof", s.getProofHandler},
+		{"POST /v1/sets/{key}/challenge", s.challengeHandler},
+		{"POST /v1/sets/{key}/files/{n}/share", s.createShareHandler},
+		{"POST /v1/sets/{key}/names/{name}/share", s.createShareHandler},
+		{"GET /v1/shared/{key}/{version}/{n}", s.getSharedFileHandler},
+
+		{"POST /v1/keys", s.createAPIKeyHandler},
+		{"GET /v1/keys", s.listAPIKeysHandler},
+		{"DELETE /v1/keys/{id}", s.revokeAPIKeyHandler},
+		{"POST /v1/admin/master-key/rotate", s.rotateMasterKeyHandler},
+		{"GET /v1/admin/audit", s.exportAuditLogHandler},
+		{"GET /v1/admin/audit/verify", s.verifyAuditLogHandler},
+		{"GET /v1/usage", s.getUsageHandler},
+
+		{"GET /v1/openapi.json", openAPIHandler},
+		{"GET /ping", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("pong"))
+		}},
+	}
+}
+
+// routes returns the handler of the API, which limits the request rate of
+// every identity before credentials are checked. The browser UI is served
+// under /ui/ next to the API and is not part of it.
+func (s *server) routes() http.Handler {
+	mux := http.NewServeMux()
+	for _, route := range s.apiRoutes() {
+		mux.HandleFunc(route.pattern, route.handler)
+	}
+	mux.Handle("GET /ui/", http.StripPrefix("/ui", uiHandler()))
+	mux.Handle("GET /{$}", http.RedirectHandler("/ui/", http.StatusFound))
+
+	return s.cors(s.limitRate(s.authenticate(logRequests(jsonErrors(mux)))))
+}
+
+// jsonErrors answers requests that match no route, or no method of a route,
+// with an ErrorResponse instead of the plain text of the mux.
+func jsonErrors(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handler, pattern := mux.Handler(r)
+		if pattern != "" {
+			mux.ServeHTTP(w, r)
+			return
+		}
+
+		// The mux only answers with 405 when another method of the path is
+		// routed, and then sets Allow.
+		recorder := &headerRecorder{header: make(http.Header)}
+		handler.ServeHTTP(recorder, r)
+
+		if recorder.status != http.StatusMethodNotAllowed {
+			writeError(w, errRouteNotFound)
+			return
+		}
+
+		w.Header().Set("Allow", recorder.header.Get("Allow"))
+		writeError(w, errMethodNotAllowed)
+	})
+}
+
+// headerRecorder keeps the headers and status of a response and drops its body.
+type headerRecorder struct {
+	header http.Header
+	status int
+}
+
+func (h *headerRecorder) Header() http.Header {
+	return h.header
+}
+
+func (h *headerRecorder) Write(b []byte) (int, error) {
+	if h.status == 0 {
+		h.status = http.StatusOK
+	}
+
+	return len(b), nil
+}
+
+func (h *headerRecorder) WriteHeader(status int) {
+	h.status = status
+}
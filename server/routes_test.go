@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	merkleTree "github.com/vitaliy/file-storage/common/merkleTree"
+	fileservice "github.com/vitaliy/file-storage/server/fileService"
+)
+
+func TestRoutes(t *testing.T) {
+	ts := newTestServer(t, 1<<20)
+
+	resp := upload(t, http.MethodPost, ts.URL+"/v1/sets", "", map[string]string{"test1": "test1", "test2": "test2"})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected 201, got %v", resp.Status)
+	}
+
+	var uploadResponse UploadResponse
+	err := json.NewDecoder(resp.Body).Decode(&uploadResponse)
+	if err != nil {
+		t.Fatalf("Error decoding upload response: %v", err)
+	}
+	if resp.Header.Get("Location") != "/v1/sets/"+uploadResponse.Key {
+		t.Fatalf("Unexpected location %v", resp.Header.Get("Location"))
+	}
+
+	root := testRoot(t, "test1", "test2")
+	if uploadResponse.Root != root || uploadResponse.LeafCount != 2 || uploadResponse.HashAlgorithm != merkleTree.HashAlgorithm {
+		t.Fatalf("Expected root %v of 2 leaves, got %+v", root, uploadResponse)
+	}
+
+	set := ts.URL + "/v1/sets/" + uploadResponse.Key
+
+	resp = get(t, set+"/files/1")
+	content, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(content) != "test2" {
+		t.Fatalf("Expected file test2, got %v %q", resp.Status, content)
+	}
+
+	resp = get(t, set+"/names/test2/proof")
+	var proofResponse ProofResponse
+	err = json.NewDecoder(resp.Body).Decode(&proofResponse)
+	if err != nil || proofResponse.Index != 1 {
+		t.Fatalf("Expected proof of file 1, got %+v (%v)", proofResponse, err)
+	}
+
+	req := newUploadRequest(t, http.MethodPut, set, fileservice.AnyRoot, map[string]string{"test3": "test3"})
+	req.Header.Set("X-Merkle-Root", testRoot(t, "test3"))
+	resp = do(t, req)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200, got %v", resp.Status)
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		status int
+		code   string
+	}{
+		{"missing set", http.MethodGet, ts.URL + "/v1/sets/missing", http.StatusNotFound, "set_not_found"},
+		{"missing version", http.MethodGet, set + "?version=9", http.StatusNotFound, "version_not_found"},
+		{"invalid version", http.MethodGet, set + "?version=x", http.StatusBadRequest, "invalid_version"},
+		{"invalid file", http.MethodGet, set + "/files/x", http.StatusBadRequest, "invalid_file"},
+		{"missing file", http.MethodGet, set + "/files/9", http.StatusNotFound, "file_not_found"},
+		{"missing name", http.MethodGet, set + "/names/missing", http.StatusNotFound, "file_not_found"},
+		{"invalid format", http.MethodGet, set + "/archive?format=rar", http.StatusBadRequest, "invalid_format"},
+		{"unknown route", http.MethodGet, ts.URL + "/upload", http.StatusNotFound, "route_not_found"},
+		{"wrong method", http.MethodPatch, set, http.StatusMethodNotAllowed, "method_not_allowed"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req, err := http.NewRequest(test.method, test.url, nil)
+			if err != nil {
+				t.Fatalf("Error creating request: %v", err)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatalf("Error sending request: %v", err)
+			}
+			defer resp.Body.Close()
+
+			verifyError(t, resp, test.status, test.code)
+		})
+	}
+}
+
+func TestRoutesDownload(t *testing.T) {
+	content := "0123456789"
+	hash, _ := merkleTree.GetHashFromBytes([]byte(content))
+	leafETag := `"` + hex.EncodeToString(hash) + `"`
+
+	tests := []struct {
+		name    string
+		method  string
+		header  map[string]string
+		status  int
+		body    string
+		headers map[string]string
+	}{
+		{"full", http.MethodGet, nil, http.StatusOK, content, map[string]string{"ETag": leafETag, "Accept-Ranges": "bytes"}},
+		{"range", http.MethodGet, map[string]string{"Range": "bytes=2-5"}, http.StatusPartialContent, "2345", map[string]string{"ETag": leafETag, "Content-Range": "bytes 2-5/10"}},
+		{"suffix range", http.MethodGet, map[string]string{"Range": "bytes=-3"}, http.StatusPartialContent, "789", map[string]string{"Content-Range": "bytes 7-9/10"}},
+		{"matching etag", http.MethodGet, map[string]string{"If-None-Match": leafETag}, http.StatusNotModified, "", map[string]string{"ETag": leafETag}},
+		{"other etag", http.MethodGet, map[string]string{"If-None-Match": `"other"`}, http.StatusOK, content, map[string]string{"ETag": leafETag}},
+		{"head", http.MethodHead, nil, http.StatusOK, "", map[string]string{"ETag": leafETag, "Content-Length": "10"}},
+		{"head with matching etag", http.MethodHead, map[string]string{"If-None-Match": leafETag}, http.StatusNotModified, "", map[string]string{"ETag": leafETag}},
+	}
+
+	for _, masterKey := range [][]byte{nil, bytes.Repeat([]byte{1}, 32)} {
+		s := newTestAPI(t, 1<<20)
+		if masterKey != nil {
+			files, err := fileservice.NewFileService(fileservice.Options{DataDir: t.TempDir(), MasterKey: masterKey})
+			if err != nil {
+				t.Fatalf("Error creating file service: %v", err)
+			}
+			t.Cleanup(func() { files.Close() })
+			s.files = files
+		}
+		ts := httptest.NewServer(s.routes())
+		t.Cleanup(ts.Close)
+
+		resp := upload(t, http.MethodPut, ts.URL+"/v1/sets/download", "", map[string]string{"test1": content})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Error uploading file: %v", resp.Status)
+		}
+
+		for _, test := range tests {
+			t.Run(fmt.Sprintf("%v encrypted %v", test.name, masterKey != nil), func(t *testing.T) {
+				req, err := http.NewRequest(test.method, ts.URL+"/v1/sets/download/files/0", nil)
+				if err != nil {
+					t.Fatalf("Error creating request: %v", err)
+				}
+				for name, value := range test.header {
+					req.Header.Set(name, value)
+				}
+
+				resp := do(t, req)
+				body, _ := io.ReadAll(resp.Body)
+				if resp.StatusCode != test.status || string(body) != test.body {
+					t.Fatalf("Expected %v %q, got %v %q", test.status, test.body, resp.Status, body)
+				}
+
+				for name, value := range test.headers {
+					if resp.Header.Get(name) != value {
+						t.Fatalf("Expected %v %v, got %v", name, value, resp.Header.Get(name))
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestRoutesUploadErrors(t *testing.T) {
+	s := newTestAPI(t, 1<<10)
+	s.adminToken = testAdminToken
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+
+	resp := upload(t, http.MethodPost, ts.URL+"/v1/sets", "", map[string]string{"large": strings.Repeat("x", 2<<10)})
+	verifyError(t, resp, http.StatusRequestEntityTooLarge, "upload_too_large")
+
+	resp = upload(t, http.MethodPost, ts.URL+"/v1/sets", "", map[string]string{})
+	verifyError(t, resp, http.StatusBadRequest, "no_files")
+
+	resp = upload(t, http.MethodPut, ts.URL+"/v1/sets/..%2F..%2Fescape", "", map[string]string{"test1": "test1"})
+	verifyError(t, resp, http.StatusBadRequest, "invalid_key")
+
+	resp = upload(t, http.MethodPost, ts.URL+"/v1/sets", "", map[string]string{"_merkleTree.json": "{}"})
+	verifyError(t, resp, http.StatusBadRequest, "invalid_file_name")
+
+	req := newUploadRequest(t, http.MethodPost, ts.URL+"/v1/sets", "", map[string]string{"test1": "test1"})
+	req.Header.Set("X-Merkle-Root", testRoot(t, "other"))
+	verifyError(t, do(t, req), http.StatusConflict, "root_mismatch")
+
+	req = newUploadRequest(t, http.MethodPost, ts.URL+"/v1/sets", "", map[string]string{"test1": "test1"})
+	req.Header.Set("X-Merkle-Root", "not hex")
+	verifyError(t, do(t, req), http.StatusBadRequest, "invalid_root")
+
+	resp = upload(t, http.MethodPut, ts.URL+"/v1/sets/held", "", map[string]string{"test1": "test1"})
+	resp.Body.Close()
+
+	// Only admins may place and release legal holds.
+	verifyError(t, do(t, newRequest(t, http.MethodPut, ts.URL+"/v1/sets/held/hold", "")), http.StatusUnauthorized, "unauthorized")
+
+	resp = do(t, newRequest(t, http.MethodPut, ts.URL+"/v1/sets/held/hold", testAdminToken))
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Error placing legal hold: %v", resp.Status)
+	}
+
+	verifyError(t, do(t, newRequest(t, http.MethodDelete, ts.URL+"/v1/sets/held/hold", "")), http.StatusUnauthorized, "unauthorized")
+
+	req, _ = http.NewRequest(http.MethodDelete, ts.URL+"/v1/sets/held", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error deleting set: %v", err)
+	}
+	verifyError(t, resp, http.StatusConflict, "legal_hold")
+}
+
+// testRoot returns the hex root of files with the given contents.
+func testRoot(t *testing.T, contents ...string) string {
+	hashes := make([][]byte, 0, len(contents))
+	for _, content := range contents {
+		hash, _ := merkleTree.GetHashFromBytes([]byte(content))
+		hashes = append(hashes, hash)
+	}
+
+	root, err := merkleTree.GetMerkleRoot(hashes)
+	if err != nil {
+		t.Fatalf("Error computing root: %v", err)
+	}
+
+	return hex.EncodeToString(root)
+}
+
+// newTestServer serves the API from a service that stores into a temporary
+// directory.
+func newTestServer(t *testing.T, maxUploadSize int64) *httptest.Server {
+	ts := httptest.NewServer(newTestAPI(t, maxUploadSize).routes())
+	t.Cleanup(ts.Close)
+
+	return ts
+}
+
+func newTestAPI(t *testing.T, maxUploadSize int64) *server {
+	files, err := fileservice.NewFileService(fileservice.Options{DataDir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("Error creating file service: %v", err)
+	}
+	t.Cleanup(func() { files.Close() })
+
+	return &server{files: files, maxUploadSize: maxUploadSize, maxUploadMemory: 10 << 20, shareSecret: []byte("test-share-secret")}
+}
+
+func upload(t *testing.T, method string, url string, ifMatch string, files map[string]string) *http.Response {
+	return do(t, newUploadRequest(t, method, url, ifMatch, files))
+}
+
+func newUploadRequest(t *testing.T, method string, url string, ifMatch string, files map[string]string) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	for name, content := range files {
+		part, err := writer.CreateFormFile("files", name)
+		if err != nil {
+			t.Fatalf("Error creating form file: %v", err)
+		}
+		part.Write([]byte(content))
+	}
+	writer.Close()
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+
+	return req
+}
+
+func do(t *testing.T, req *http.Request) *http.Response {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error sending %v %v: %v", req.Method, req.URL, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
+
+func get(t *testing.T, url string) *http.Response {
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Error getting %v: %v", url, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	return resp
+}
+
+func verifyError(t *testing.T, resp *http.Response, status int, code string) {
+	t.Helper()
+
+	if resp.StatusCode != status {
+		t.Fatalf("Expected status %d, got %v", status, resp.Status)
+	}
+
+	if resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("Expected a JSON error, got %v", resp.Header.Get("Content-Type"))
+	}
+
+	var errorResponse ErrorResponse
+	err := json.NewDecoder(resp.Body).Decode(&errorResponse)
+	if err != nil {
+		t.Fatalf("Error decoding error response: %v", err)
+	}
+
+	if errorResponse.Code != code {
+		t.Fatalf("Expected code %v, got %v (%v)", code, errorResponse.Code, errorResponse.Message)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// defaultShareTTL is how long a share link is valid when the request
+	// does not say.
+	defaultShareTTL = 24 * time.Hour
+	// maxShareTTL limits how long a share link can be valid.
+	maxShareTTL = 7 * 24 * time.Hour
+)
+
+// ShareResponse describes a share link. Path is relative to the server and
+// carries the signature, so anyone holding it can download the file.
+type ShareResponse struct {
+	Path    string    `json:"path"`
+	Key     string    `json:"key"`
+	Version int       `json:"version"`
+	Index   int       `json:"index"`
+	Name    string    `json:"name"`
+	Root    string    `json:"root"`
+	Expires time.Time `json:"expires"`
+}
+
+// newShareSecret returns the configured secret share links are signed
+// with. Without one a random secret is used, and links stop working when the
+// server restarts.
+func newShareSecret(configured string) ([]byte, error) {
+	if configured != "" {
+		return []byte(configured), nil
+	}
+
+	slog.Warn("no share secret configured, share links will not survive a restart")
+
+	secret := make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// shareSignature signs a link to the file with the given index in a version
+// of key that is valid until expires. The version and its root are fixed so
+// the file and its proof cannot change while the link is valid, not even when
+// the set is deleted and created again under the same key.
+func (s *server) shareSignature(key string, version int, index int, root []byte, expires int64) string {
+	mac := hmac.New(sha256.New, s.shareSecret)
+	fmt.Fprintf(mac, "%q %d %d %x %d", key, version, index, root, expires)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// createShareHandler signs a link that grants download of one file of a set
+// together with its proof until the link expires.
+func (s *server) createShareHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	err := s.authorize(r, key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ttl, err := parseTTL(r.URL.Query().Get("ttl"))
+	if err != nil || ttl > maxShareTTL {
+		writeError(w, errInvalidTTL)
+		return
+	}
+	if ttl == 0 {
+		ttl = defaultShareTTL
+	}
+
+	versionInt, numberInt, err := s.resolveFile(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// Opening the file checks that it exists and was not deleted, so links
+	// are only handed out for files that can be downloaded.
+	download, err := s.files.As(actor(r)).OpenFile(key, versionInt, numberInt, false)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	download.Content.Close()
+
+	expires := time.Now().Add(ttl).Truncate(time.Second).UTC()
+	version := download.Version.Number
+
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	query.Set("root", hex.EncodeToString(download.Version.Root))
+	query.Set("signature", s.shareSignature(key, version, numberInt, download.Version.Root, expires.Unix()))
+
+	writeJSON(w, http.StatusOK, ShareResponse{
+		Path:    fmt.Sprintf("/v1/shared/%v/%d/%d?%v", url.PathEscape(key), version, numberInt, query.Encode()),
+		Key:     key,
+		Version: version,
+		Index:   numberInt,
+		Name:    download.File.Name,
+		Root:    hex.EncodeToString(download.Version.Root),
+		Expires: expires,
+	})
+}
+
+// getSharedFileHandler serves the file of a share link with its proof. The
+// link is validated from its signature alone, so it needs no credentials.
+func (s *server) getSharedFileHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+
+	version, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil || version <= 0 {
+		writeError(w, errInvalidVersion)
+		return
+	}
+
+	number, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil || number < 0 {
+		writeError(w, errInvalidFile)
+		return
+	}
+
+	expires, err := strconv.ParseInt(r.URL.Query().Get("expires"), 10, 64)
+	if err != nil {
+		writeError(w, errInvalidShareLink)
+		return
+	}
+
+	root, err := hex.DecodeString(r.URL.Query().Get("root"))
+	if err != nil {
+		writeError(w, errInvalidShareLink)
+		return
+	}
+
+	signature, err := hex.DecodeString(r.URL.Query().Get("signature"))
+	expected, _ := hex.DecodeString(s.shareSignature(key, version, number, root, expires))
+	if err != nil || !hmac.Equal(signature, expected) {
+		writeError(w, errInvalidShareLink)
+		return
+	}
+
+	if time.Now().Unix() >= expires {
+		writeError(w, errShareLinkExpired)
+		return
+	}
+
+	download, err := s.files.As(actor(r)).OpenFile(key, version, number, true)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer download.Content.Close()
+
+	// A set deleted and uploaded again starts over at version 1, so the
+	// version alone does not identify the shared file.
+	if !bytes.Equal(download.Version.Root, root) {
+		writeError(w, errShareLinkGone)
+		return
+	}
+
+	// Links are valid for their whole lifetime, so shared caches must not
+	// keep serving the file once it expired.
+	w.Header().Set("Cache-Control", "private, no-store")
+
+	serveDownload(w, r, download, number, true)
+}
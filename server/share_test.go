@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/vitaliy/file-storage/common/merkleTree"
+)
+
+func TestShareLinks(t *testing.T) {
+	s := newTestAPI(t, 1<<20)
+	s.adminToken = testAdminToken
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+
+	alice := createAPIKey(t, ts.URL, testAdminToken, "alice")
+
+	req := newUploadRequest(t, http.MethodPost, ts.URL+"/v1/sets", "", map[string]string{"test1": "test1", "test2": "test2"})
+	req.Header.Set("Authorization", "Bearer "+alice.Token)
+	var uploadResponse UploadResponse
+	json.NewDecoder(do(t, req).Body).Decode(&uploadResponse)
+	set := ts.URL + "/v1/sets/" + uploadResponse.Key
+
+	resp := do(t, newRequest(t, http.MethodPost, set+"/names/test2/share?ttl=1h", ""))
+	verifyError(t, resp, http.StatusUnauthorized, "unauthorized")
+
+	resp = do(t, newRequest(t, http.MethodPost, set+"/names/test2/share?ttl=1h", alice.Token))
+	var share ShareResponse
+	err := json.NewDecoder(resp.Body).Decode(&share)
+	if err != nil || share.Index != 1 || share.Version != 1 {
+		t.Fatalf("Expected a link to file 1 of version 1, got %+v (%v)", share, err)
+	}
+
+	// The link works without credentials and carries the proof.
+	resp = get(t, ts.URL+share.Path)
+	content, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(content) != "test2" {
+		t.Fatalf("Expected file test2, got %v %q", resp.Status, content)
+	}
+
+	proof := make([][]byte, 0)
+	for _, hash := range strings.Split(resp.Header.Get("X-Merkle-Proof"), ",") {
+		decoded, _ := hex.DecodeString(hash)
+		proof = append(proof, decoded)
+	}
+	root, _ := hex.DecodeString(share.Root)
+	leaf, _ := merkleTree.GetHashFromBytes(content)
+	ok, err := merkleTree.VerifyProof(root, share.Index, leaf, proof)
+	if err != nil || !ok {
+		t.Fatalf("Expected the shared file to verify against %v (%v)", share.Root, err)
+	}
+
+	expired := time.Now().Add(-time.Minute).Unix()
+	signature := s.shareSignature(uploadResponse.Key, 1, 1, root, expired)
+
+	tests := []struct {
+		name   string
+		url    string
+		status int
+		code   string
+	}{
+		{"other file", strings.Replace(share.Path, "/1/1?", "/1/0?", 1), http.StatusForbidden, "invalid_share_link"},
+		{"other root", strings.Replace(share.Path, "root=", "root=00", 1), http.StatusForbidden, "invalid_share_link"},
+		{"tampered expiry", strings.Replace(share.Path, "expires=", "expires=9", 1), http.StatusForbidden, "invalid_share_link"},
+		{"missing signature", strings.Split(share.Path, "&")[0], http.StatusForbidden, "invalid_share_link"},
+		{"expired", "/v1/shared/" + uploadResponse.Key + "/1/1?expires=" + strconv.FormatInt(expired, 10) + "&root=" + share.Root + "&signature=" + signature, http.StatusForbidden, "share_link_expired"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifyError(t, get(t, ts.URL+test.url), test.status, test.code)
+		})
+	}
+
+	resp = do(t, newRequest(t, http.MethodPost, set+"/files/0/share?ttl=720h", alice.Token))
+	verifyError(t, resp, http.StatusBadRequest, "invalid_ttl")
+
+	resp = do(t, newRequest(t, http.MethodDelete, set+"/files/1", alice.Token))
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %v", resp.Status)
+	}
+
+	verifyError(t, get(t, ts.URL+share.Path), http.StatusGone, "file_deleted")
+
+	resp = do(t, newRequest(t, http.MethodPost, set+"/names/test1/share?ttl=1h", alice.Token))
+	json.NewDecoder(resp.Body).Decode(&share)
+
+	// A set created again under the key starts over at version 1, the link
+	// must not serve the file that now has the index.
+	resp = do(t, newRequest(t, http.MethodDelete, set, alice.Token))
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204, got %v", resp.Status)
+	}
+
+	req = newUploadRequest(t, http.MethodPut, set, "", map[string]string{"test1": "other"})
+	req.Header.Set("Authorization", "Bearer "+alice.Token)
+	resp = do(t, req)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected the set to be created again, got %v", resp.Status)
+	}
+
+	verifyError(t, get(t, ts.URL+share.Path), http.StatusGone, "share_link_gone")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// retryAfterShutdown is how many seconds clients are told to wait before
+// retrying an upload rejected during shutdown.
+const retryAfterShutdown = "30"
+
+// uploadTracker counts in-flight uploads and refuses new ones once closed.
+type uploadTracker struct {
+	mu     sync.Mutex
+	closed bool
+	count  int
+	active sync.WaitGroup
+}
+
+// begin registers an upload and reports whether it may proceed. Every
+// successful begin must be followed by end.
+func (u *uploadTracker) begin() bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.closed {
+		return false
+	}
+
+	u.count++
+	u.active.Add(1)
+	return true
+}
+
+func (u *uploadTracker) end() {
+	u.mu.Lock()
+	u.count--
+	u.mu.Unlock()
+
+	u.active.Done()
+}
+
+// inFlight returns the number of uploads that have not ended yet.
+func (u *uploadTracker) inFlight() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.count
+}
+
+// close refuses all further uploads.
+func (u *uploadTracker) close() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.closed = true
+}
+
+// wait blocks until every registered upload ended.
+func (u *uploadTracker) wait() {
+	u.active.Wait()
+}
+
+// shutdown stops accepting uploads and connections, then gives in-flight
+// requests up to timeout to finish before cutting them off.
+func (s *server) shutdown(httpServer *http.Server, timeout time.Duration) error {
+	s.uploads.close()
+	slog.Info("draining uploads", "uploads", s.uploads.inFlight())
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	err := httpServer.Shutdown(ctx)
+	if errors.Is(err, context.DeadlineExceeded) {
+		slog.Warn("in-flight requests did not finish in time, closing connections", "timeout", timeout)
+		err = httpServer.Close()
+	}
+
+	// Closing connections does not wait for their handlers, and uploads must
+	// stop writing before partial writes are cleaned up.
+	s.uploads.wait()
+
+	return err
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestShutdownRejectsUploads(t *testing.T) {
+	s := newTestAPI(t, 1<<20)
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+
+	s.uploads.close()
+
+	resp := upload(t, http.MethodPost, ts.URL+"/v1/sets", "", map[string]string{"test1": "test1"})
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("Expected Retry-After to be set")
+	}
+	verifyError(t, resp, http.StatusServiceUnavailable, "shutting_down")
+
+	resp = get(t, ts.URL+"/ping")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected reads to be served while draining, got %v", resp.Status)
+	}
+}
+
+func TestShutdownDrainsUploads(t *testing.T) {
+	s := newTestAPI(t, 1<<20)
+	ts := httptest.NewServer(s.routes())
+	t.Cleanup(ts.Close)
+
+	// An upload whose body never completes is in flight until shutdown
+	// cuts it off.
+	body, writer := io.Pipe()
+	t.Cleanup(func() { writer.Close() })
+
+	req, err := http.NewRequest(http.MethodPost, ts.URL+"/v1/sets", body)
+	if err != nil {
+		t.Fatalf("Error creating request: %v", err)
+	}
+	req.Header.Set("Content-Type", "multipart/form-data; boundary=x")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	writer.Write([]byte("--x\r\nContent-Disposition: form-data; name=\"files\"; filename=\"test1\"\r\n\r\npartial"))
+
+	for s.uploads.inFlight() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	err = s.shutdown(ts.Config, 50*time.Millisecond)
+	if err != nil {
+		t.Fatalf("Error shutting down: %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("Shutdown took %v", elapsed)
+	}
+
+	if s.uploads.begin() {
+		t.Fatalf("Expected uploads to be refused after shutdown")
+	}
+
+	writer.Close()
+	<-done
+}
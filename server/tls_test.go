@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/vitaliy/file-storage/server/config"
+)
+
+func TestMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCertificate(t, dir, "ca", nil)
+	newTestCertificate(t, dir, "server", ca)
+	newTestCertificate(t, dir, "alice", ca)
+
+	for _, clientAuth := range []string{"optional", "require"} {
+		t.Run(clientAuth, func(t *testing.T) {
+			cfg, err := config.Load([]string{
+				"-data-dir", t.TempDir(),
+				"-tls-cert", filepath.Join(dir, "server.pem"),
+				"-tls-key", filepath.Join(dir, "server-key.pem"),
+				"-tls-client-ca", filepath.Join(dir, "ca.pem"),
+				"-tls-client-auth", clientAuth,
+			}, func(string) string { return "" })
+			if err != nil {
+				t.Fatalf("Error loading configuration: %v", err)
+			}
+
+			tlsConfig, err := cfg.TLSConfig()
+			if err != nil {
+				t.Fatalf("Error loading TLS configuration: %v", err)
+			}
+
+			ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(clientIdentity(r)))
+			}))
+			ts.TLS = tlsConfig
+			ts.StartTLS()
+			t.Cleanup(ts.Close)
+
+			roots := x509.NewCertPool()
+			roots.AddCert(ca.Leaf)
+
+			alice, err := tls.LoadX509KeyPair(filepath.Join(dir, "alice.pem"), filepath.Join(dir, "alice-key.pem"))
+			if err != nil {
+				t.Fatalf("Error loading client certificate: %v", err)
+			}
+
+			identity, err := getIdentity(ts.URL, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{alice}})
+			if err != nil || identity != "cert:alice" {
+				t.Fatalf("Expected identity cert:alice, got %q (%v)", identity, err)
+			}
+
+			identity, err = getIdentity(ts.URL, &tls.Config{RootCAs: roots})
+			if clientAuth == "require" && err == nil {
+				t.Fatalf("Expected clients without certificate to be rejected")
+			}
+			if clientAuth == "optional" && (err != nil || identity != "") {
+				t.Fatalf("Expected an anonymous request, got %q (%v)", identity, err)
+			}
+		})
+	}
+}
+
+func getIdentity(url string, tlsConfig *tls.Config) (string, error) {
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	identity, err := io.ReadAll(resp.Body)
+	return string(identity), err
+}
+
+// newTestCertificate writes <name>.pem and <name>-key.pem into dir. The
+// certificate is a CA when parent is nil and is signed by parent otherwise.
+func newTestCertificate(t *testing.T, dir string, name string, parent *tls.Certificate) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	signer, signerKey := template, any(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %v", err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshalling key: %v", err)
+	}
+
+	err = os.WriteFile(filepath.Join(dir, name+".pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatalf("Error writing certificate: %v", err)
+	}
+	err = os.WriteFile(filepath.Join(dir, name+"-key.pem"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatalf("Error writing key: %v", err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("Error parsing certificate: %v", err)
+	}
+
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
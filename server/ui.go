@@ -0,0 +1,36 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// uiFiles is the browser UI, a static page that calls the API and verifies
+// every file it downloads against a root it keeps in the browser.
+//
+//go:embed ui
+var uiFiles embed.FS
+
+// uiContentSecurityPolicy only loads the scripts of the UI itself. The API
+// may be on another origin, see cors.
+const uiContentSecurityPolicy = "default-src 'self'; connect-src *; frame-ancestors 'none'; base-uri 'none'; form-action 'none'"
+
+// uiHandler serves the files of the UI relative to its root.
+func uiHandler() http.Handler {
+	files, err := fs.Sub(uiFiles, "ui")
+	if err != nil {
+		panic(err)
+	}
+	fileServer := http.FileServerFS(files)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Security-Policy", uiContentSecurityPolicy)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Referrer-Policy", "no-referrer")
+		// Embedded files have no modification time, so browsers must ask
+		// again to notice a new release.
+		w.Header().Set("Cache-Control", "no-cache")
+		fileServer.ServeHTTP(w, r)
+	})
+}
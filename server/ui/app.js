@@ -0,0 +1,289 @@
+import { fromHex, hashAlgorithm, merkleRoot, sha256, sortFiles, toHex, verifyProof } from "./merkle.js";
+
+// The roots of the sets known to this browser are the trust anchor of every
+// verification. They are stored by key together with their version.
+const roots = {
+  all() {
+    return JSON.parse(localStorage.getItem("roots") ?? "{}");
+  },
+  get(key) {
+    return this.all()[key];
+  },
+  set(key, root, version) {
+    const all = this.all();
+    all[key] = { root, version };
+    localStorage.setItem("roots", JSON.stringify(all));
+  },
+  delete(key) {
+    const all = this.all();
+    delete all[key];
+    localStorage.setItem("roots", JSON.stringify(all));
+  },
+};
+
+const settings = document.getElementById("settings");
+const uploadForm = document.getElementById("upload");
+const openForm = document.getElementById("open");
+
+// api calls the API and throws the message of error responses.
+async function api(path, options = {}) {
+  const headers = new Headers(options.headers);
+  const apiKey = sessionStorage.getItem("apiKey");
+  if (apiKey) {
+    headers.set("Authorization", `Bearer ${apiKey}`);
+  }
+
+  const base = localStorage.getItem("apiUrl") || location.origin;
+  const resp = await fetch(new URL(path, base), { ...options, headers });
+  if (!resp.ok) {
+    const error = await resp.json().catch(() => ({ message: resp.statusText }));
+    throw new Error(error.code ? `${error.message} (${error.code})` : error.message);
+  }
+
+  return resp;
+}
+
+function setPath(key) {
+  return `/v1/sets/${encodeURIComponent(key)}`;
+}
+
+function showStatus(message, error = false) {
+  const status = document.getElementById("status");
+  status.textContent = message;
+  status.classList.toggle("error", error);
+  status.hidden = false;
+}
+
+// handle runs action on submit and reports its errors.
+function handle(form, action) {
+  form.addEventListener("submit", async (event) => {
+    event.preventDefault();
+    try {
+      await action(form);
+    } catch (err) {
+      showStatus(err.message, true);
+    }
+  });
+}
+
+function button(label, action) {
+  const b = document.createElement("button");
+  b.type = "button";
+  b.textContent = label;
+  b.addEventListener("click", async () => {
+    try {
+      await action();
+    } catch (err) {
+      showStatus(err.message, true);
+    }
+  });
+  return b;
+}
+
+function row(...cells) {
+  const tr = document.createElement("tr");
+  for (const cell of cells) {
+    const td = document.createElement("td");
+    td.append(cell);
+    tr.append(td);
+  }
+  return tr;
+}
+
+function code(text) {
+  const c = document.createElement("code");
+  c.textContent = text;
+  return c;
+}
+
+// upload uploads the files of a folder with the root computed here, which
+// the server checks before it stores them.
+async function upload(form) {
+  const files = sortFiles(Array.from(form.folder.files));
+  if (files.length === 0) {
+    throw new Error("The folder is empty");
+  }
+
+  const names = new Set();
+  for (const file of files) {
+    if (names.has(file.name)) {
+      throw new Error(`The folder has more than one file named ${file.name}`);
+    }
+    names.add(file.name);
+  }
+
+  showStatus(`Hashing ${files.length} files…`);
+  const leaves = [];
+  for (const file of files) {
+    leaves.push(await sha256(await file.arrayBuffer()));
+  }
+  const root = toHex(await merkleRoot(leaves));
+
+  const body = new FormData();
+  for (const file of files) {
+    body.append("files", file, file.name);
+  }
+  body.append("root", root);
+
+  const key = form.key.value.trim();
+  const headers = {};
+  const stored = key ? roots.get(key) : undefined;
+  if (stored) {
+    headers["If-Match"] = `"${stored.root}"`;
+  }
+
+  showStatus(`Uploading ${files.length} files…`);
+  const resp = await api(key ? setPath(key) : "/v1/sets", { method: key ? "PUT" : "POST", headers, body });
+  const uploaded = await resp.json();
+
+  if (uploaded.hashAlgorithm !== hashAlgorithm) {
+    throw new Error(`Unsupported hash algorithm ${uploaded.hashAlgorithm}`);
+  }
+  if (uploaded.root !== root || uploaded.leafCount !== files.length) {
+    throw new Error(`The server stored set ${uploaded.key} with root ${uploaded.root} of ${uploaded.leafCount} files, expected ${root} of ${files.length} files`);
+  }
+
+  roots.set(uploaded.key, root, uploaded.version);
+  form.reset();
+  renderSets();
+  await showSet(uploaded.key);
+  showStatus(`Uploaded ${files.length} files as version ${uploaded.version} of set ${uploaded.key} with root ${root}.`);
+}
+
+// open trusts a pasted root, or the root stored for the key, and shows the
+// version of the set with that root.
+async function open(form) {
+  const key = form.key.value.trim();
+  const root = form.root.value.trim().toLowerCase();
+
+  if (root) {
+    const resp = await api(`${setPath(key)}/versions`);
+    const { versions } = await resp.json();
+    const version = versions.find((v) => v.root === root);
+    if (!version) {
+      throw new Error(`No version of set ${key} has root ${root}`);
+    }
+    roots.set(key, root, version.version);
+    renderSets();
+  } else if (!roots.get(key)) {
+    throw new Error(`No root of set ${key} is stored in this browser, paste it`);
+  }
+
+  form.reset();
+  await showSet(key);
+}
+
+// verifyManifest checks that the leaf hashes of manifest add up to root, so
+// the server cannot change or hide files in the listing.
+async function verifyManifest(root, manifest) {
+  if (manifest.hashAlgorithm !== hashAlgorithm) {
+    throw new Error(`Unsupported hash algorithm ${manifest.hashAlgorithm}`);
+  }
+  if (manifest.leafCount !== manifest.files.length) {
+    throw new Error(`The manifest lists ${manifest.files.length} files but ${manifest.leafCount} leaves`);
+  }
+
+  const leaves = manifest.files.map((file, i) => {
+    if (file.index !== i) {
+      throw new Error(`Manifest file ${i} has index ${file.index}`);
+    }
+    return fromHex(file.leafHash);
+  });
+
+  if (toHex(await merkleRoot(leaves)) !== root) {
+    throw new Error(`The files of set ${manifest.key} do not match the stored root`);
+  }
+}
+
+async function showSet(key) {
+  const section = document.getElementById("set");
+  section.hidden = true;
+
+  const { root, version } = roots.get(key);
+  const resp = await api(`${setPath(key)}?version=${version}`);
+  const manifest = await resp.json();
+  await verifyManifest(root, manifest);
+
+  document.getElementById("set-key").textContent = key;
+  document.getElementById("set-info").replaceChildren(
+    `Version ${manifest.version} of ${new Date(manifest.created).toLocaleString()} with root `,
+    code(root),
+    manifest.expires ? `, expires ${new Date(manifest.expires).toLocaleString()}.` : ".",
+  );
+
+  const tbody = document.querySelector("#files tbody");
+  tbody.replaceChildren();
+  for (const file of manifest.files) {
+    const tr = row(
+      String(file.index),
+      file.name,
+      `${file.size} bytes`,
+      new Date(file.uploaded).toLocaleString(),
+      file.deleted ? "deleted" : button("Download", () => download(key, root, manifest.version, file)),
+    );
+    tr.classList.toggle("deleted", file.deleted);
+    tbody.append(tr);
+  }
+
+  section.hidden = false;
+}
+
+// download saves a file only after its proof verified against the root.
+async function download(key, root, version, file) {
+  showStatus(`Downloading ${file.name}…`);
+  const resp = await api(`${setPath(key)}/files/${file.index}?version=${version}&proof=true`);
+
+  const algorithm = resp.headers.get("X-Merkle-Hash-Algorithm");
+  if (algorithm !== hashAlgorithm) {
+    throw new Error(`Unsupported hash algorithm ${algorithm}`);
+  }
+  const proof = (resp.headers.get("X-Merkle-Proof") ?? "").split(",").filter((p) => p !== "").map(fromHex);
+
+  const content = await resp.blob();
+  const hash = await sha256(await content.arrayBuffer());
+  if (!(await verifyProof(fromHex(root), file.index, hash, proof))) {
+    throw new Error(`${file.name} does not match the root of set ${key} and was not saved`);
+  }
+
+  const a = document.createElement("a");
+  a.href = URL.createObjectURL(content);
+  a.download = file.name;
+  a.click();
+  setTimeout(() => URL.revokeObjectURL(a.href), 60_000);
+
+  showStatus(`${file.name} was verified against the root of set ${key} and saved.`);
+}
+
+function renderSets() {
+  const tbody = document.querySelector("#sets tbody");
+  tbody.replaceChildren();
+  for (const [key, { root, version }] of Object.entries(roots.all())) {
+    const actions = document.createElement("span");
+    actions.append(
+      button("Open", () => showSet(key)),
+      button("Forget", () => {
+        if (confirm(`Forget the root of set ${key}? Its files cannot be verified without it.`)) {
+          roots.delete(key);
+          renderSets();
+        }
+      }),
+    );
+    tbody.append(row(key, String(version), code(root), actions));
+  }
+}
+
+settings.apiUrl.value = localStorage.getItem("apiUrl") ?? "";
+settings.apiKey.value = sessionStorage.getItem("apiKey") ?? "";
+handle(settings, (form) => {
+  localStorage.setItem("apiUrl", form.apiUrl.value.trim());
+  sessionStorage.setItem("apiKey", form.apiKey.value.trim());
+  showStatus("Saved.");
+});
+handle(uploadForm, upload);
+handle(openForm, open);
+renderSets();
+
+// Hashing needs a secure context.
+if (!globalThis.crypto?.subtle) {
+  showStatus("Files cannot be verified over plain HTTP, open this page over HTTPS or on localhost.", true);
+}
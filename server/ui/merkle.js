@@ -0,0 +1,84 @@
+// The Merkle tree of common/merkleTree, so the browser verifies proofs
+// without trusting the server. Leaves are the SHA-256 hashes of whole files,
+// inner nodes hash the concatenation of their children, and the last node of
+// a level with an odd number of nodes is paired with itself.
+
+export const hashAlgorithm = "sha256";
+
+export async function sha256(data) {
+  return new Uint8Array(await crypto.subtle.digest("SHA-256", data));
+}
+
+export async function merkleRoot(leaves) {
+  if (leaves.length === 0) {
+    throw new Error("a tree needs at least one leaf");
+  }
+
+  let level = leaves;
+  while (level.length > 1) {
+    if (level.length % 2 === 1) {
+      level = [...level, level[level.length - 1]];
+    }
+
+    const next = [];
+    for (let i = 0; i < level.length; i += 2) {
+      next.push(await sha256(concat(level[i], level[i + 1])));
+    }
+    level = next;
+  }
+
+  return level[0];
+}
+
+// sortFiles returns files in the order of their leaves. The server sorts the
+// files of an upload by name, comparing the bytes of their UTF-8 encoding,
+// and only the names are sent, never the folders of the files.
+export function sortFiles(files) {
+  const encoder = new TextEncoder();
+  const keyed = files.map((file) => ({ file, name: encoder.encode(file.name) }));
+  keyed.sort((a, b) => compareBytes(a.name, b.name));
+  return keyed.map(({ file }) => file);
+}
+
+// verifyProof checks that hash is the leaf at index of the tree with root.
+// The proof lists the siblings from the leaf up to the root.
+export async function verifyProof(root, index, hash, proof) {
+  for (const sibling of proof) {
+    hash = index % 2 === 0 ? await sha256(concat(hash, sibling)) : await sha256(concat(sibling, hash));
+    index = Math.floor(index / 2);
+  }
+
+  return equal(hash, root);
+}
+
+export function toHex(bytes) {
+  return Array.from(bytes, (b) => b.toString(16).padStart(2, "0")).join("");
+}
+
+export function fromHex(hex) {
+  if (!/^([0-9a-fA-F]{2})*$/.test(hex)) {
+    throw new Error(`invalid hex ${JSON.stringify(hex)}`);
+  }
+
+  return Uint8Array.from(hex.match(/../g) ?? [], (b) => parseInt(b, 16));
+}
+
+function concat(a, b) {
+  const c = new Uint8Array(a.length + b.length);
+  c.set(a);
+  c.set(b, a.length);
+  return c;
+}
+
+function compareBytes(a, b) {
+  for (let i = 0; i < Math.min(a.length, b.length); i++) {
+    if (a[i] !== b[i]) {
+      return a[i] - b[i];
+    }
+  }
+  return a.length - b.length;
+}
+
+function equal(a, b) {
+  return a.length === b.length && a.every((v, i) => v === b[i]);
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUI(t *testing.T) {
+	ts := newTestServer(t, 1<<20)
+
+	client := &http.Client{CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+	resp, err := client.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatalf("Error sending request: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/ui/" {
+		t.Fatalf("Expected a redirect to the UI, got %v %v", resp.Status, resp.Header.Get("Location"))
+	}
+
+	for path, contentType := range map[string]string{
+		"/ui/":          "text/html",
+		"/ui/app.js":    "text/javascript",
+		"/ui/merkle.js": "text/javascript",
+		"/ui/style.css": "text/css",
+	} {
+		resp := get(t, ts.URL+path)
+		body, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode != http.StatusOK || len(body) == 0 {
+			t.Fatalf("Expected %v to be served, got %v", path, resp.Status)
+		}
+		if !strings.HasPrefix(resp.Header.Get("Content-Type"), contentType) {
+			t.Fatalf("Expected %v to be %v, got %v", path, contentType, resp.Header.Get("Content-Type"))
+		}
+		if resp.Header.Get("Content-Security-Policy") != uiContentSecurityPolicy {
+			t.Fatalf("Expected %v to have the content security policy of the UI", path)
+		}
+	}
+
+	resp = get(t, ts.URL+"/ui/missing.js")
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected a missing file to be not found, got %v", resp.Status)
+	}
+}
+
+// uiRootScript computes the root of the files on stdin like the upload of
+// the UI, with the merkle.js given as argument.
+const uiRootScript = `
+import { readFileSync } from "node:fs";
+import { pathToFileURL } from "node:url";
+
+const { merkleRoot, sha256, sortFiles, toHex } = await import(pathToFileURL(process.argv[1]));
+const files = sortFiles(JSON.parse(readFileSync(0, "utf8")));
+
+const leaves = [];
+for (const file of files) {
+  leaves.push(await sha256(new TextEncoder().encode(file.content)));
+}
+console.log(toHex(await merkleRoot(leaves)));
+`
+
+func TestUIMerkleRoot(t *testing.T) {
+	node, err := exec.LookPath("node")
+	if err != nil {
+		t.Skip("node is not installed")
+	}
+
+	// Files of nested folders are sorted by name, not by path, and names
+	// by their UTF-8 bytes, which differs from their UTF-16 code units.
+	type uiFile struct {
+		Name               string `json:"name"`
+		WebkitRelativePath string `json:"webkitRelativePath"`
+		Content            string `json:"content"`
+	}
+	files := []uiFile{
+		{"z.txt", "folder/a/z.txt", "z"},
+		{"a.txt", "folder/b/a.txt", "a"},
+		{"B.txt", "folder/B.txt", "B"},
+		{"\uff21", "folder/c/\uff21", "fullwidth"},
+		{"\U0001f600", "folder/\U0001f600", "emoji"},
+		{"\u00e9", "folder/d/e/\u00e9", "accent"},
+	}
+
+	script, err := filepath.Abs(filepath.Join("ui", "merkle.js"))
+	if err != nil {
+		t.Fatalf("Error resolving merkle.js: %v", err)
+	}
+	input, _ := json.Marshal(files)
+	cmd := exec.Command(node, "--input-type=module", "-e", uiRootScript, script)
+	cmd.Stdin = bytes.NewReader(input)
+	output, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Error running merkle.js: %v", err)
+	}
+
+	ts := newTestServer(t, 1<<20)
+	contents := make(map[string]string)
+	for _, file := range files {
+		contents[file.Name] = file.Content
+	}
+	var uploadResponse UploadResponse
+	json.NewDecoder(upload(t, http.MethodPost, ts.URL+"/v1/sets", "", contents).Body).Decode(&uploadResponse)
+
+	root := strings.TrimSpace(string(output))
+	if root != uploadResponse.Root {
+		t.Fatalf("Expected the UI to compute root %v of the server, got %v", uploadResponse.Root, root)
+	}
+}